@@ -3,64 +3,113 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"golang.org/x/crypto/bcrypt"
 )
 
-// jwtClaims contains the claims of a issued JSON Web Token.
+// Claims contains the claims of an access token.
+type Claims struct {
+	AccountID int64
+	TokenID   string
+	Role      string
+}
+
+// jwtClaims contains the claims of a issued JSON Web Token. The token ID is
+// stored in the standard jti claim.
 type jwtClaims struct {
 	jwt.StandardClaims
-	AccountID int64 `json:"https://desafio-go-stone.local/account_id"`
+	AccountID int64  `json:"https://desafio-go-stone.local/account_id"`
+	Role      string `json:"https://desafio-go-stone.local/role,omitempty"`
 }
 
-// jwtMethod is the method for signing JSON Web Token.
-var jwtMethod = jwt.SigningMethodHS256
+// The lifetimes of the tokens of a session.
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// EncodeToken returns a JSON Web Token with claims, signed by the signing key
+// of keys. The token is valid for AccessTokenTTL.
+func EncodeToken(keys *KeySet, claims *Claims) (string, error) {
+	c := &jwtClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        claims.TokenID,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(AccessTokenTTL).Unix(),
+		},
+		AccountID: claims.AccountID,
+		Role:      claims.Role,
+	}
+
+	t := jwt.NewWithClaims(keys.signing.method, c)
+	if keys.signing.ID != "" {
+		t.Header["kid"] = keys.signing.ID
+	}
+	return t.SignedString(keys.signing.private)
+}
 
-// HashPassword returns the hash for password.
-func HashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// DecodeToken returns the claims encoded in a JSON Web token. The token is
+// verified with the key of keys named by its kid header. Returns an error if
+// the token is malformed, has expired or has no ID.
+func DecodeToken(keys *KeySet, token string) (*Claims, error) {
+	t, err := jwt.ParseWithClaims(token, &jwtClaims{}, keys.verificationKey)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	c := t.Claims.(*jwtClaims)
+	if c.Id == "" {
+		return nil, errors.New("missing token id")
 	}
-	return string(hash), nil
+	return &Claims{AccountID: c.AccountID, TokenID: c.Id, Role: c.Role}, nil
 }
 
-// ComparePassword compares a password hash with its value.
-func ComparePassword(hash, password string) bool {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+// NewTokenID returns a random ID for a JSON Web Token.
+func NewTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
-// EncodeToken returns a JSON Web Token for a session authenticated as
-// accountID. The token is valid for one hour.
-func EncodeToken(secret []byte, accountID int64) (string, error) {
-	claims := &jwtClaims{
-		StandardClaims: jwt.StandardClaims{
-			IssuedAt:  time.Now().Unix(),
-			ExpiresAt: time.Now().Add(time.Hour).Unix(),
-		},
-		AccountID: accountID,
+// NewRefreshToken returns a random opaque refresh token.
+func NewRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	return jwt.NewWithClaims(jwtMethod, claims).SignedString(secret)
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-// DecodeToken returns the accountID encoded from a JSON Web token. Returns an
-// error if the token is malformed or has expired.
-func DecodeToken(secret []byte, token string) (accountID int64, err error) {
-	t, err := jwt.ParseWithClaims(
-		token,
-		&jwtClaims{},
-		func(t *jwt.Token) (interface{}, error) {
-			if t.Method.Alg() != jwtMethod.Alg() {
-				return nil, errors.New("unexpected signing method")
-			}
-			return secret, nil
-		},
-	)
-	if err != nil {
-		return 0, err
+// HashRefreshToken returns the hash of a refresh token, which is stored in
+// place of the token itself.
+func HashRefreshToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// APIKeyPrefix starts every API key, telling them apart from JSON Web Tokens.
+const APIKeyPrefix = "sk_"
+
+// NewAPIKey returns a random API key.
+func NewAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	return t.Claims.(*jwtClaims).AccountID, nil
+	return APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashAPIKey returns the hash of an API key, which is stored in place of the
+// key itself.
+func HashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
 }
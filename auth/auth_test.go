@@ -1,9 +1,19 @@
 package auth
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestPassword(t *testing.T) {
@@ -12,14 +22,155 @@ func TestPassword(t *testing.T) {
 	require.True(t, ComparePassword(hash, "secret"))
 }
 
+func TestPasswordHashers(t *testing.T) {
+	bcryptHasher := &BcryptHasher{Cost: bcrypt.MinCost}
+	argon2idHasher := &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32}
+
+	for _, h := range []PasswordHasher{bcryptHasher, argon2idHasher} {
+		hash, err := h.Hash("secret")
+		require.NoError(t, err)
+		require.True(t, ComparePassword(hash, "secret"))
+		require.False(t, ComparePassword(hash, "other secret"))
+		require.False(t, h.NeedsRehash(hash))
+	}
+
+	bcryptHash, err := bcryptHasher.Hash("secret")
+	require.NoError(t, err)
+	argon2idHash, err := argon2idHasher.Hash("secret")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(argon2idHash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	// hashes of other algorithms or weaker parameters need to be rehashed
+	require.True(t, bcryptHasher.NeedsRehash(argon2idHash))
+	require.True(t, argon2idHasher.NeedsRehash(bcryptHash))
+	require.True(t, (&BcryptHasher{Cost: bcrypt.MinCost + 1}).NeedsRehash(bcryptHash))
+	require.True(t, (&Argon2idHasher{Time: 2, Memory: 1024, Threads: 1, KeyLen: 32}).NeedsRehash(argon2idHash))
+	require.True(t, (&Argon2idHasher{Time: 1, Memory: 2048, Threads: 1, KeyLen: 32}).NeedsRehash(argon2idHash))
+
+	require.False(t, ComparePassword("$argon2id$v=19$m=1024,t=1,p=1$invalid", "secret"))
+}
+
 func TestToken(t *testing.T) {
 	const accountID = 1000
-	secret := []byte("secret")
+	secret := NewHMACKeySet([]byte("secret"))
+
+	tokenID, err := NewTokenID()
+	require.NoError(t, err)
+
+	token, err := EncodeToken(secret, &Claims{AccountID: accountID, TokenID: tokenID, Role: "admin"})
+	require.NoError(t, err)
+
+	claims, err := DecodeToken(secret, token)
+	require.NoError(t, err)
+	require.EqualValues(t, accountID, claims.AccountID)
+	require.Equal(t, tokenID, claims.TokenID)
+	require.Equal(t, "admin", claims.Role)
+
+	_, err = DecodeToken(NewHMACKeySet([]byte("other secret")), token)
+	require.Error(t, err)
+}
+
+// encodePEM encodes a key in the PKCS #8 or PKIX formats.
+func encodePEM(t *testing.T, key interface{}) []byte {
+	if pub, ok := key.(ed25519.PublicKey); ok {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		require.NoError(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestKeyRotation(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	oldKey, err := ParsePEMKey("old", encodePEM(t, rsaKey))
+	require.NoError(t, err)
+
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	newKey, err := ParsePEMKey("new", encodePEM(t, edKey))
+	require.NoError(t, err)
+
+	oldKeys, err := NewKeySet("old", oldKey)
+	require.NoError(t, err)
+	oldToken, err := EncodeToken(oldKeys, &Claims{AccountID: 1, TokenID: "old-token"})
+	require.NoError(t, err)
+
+	// the rotated key set signs with the new key and still verifies tokens
+	// signed with the old one
+	keys, err := NewKeySet("new", oldKey, newKey)
+	require.NoError(t, err)
+	newToken, err := EncodeToken(keys, &Claims{AccountID: 1, TokenID: "new-token"})
+	require.NoError(t, err)
+
+	parsed, _, err := new(jwt.Parser).ParseUnverified(newToken, &jwtClaims{})
+	require.NoError(t, err)
+	require.Equal(t, "EdDSA", parsed.Method.Alg())
+	require.Equal(t, "new", parsed.Header["kid"])
+
+	for tokenID, token := range map[string]string{"old-token": oldToken, "new-token": newToken} {
+		claims, err := DecodeToken(keys, token)
+		require.NoError(t, err)
+		require.Equal(t, tokenID, claims.TokenID)
+	}
+
+	// services holding only the public key verify the tokens
+	pubKey, err := ParsePEMKey("new", encodePEM(t, edPub))
+	require.NoError(t, err)
+	_, err = NewKeySet("new", pubKey)
+	require.Error(t, err)
+
+	verifier := &KeySet{keys: map[string]*Key{"new": pubKey}}
+	_, err = DecodeToken(verifier, newToken)
+	require.NoError(t, err)
+	_, err = DecodeToken(verifier, oldToken)
+	require.Error(t, err)
+
+	jwks := keys.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	require.Equal(t, JWK{KeyType: "OKP", KeyID: "new", Use: "sig", Algorithm: "EdDSA", Curve: "Ed25519", X: jwt.EncodeSegment(edPub)}, jwks.Keys[0])
+	require.Equal(t, "RSA", jwks.Keys[1].KeyType)
+	require.Equal(t, "AQAB", jwks.Keys[1].E)
+
+	require.Empty(t, NewHMACKeySet([]byte("secret")).JWKS().Keys)
+}
+
+func TestLoadKeySet(t *testing.T) {
+	dir := t.TempDir()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "2021-01.pem"), encodePEM(t, key), 0600))
+
+	keys, err := LoadKeySet(dir, "2021-01")
+	require.NoError(t, err)
+	require.Len(t, keys.JWKS().Keys, 1)
+
+	_, err = LoadKeySet(dir, "2021-02")
+	require.Error(t, err)
+}
+
+func TestRefreshToken(t *testing.T) {
+	token, err := NewRefreshToken()
+	require.NoError(t, err)
+
+	other, err := NewRefreshToken()
+	require.NoError(t, err)
+	require.NotEqual(t, token, other)
+
+	require.Equal(t, HashRefreshToken(token), HashRefreshToken(token))
+	require.NotEqual(t, HashRefreshToken(token), HashRefreshToken(other))
+}
 
-	token, err := EncodeToken(secret, accountID)
+func TestAPIKey(t *testing.T) {
+	key, err := NewAPIKey()
 	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(key, APIKeyPrefix))
 
-	expectedAccountID, err := DecodeToken(secret, token)
+	other, err := NewAPIKey()
 	require.NoError(t, err)
-	require.EqualValues(t, expectedAccountID, accountID)
+	require.NotEqual(t, key, other)
+	require.NotEqual(t, HashAPIKey(key), HashAPIKey(other))
 }
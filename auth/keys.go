@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Key is a key for signing and verifying JSON Web Tokens. Keys parsed from
+// public keys are only able to verify tokens.
+type Key struct {
+	ID      string
+	method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+// NewHMACKey returns a HS256 key identified by id.
+func NewHMACKey(id string, secret []byte) *Key {
+	return &Key{ID: id, method: jwt.SigningMethodHS256, private: secret, public: secret}
+}
+
+// ParsePEMKey parses a PEM encoded RSA or Ed25519 key identified by id. RSA
+// keys sign tokens with RS256 and Ed25519 keys with EdDSA. Private keys must
+// use the PKCS #8 or PKCS #1 formats and public keys the PKIX or PKCS #1
+// formats.
+func ParsePEMKey(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("auth: no PEM data found")
+	}
+
+	var (
+		parsed interface{}
+		err    error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("auth: unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("auth: error parsing key %q: %w", id, err)
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &Key{ID: id, method: jwt.SigningMethodRS256, private: k, public: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		return &Key{ID: id, method: jwt.SigningMethodRS256, public: k}, nil
+	case ed25519.PrivateKey:
+		return &Key{ID: id, method: signingMethodEdDSA, private: k, public: k.Public()}, nil
+	case ed25519.PublicKey:
+		return &Key{ID: id, method: signingMethodEdDSA, public: k}, nil
+	default:
+		return nil, fmt.Errorf("auth: unsupported key type %T", parsed)
+	}
+}
+
+// KeySet holds the key used for signing new tokens along with the keys
+// accepted when verifying tokens. During a key rotation the set keeps the
+// previous keys, so tokens signed by them remain valid until they expire.
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+// NewKeySet returns a key set that signs tokens with the key identified by
+// signingKeyID and verifies tokens with any of keys.
+func NewKeySet(signingKeyID string, keys ...*Key) (*KeySet, error) {
+	ks := &KeySet{keys: map[string]*Key{}}
+	for _, k := range keys {
+		if _, ok := ks.keys[k.ID]; ok {
+			return nil, fmt.Errorf("auth: duplicated key id %q", k.ID)
+		}
+		ks.keys[k.ID] = k
+	}
+
+	ks.signing = ks.keys[signingKeyID]
+	if ks.signing == nil {
+		return nil, fmt.Errorf("auth: signing key %q not found", signingKeyID)
+	}
+	if ks.signing.private == nil {
+		return nil, fmt.Errorf("auth: signing key %q is a public key", signingKeyID)
+	}
+	return ks, nil
+}
+
+// NewHMACKeySet returns a key set with a single HS256 key without ID.
+func NewHMACKeySet(secret []byte) *KeySet {
+	k := NewHMACKey("", secret)
+	return &KeySet{signing: k, keys: map[string]*Key{k.ID: k}}
+}
+
+// LoadKeySet returns a key set with the PEM encoded keys stored in dir. Every
+// file with the .pem extension holds a key whose ID is the name of the file
+// without the extension.
+func LoadKeySet(dir, signingKeyID string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*Key
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		k, err := ParsePEMKey(strings.TrimSuffix(filepath.Base(path), ".pem"), data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return NewKeySet(signingKeyID, keys...)
+}
+
+// verificationKey returns the key for verifying a token with given header.
+func (ks *KeySet) verificationKey(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	k, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	// the algorithm must be the one of the key, otherwise a public key
+	// could be used as a HMAC secret
+	if t.Method.Alg() != k.method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return k.public, nil
+}
+
+// JWK represents a public key in the JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// JWKS represents a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of ks sorted by ID. HMAC keys are secret and
+// are never included.
+func (ks *KeySet) JWKS() *JWKS {
+	set := &JWKS{Keys: []JWK{}}
+	for _, k := range ks.keys {
+		jwk := JWK{KeyID: k.ID, Use: "sig", Algorithm: k.method.Alg()}
+		switch pub := k.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].KeyID < set.Keys[j].KeyID
+	})
+	return set
+}
+
+// signingMethodEdDSA signs tokens with Ed25519 keys, which is not supported by
+// the jwt package.
+var signingMethodEdDSA = &edDSASigningMethod{}
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+// edDSASigningMethod implements the EdDSA signing method of RFC 8037.
+type edDSASigningMethod struct{}
+
+func (m *edDSASigningMethod) Alg() string { return "EdDSA" }
+
+func (m *edDSASigningMethod) Sign(signingString string, key interface{}) (string, error) {
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(k, []byte(signingString))), nil
+}
+
+func (m *edDSASigningMethod) Verify(signingString, signature string, key interface{}) error {
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(k, []byte(signingString), sig) {
+		return errors.New("auth: signature is invalid")
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords with an algorithm and its parameters.
+type PasswordHasher interface {
+	// Hash returns the hash for password.
+	Hash(password string) (string, error)
+
+	// NeedsRehash reports whether hash was produced by another algorithm or
+	// with weaker parameters than the ones of the hasher.
+	NeedsRehash(hash string) bool
+}
+
+// DefaultPasswordHasher is the hasher used by HashPassword.
+var DefaultPasswordHasher PasswordHasher = &BcryptHasher{Cost: bcrypt.DefaultCost}
+
+// HashPassword returns the hash for password produced by
+// DefaultPasswordHasher.
+func HashPassword(password string) (string, error) {
+	return DefaultPasswordHasher.Hash(password)
+}
+
+// ComparePassword compares a password hash with its value. The hash may be
+// produced by any of the supported hashers.
+func ComparePassword(hash, password string) bool {
+	if strings.HasPrefix(hash, argon2idPrefix) {
+		params, salt, key, err := decodeArgon2idHash(hash)
+		if err != nil {
+			return false
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// BcryptHasher hashes passwords with bcrypt.
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash implements the PasswordHasher interface.
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// NeedsRehash implements the PasswordHasher interface.
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < h.Cost
+}
+
+// Argon2idHasher hashes passwords with argon2id. The hashes are encoded in the
+// PHC string format used by the reference implementation.
+type Argon2idHasher struct {
+	// Time is the number of passes over the memory.
+	Time uint32
+
+	// Memory is the size of the memory in KiB.
+	Memory uint32
+
+	// Threads is the number of threads.
+	Threads uint8
+
+	// KeyLen is the length of the hash in bytes.
+	KeyLen uint32
+}
+
+// NewArgon2idHasher returns an argon2id hasher with the parameters
+// recommended by RFC 9106 for memory constrained environments.
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{Time: 3, Memory: 64 * 1024, Threads: 4, KeyLen: 32}
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// Hash implements the PasswordHasher interface.
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		h.Memory,
+		h.Time,
+		h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// NeedsRehash implements the PasswordHasher interface.
+func (h *Argon2idHasher) NeedsRehash(hash string) bool {
+	params, _, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return true
+	}
+	return params.Time < h.Time ||
+		params.Memory < h.Memory ||
+		params.Threads < h.Threads ||
+		uint32(len(key)) < h.KeyLen
+}
+
+// decodeArgon2idHash decodes the parameters, the salt and the key of a hash
+// produced by an Argon2idHasher.
+func decodeArgon2idHash(hash string) (params *Argon2idHasher, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, errors.New("auth: invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, err
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("auth: unsupported argon2 version %d", version)
+	}
+
+	params = &Argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, err
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, nil, nil, err
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, nil, nil, err
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTP(t *testing.T) {
+	// test vectors of RFC 6238, truncated to six digits
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for unix, expected := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := TOTPCode(secret, time.Unix(unix, 0))
+		require.NoError(t, err)
+		require.Equal(t, expected, code)
+	}
+
+	now := time.Unix(1234567890, 0)
+	step, ok := ValidateTOTP(secret, "005924", now)
+	require.True(t, ok)
+	require.EqualValues(t, 1234567890/30, step)
+
+	// codes of the previous and next periods are accepted
+	_, ok = ValidateTOTP(secret, "005924", now.Add(30*time.Second))
+	require.True(t, ok)
+	_, ok = ValidateTOTP(secret, "005924", now.Add(time.Minute))
+	require.False(t, ok)
+	_, ok = ValidateTOTP(secret, "000000", now)
+	require.False(t, ok)
+
+	secret2, err := NewTOTPSecret()
+	require.NoError(t, err)
+	code, err := TOTPCode(secret2, now)
+	require.NoError(t, err)
+	_, ok = ValidateTOTP(secret2, code, now)
+	require.True(t, ok)
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := NewRecoveryCodes(10)
+	require.NoError(t, err)
+	require.Len(t, codes, 10)
+	require.Len(t, codes[0], 11)
+	require.NotEqual(t, codes[0], codes[1])
+	key := []byte("0123456789abcdef0123456789abcdef")
+	require.Equal(t, HashRecoveryCode(key, codes[0]), HashRecoveryCode(key, " "+codes[0][:5]+codes[0][6:]+" "))
+	require.NotEqual(t, HashRecoveryCode(key, codes[0]), HashRecoveryCode([]byte("fedcba9876543210fedcba9876543210"), codes[0]))
+}
+
+func TestEncryptSecret(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	encrypted, err := EncryptSecret(key, "GEZDGNBVGY3TQOJQ")
+	require.NoError(t, err)
+	require.NotContains(t, encrypted, "GEZDGNBVGY3TQOJQ")
+
+	secret, err := DecryptSecret(key, encrypted)
+	require.NoError(t, err)
+	require.Equal(t, "GEZDGNBVGY3TQOJQ", secret)
+
+	_, err = DecryptSecret([]byte("fedcba9876543210fedcba9876543210"), encrypted)
+	require.Error(t, err)
+}
@@ -2,68 +2,1472 @@
 package database
 
 import (
+	"context"
 	"errors"
 	"time"
 
 	"github.com/shopspring/decimal"
+
+	"github.com/lindebergue/desafio-go-stone/document"
+	"github.com/lindebergue/desafio-go-stone/money"
 )
 
 var (
 	// ErrAccountNotFound indicates that an account cannot be found.
 	ErrAccountNotFound = errors.New("database: account not found")
 
-	// ErrAccountAlreadyExists indicates that an account with same CPF already
-	// exists.
+	// ErrAccountAlreadyExists indicates that an account with same document
+	// already exists.
 	ErrAccountAlreadyExists = errors.New("database: account already exists")
 
+	// ErrAccountDocumentMismatch indicates that an account does not have the
+	// document required by its type: a CPF for individuals and a CNPJ for
+	// businesses.
+	ErrAccountDocumentMismatch = errors.New("database: account document mismatch")
+
+	// ErrAccountFrozen indicates that money cannot leave an account because
+	// it was frozen.
+	ErrAccountFrozen = errors.New("database: account frozen")
+
+	// ErrAccountBlocked indicates that money cannot enter or leave an account
+	// because it was blocked.
+	ErrAccountBlocked = errors.New("database: account blocked")
+
+	// ErrAccountClosed indicates that an account was closed and can no longer
+	// be used.
+	ErrAccountClosed = errors.New("database: account closed")
+
+	// ErrInvalidStatusTransition indicates that an account cannot change from
+	// its current status to the requested one.
+	ErrInvalidStatusTransition = errors.New("database: invalid status transition")
+
+	// ErrAccountBalanceNotZero indicates that an account cannot be closed
+	// because it is overdrawn, or because it still has funds and no account
+	// to sweep them to was given.
+	ErrAccountBalanceNotZero = errors.New("database: account balance not zero")
+
+	// ErrTOTPAlreadyEnabled indicates that an account already confirmed its
+	// TOTP enrollment.
+	ErrTOTPAlreadyEnabled = errors.New("database: totp already enabled")
+
+	// ErrTOTPNotEnrolled indicates that an account has no pending TOTP
+	// enrollment.
+	ErrTOTPNotEnrolled = errors.New("database: totp not enrolled")
+
+	// ErrTOTPCodeReused indicates that a TOTP code of the same or a later
+	// time step was already used by an account.
+	ErrTOTPCodeReused = errors.New("database: totp code reused")
+
+	// ErrRecoveryCodeNotFound indicates that a recovery code does not belong
+	// to an account or was already used.
+	ErrRecoveryCodeNotFound = errors.New("database: recovery code not found")
+
+	// ErrInvalidAmount indicates that an amount is not positive or has more
+	// decimal places than its currency allows.
+	ErrInvalidAmount = errors.New("database: invalid amount")
+
+	// ErrInvalidCurrency indicates that a currency is not supported.
+	ErrInvalidCurrency = errors.New("database: invalid currency")
+
+	// ErrExchangeRateNotFound indicates that there is no exchange rate for
+	// converting between two currencies.
+	ErrExchangeRateNotFound = errors.New("database: exchange rate not found")
+
+	// ErrInvalidExchangeRate indicates that an exchange rate is not positive or
+	// converts a currency to itself.
+	ErrInvalidExchangeRate = errors.New("database: invalid exchange rate")
+
+	// ErrSelfTransfer indicates that the origin and the destination of a
+	// transfer are the same account.
+	ErrSelfTransfer = errors.New("database: self transfer")
+
 	// ErrNotEnoughFunds indicates that a transfer cannot be completed due to
 	// insufficient funds.
 	ErrNotEnoughFunds = errors.New("database: not enough funds")
+
+	// ErrLimitExceeded indicates that a transfer cannot be completed because
+	// it exceeds one of the transfer limits of its origin account.
+	ErrLimitExceeded = errors.New("database: limit exceeded")
+
+	// ErrInvalidTransferLimit indicates that a transfer limit is of an unknown
+	// kind.
+	ErrInvalidTransferLimit = errors.New("database: invalid transfer limit")
+
+	// ErrInvalidFeeSchedule indicates that a fee schedule is not valid.
+	ErrInvalidFeeSchedule = errors.New("database: invalid fee schedule")
+
+	// ErrInvalidCreditLine indicates that a credit limit or an overdraft rate
+	// is negative, or that the credit limit has more decimal places than
+	// money.DefaultCurrency allows.
+	ErrInvalidCreditLine = errors.New("database: invalid credit line")
+
+	// ErrTransferNotFound indicates that a transfer cannot be found.
+	ErrTransferNotFound = errors.New("database: transfer not found")
+
+	// ErrTransferAlreadyReversed indicates that a transfer was already
+	// reversed.
+	ErrTransferAlreadyReversed = errors.New("database: transfer already reversed")
+
+	// ErrTransferNotReversible indicates that a transfer cannot be reversed
+	// because it is itself a reversal.
+	ErrTransferNotReversible = errors.New("database: transfer not reversible")
+
+	// ErrReversalAmountExceeded indicates that the amount of a reversal is
+	// greater than the amount of the reversed transfer.
+	ErrReversalAmountExceeded = errors.New("database: reversal amount exceeded")
+
+	// ErrScheduledTransferNotFound indicates that a scheduled transfer cannot
+	// be found.
+	ErrScheduledTransferNotFound = errors.New("database: scheduled transfer not found")
+
+	// ErrScheduledTransferNotActive indicates that a scheduled transfer was
+	// already cancelled or completed.
+	ErrScheduledTransferNotActive = errors.New("database: scheduled transfer not active")
+
+	// ErrSessionNotFound indicates that a session cannot be found, or that it
+	// was revoked or has expired.
+	ErrSessionNotFound = errors.New("database: session not found")
+
+	// ErrRefreshTokenReused indicates that a refresh token was used after being
+	// rotated, which causes its session to be revoked.
+	ErrRefreshTokenReused = errors.New("database: refresh token reused")
+
+	// ErrAPIKeyNotFound indicates that an API key cannot be found or was
+	// revoked.
+	ErrAPIKeyNotFound = errors.New("database: api key not found")
+
+	// ErrLoginThrottleNotFound indicates that there are no failed login
+	// attempts for a key.
+	ErrLoginThrottleNotFound = errors.New("database: login throttle not found")
+
+	// ErrLoginLocked indicates that the failed login attempts for a key lock
+	// new attempts.
+	ErrLoginLocked = errors.New("database: login locked")
+
+	// ErrIdempotencyKeyNotFound indicates that an idempotency key cannot be
+	// found.
+	ErrIdempotencyKeyNotFound = errors.New("database: idempotency key not found")
+
+	// ErrIdempotencyKeyAlreadyExists indicates that an idempotency key was
+	// already used by the same account.
+	ErrIdempotencyKeyAlreadyExists = errors.New("database: idempotency key already exists")
 )
 
-// Account represents a bank account and its balance.
+// Role represents the role of an account, which defines the operations it is
+// allowed to perform.
+type Role string
+
+// The account roles.
+const (
+	RoleCustomer Role = "customer"
+	RoleOperator Role = "operator"
+	RoleSupport  Role = "support"
+	RoleAdmin    Role = "admin"
+)
+
+// AccountStatus represents the status of an account.
+type AccountStatus string
+
+// The account statuses. Money cannot leave frozen accounts, but they still
+// receive transfers and can log in. Blocked accounts cannot log in nor move
+// money in any direction. Reversals are made by operators and are allowed on
+// both. Closed accounts are permanently disabled and never change status
+// again.
+const (
+	AccountActive  AccountStatus = "active"
+	AccountFrozen  AccountStatus = "frozen"
+	AccountBlocked AccountStatus = "blocked"
+	AccountClosed  AccountStatus = "closed"
+)
+
+// CanTransitionTo reports whether an account can change from status s to next.
+// Accounts move freely between the active, frozen and blocked statuses, while
+// closing is only done by DB.CloseAccount.
+func (s AccountStatus) CanTransitionTo(next AccountStatus) bool {
+	switch next {
+	case AccountActive, AccountFrozen, AccountBlocked:
+		return s != next && s != AccountClosed
+	default:
+		return false
+	}
+}
+
+// checkDebit returns the error preventing money from leaving account, if any.
+func checkDebit(account *Account, reversal bool) error {
+	switch {
+	case account.Status == AccountClosed:
+		return ErrAccountClosed
+	case reversal:
+		return nil
+	case account.Status == AccountBlocked:
+		return ErrAccountBlocked
+	case account.Status == AccountFrozen:
+		return ErrAccountFrozen
+	}
+	return nil
+}
+
+// checkCredit returns the error preventing money from entering account, if
+// any.
+func checkCredit(account *Account, reversal bool) error {
+	switch {
+	case account.Status == AccountClosed:
+		return ErrAccountClosed
+	case reversal:
+		return nil
+	case account.Status == AccountBlocked:
+		return ErrAccountBlocked
+	}
+	return nil
+}
+
+// AccountType represents the type of the holder of an account.
+type AccountType string
+
+// The account types.
+const (
+	AccountIndividual AccountType = "individual"
+	AccountBusiness   AccountType = "business"
+)
+
+// Account represents a bank account and its balance. Individual accounts are
+// identified by a CPF and business accounts by a CNPJ.
+//
+// Balance is the balance in money.DefaultCurrency. Accounts may also hold
+// money in other currencies, which is kept in wallets.
+//
+// Accounts approved for an overdraft have a credit line: their balance may go
+// below zero down to -CreditLimit, and the negative balance is charged
+// OverdraftRate of interest per day. The credit line only covers
+// money.DefaultCurrency.
+//
+// Accounts may enroll a TOTP authenticator as a second factor. The TOTP secret
+// is stored encrypted and the recovery codes are stored hashed; the
+// enrollment only takes effect after being confirmed with a valid code.
 type Account struct {
 	ID        int64           `json:"id"`
 	Name      string          `json:"name"`
-	CPF       string          `json:"cpf"`
+	Type      AccountType     `json:"type"`
+	CPF       string          `json:"cpf,omitempty"`
+	CNPJ      string          `json:"cnpj,omitempty"`
 	Secret    string          `json:"-"`
+	Role      Role            `json:"role"`
+	Status    AccountStatus   `json:"status"`
 	Balance   decimal.Decimal `json:"balance" pg:",use_zero"`
 	CreatedAt time.Time       `json:"created_at"`
+
+	CreditLimit   decimal.Decimal `json:"credit_limit" pg:",use_zero"`
+	OverdraftRate decimal.Decimal `json:"overdraft_rate" pg:",use_zero"`
+
+	TOTPSecret        string   `json:"-" pg:"totp_secret"`
+	TOTPEnabled       bool     `json:"-" pg:"totp_enabled,use_zero"`
+	TOTPLastStep      int64    `json:"-" pg:"totp_last_step,use_zero"`
+	TOTPRecoveryCodes []string `json:"-" pg:"totp_recovery_codes,array"`
 }
 
-// Transfer represents a balance transfer between accounts.
+// Document returns the document identifying the holder of an account.
+func (a *Account) Document() string {
+	if a.Type == AccountBusiness {
+		return a.CNPJ
+	}
+	return a.CPF
+}
+
+// prepareAccount fills the defaults of a new account and normalizes its
+// documents. New accounts are always active. Returns
+// ErrAccountDocumentMismatch if the account does not have only the document of
+// its type.
+func prepareAccount(account *Account) error {
+	if account.Type == "" {
+		account.Type = AccountIndividual
+	}
+	if account.Role == "" {
+		account.Role = RoleCustomer
+	}
+	account.Status = AccountActive
+	account.CPF = document.NormalizeCPF(account.CPF)
+	account.CNPJ = document.NormalizeCNPJ(account.CNPJ)
+
+	switch account.Type {
+	case AccountIndividual:
+		if account.CPF == "" || account.CNPJ != "" {
+			return ErrAccountDocumentMismatch
+		}
+	case AccountBusiness:
+		if account.CNPJ == "" || account.CPF != "" {
+			return ErrAccountDocumentMismatch
+		}
+	default:
+		return ErrAccountDocumentMismatch
+	}
+	return nil
+}
+
+// AvailableBalance returns the money of the account available for leaving its
+// wallet of money.DefaultCurrency, which includes its credit line.
+func (a *Account) AvailableBalance() decimal.Decimal {
+	return a.Balance.Add(a.CreditLimit)
+}
+
+// availableFunds returns the money of account available for leaving its wallet
+// of currency c, which holds balance.
+func availableFunds(account *Account, c money.Currency, balance decimal.Decimal) decimal.Decimal {
+	if c == money.DefaultCurrency {
+		return balance.Add(account.CreditLimit)
+	}
+	return balance
+}
+
+// checkCreditLine returns ErrInvalidCreditLine if limit or rate cannot make
+// the credit line of an account.
+func checkCreditLine(limit, rate decimal.Decimal) error {
+	if limit.IsNegative() || rate.IsNegative() {
+		return ErrInvalidCreditLine
+	}
+	if !limit.Equal(limit.Truncate(money.DefaultCurrency.Places())) {
+		return ErrInvalidCreditLine
+	}
+	return nil
+}
+
+// overdraftInterest returns the interest of a day charged on the negative
+// balance of account, or zero if its balance is not negative.
+func overdraftInterest(account *Account) decimal.Decimal {
+	if !account.Balance.IsNegative() {
+		return decimal.Zero
+	}
+	return money.Convert(account.Balance.Neg(), account.OverdraftRate, money.DefaultCurrency)
+}
+
+// Wallet represents the balance of an account in a currency. The balance of
+// the wallet of money.DefaultCurrency is the Balance of the account itself.
+type Wallet struct {
+	AccountID int64           `json:"-" pg:",pk"`
+	Currency  money.Currency  `json:"currency" pg:",pk"`
+	Balance   decimal.Decimal `json:"balance" pg:",use_zero"`
+}
+
+// ExchangeRate represents the rate for converting money from the Base currency
+// to the Quote currency: one unit of Base is worth Rate units of Quote. Each
+// direction has its own rate, so the rate from Quote to Base is not
+// necessarily the inverse of Rate.
+type ExchangeRate struct {
+	Base      money.Currency  `json:"base" pg:",pk"`
+	Quote     money.Currency  `json:"quote" pg:",pk"`
+	Rate      decimal.Decimal `json:"rate" pg:",use_zero"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// checkExchangeRate returns the error of storing rate, if any.
+func checkExchangeRate(rate *ExchangeRate) error {
+	if !rate.Base.Valid() || !rate.Quote.Valid() {
+		return ErrInvalidCurrency
+	}
+	if rate.Base == rate.Quote || !rate.Rate.IsPositive() {
+		return ErrInvalidExchangeRate
+	}
+	return nil
+}
+
+// Transfer represents a balance transfer between accounts. A transfer with
+// ReversedTransferID is a reversal, which gives back all or part of the amount
+// of the reversed transfer.
+//
+// Amount is debited from the wallet of Currency of the origin, and
+// DestinationAmount is credited into the wallet of DestinationCurrency of the
+// destination. Transfers between different currencies convert the amount by
+// ExchangeRate, which is one for transfers within the same currency. Fee is
+// debited from the origin on top of Amount, also in Currency, and credited
+// into the revenue account of the fee schedule of the transfer.
 type Transfer struct {
 	ID                   int64           `json:"id"`
 	AccountOriginID      int64           `json:"account_origin_id"`
 	AccountDestinationID int64           `json:"account_destination_id"`
 	Amount               decimal.Decimal `json:"amount" pg:",use_zero"`
+	Currency             money.Currency  `json:"currency"`
+	DestinationAmount    decimal.Decimal `json:"destination_amount" pg:",use_zero"`
+	DestinationCurrency  money.Currency  `json:"destination_currency"`
+	ExchangeRate         decimal.Decimal `json:"exchange_rate" pg:",use_zero"`
+	Fee                  decimal.Decimal `json:"fee" pg:",use_zero"`
+	ReversedTransferID   int64           `json:"reversed_transfer_id,omitempty"`
+	Reason               string          `json:"reason,omitempty"`
 	CreatedAt            time.Time       `json:"created_at"`
 }
 
-// DB provides methods for managing application data.
+// checkAmount returns ErrInvalidAmount if amount cannot be moved in or out of
+// an account in currency c, or ErrInvalidCurrency if c is not supported.
+func checkAmount(amount decimal.Decimal, c money.Currency) error {
+	if !c.Valid() {
+		return ErrInvalidCurrency
+	}
+	if money.ValidateAmount(amount, c) != nil {
+		return ErrInvalidAmount
+	}
+	return nil
+}
+
+// checkTransfer returns the error of transferring amount in currency c between
+// the accounts with given ids, if any.
+func checkTransfer(originID, destinationID int64, amount decimal.Decimal, c money.Currency) error {
+	if originID == destinationID {
+		return ErrSelfTransfer
+	}
+	return checkAmount(amount, c)
+}
+
+// prepareTransfer fills the currencies of transfer, which default to
+// money.DefaultCurrency for the origin and to the currency of the origin for
+// the destination, and returns the error of making it, if any.
+func prepareTransfer(transfer *Transfer) error {
+	if transfer.Currency == "" {
+		transfer.Currency = money.DefaultCurrency
+	}
+	if transfer.DestinationCurrency == "" {
+		transfer.DestinationCurrency = transfer.Currency
+	}
+	if !transfer.DestinationCurrency.Valid() {
+		return ErrInvalidCurrency
+	}
+	return checkTransfer(transfer.AccountOriginID, transfer.AccountDestinationID, transfer.Amount, transfer.Currency)
+}
+
+// convertTransfer fills the destination amount of transfer by converting its
+// amount with rate. Returns ErrInvalidAmount if the amount is too small to be
+// converted.
+func convertTransfer(transfer *Transfer, rate decimal.Decimal) error {
+	transfer.ExchangeRate = rate
+	transfer.DestinationAmount = money.Convert(transfer.Amount, rate, transfer.DestinationCurrency)
+	if !transfer.DestinationAmount.IsPositive() {
+		return ErrInvalidAmount
+	}
+	return nil
+}
+
+// sameCurrencyRate is the exchange rate of transfers within the same currency.
+var sameCurrencyRate = decimal.NewFromInt(1)
+
+// prepareReversal fills reversal for giving back the amount of original. A
+// zero amount reverses the whole amount received by the destination of
+// original. The amount is converted back at the rate of original, so a full
+// reversal restores exactly the amount that left its origin.
+func prepareReversal(reversal, original *Transfer) error {
+	if reversal.Amount.IsZero() {
+		reversal.Amount = original.DestinationAmount
+	}
+	if reversal.Amount.GreaterThan(original.DestinationAmount) {
+		return ErrReversalAmountExceeded
+	}
+
+	reversal.AccountOriginID = original.AccountDestinationID
+	reversal.AccountDestinationID = original.AccountOriginID
+	reversal.Currency = original.DestinationCurrency
+	reversal.DestinationCurrency = original.Currency
+
+	rate := sameCurrencyRate
+	if original.Currency != original.DestinationCurrency {
+		rate = sameCurrencyRate.Div(original.ExchangeRate)
+	}
+	if err := convertTransfer(reversal, rate); err != nil {
+		return err
+	}
+	if reversal.Amount.Equal(original.DestinationAmount) {
+		reversal.DestinationAmount = original.Amount
+	}
+	return nil
+}
+
+// TransferType represents the type of a transfer, which determines its fee.
+type TransferType string
+
+// The transfer types. Transfers between different currencies are exchanges,
+// and the others are of the type of their origin account.
+const (
+	TransferIndividual TransferType = "individual"
+	TransferBusiness   TransferType = "business"
+	TransferExchange   TransferType = "exchange"
+)
+
+// transferTypeOf returns the type of transfer, made by an account of type
+// origin.
+func transferTypeOf(transfer *Transfer, origin AccountType) TransferType {
+	switch {
+	case transfer.Currency != transfer.DestinationCurrency:
+		return TransferExchange
+	case origin == AccountBusiness:
+		return TransferBusiness
+	}
+	return TransferIndividual
+}
+
+// FeeType represents how the fee of a fee schedule is computed.
+type FeeType string
+
+// The fee types. Flat fees charge Amount from every transfer, percentage fees
+// charge Rate times the transfer amount and tiered fees charge the amount and
+// the rate of the tier of the transfer amount.
+const (
+	FeeFlat       FeeType = "flat"
+	FeePercentage FeeType = "percentage"
+	FeeTiered     FeeType = "tiered"
+)
+
+// FeeSchedule represents the fee charged from the transfers of a type. The
+// first FreeMonthlyQuota transfers of the type made by an account in a month
+// are free of charge. Fees are charged in the currency of the transfer and
+// credited into RevenueAccountID, the house account collecting them. The
+// fixed amounts and the tier bounds are in money.DefaultCurrency.
+type FeeSchedule struct {
+	TransferType     TransferType    `json:"transfer_type" pg:",pk"`
+	Type             FeeType         `json:"type"`
+	Amount           decimal.Decimal `json:"amount" pg:",use_zero"`
+	Rate             decimal.Decimal `json:"rate" pg:",use_zero"`
+	Tiers            []*FeeTier      `json:"tiers,omitempty"`
+	FreeMonthlyQuota int             `json:"free_monthly_quota" pg:",use_zero"`
+	RevenueAccountID int64           `json:"revenue_account_id"`
+	UpdatedAt        time.Time       `json:"updated_at"`
+}
+
+// FeeTier represents a tier of a tiered fee, which applies to transfer amounts
+// up to UpTo, or to any amount above the previous tier if UpTo is zero.
+type FeeTier struct {
+	UpTo   decimal.Decimal `json:"up_to"`
+	Amount decimal.Decimal `json:"amount"`
+	Rate   decimal.Decimal `json:"rate"`
+}
+
+// Fee returns the fee of a transfer of amount in currency c, given the
+// exchange rate from c into money.DefaultCurrency and the number of transfers
+// of the same type its origin already made in the month.
+func (s *FeeSchedule) Fee(amount decimal.Decimal, c money.Currency, rate decimal.Decimal, transfers int) decimal.Decimal {
+	if transfers < s.FreeMonthlyQuota {
+		return decimal.Zero
+	}
+
+	switch s.Type {
+	case FeeFlat:
+		return fixedFee(s.Amount, c, rate)
+	case FeePercentage:
+		return money.Convert(amount, s.Rate, c)
+	case FeeTiered:
+		converted := money.Convert(amount, rate, money.DefaultCurrency)
+		for _, tier := range s.Tiers {
+			if tier.UpTo.IsZero() || converted.LessThanOrEqual(tier.UpTo) {
+				return fixedFee(tier.Amount, c, rate).Add(money.Convert(amount, tier.Rate, c))
+			}
+		}
+	}
+	return decimal.Zero
+}
+
+// fixedFee returns amount, a fee in money.DefaultCurrency, in currency c,
+// given the exchange rate from c into money.DefaultCurrency.
+func fixedFee(amount decimal.Decimal, c money.Currency, rate decimal.Decimal) decimal.Decimal {
+	return amount.Div(rate).Round(c.Places())
+}
+
+// checkFeeSchedule returns the error of storing schedule, if any. The tiers of
+// tiered fees must be in ascending order, with only the last one unbounded.
+func checkFeeSchedule(schedule *FeeSchedule) error {
+	switch schedule.TransferType {
+	case TransferIndividual, TransferBusiness, TransferExchange:
+	default:
+		return ErrInvalidFeeSchedule
+	}
+	if schedule.FreeMonthlyQuota < 0 || schedule.RevenueAccountID == 0 {
+		return ErrInvalidFeeSchedule
+	}
+
+	switch schedule.Type {
+	case FeeFlat:
+		if !validFee(schedule.Amount, decimal.Zero) {
+			return ErrInvalidFeeSchedule
+		}
+	case FeePercentage:
+		if !validFee(decimal.Zero, schedule.Rate) {
+			return ErrInvalidFeeSchedule
+		}
+	case FeeTiered:
+		if len(schedule.Tiers) == 0 || !schedule.Tiers[len(schedule.Tiers)-1].UpTo.IsZero() {
+			return ErrInvalidFeeSchedule
+		}
+		previous := decimal.Zero
+		for n, tier := range schedule.Tiers {
+			last := n == len(schedule.Tiers)-1
+			if !validFee(tier.Amount, tier.Rate) || !last && !tier.UpTo.GreaterThan(previous) {
+				return ErrInvalidFeeSchedule
+			}
+			previous = tier.UpTo
+		}
+	default:
+		return ErrInvalidFeeSchedule
+	}
+	return nil
+}
+
+// validFee reports whether a fee of a flat amount plus rate times the transfer
+// amount is valid: neither can be negative, the amount is in cents and the
+// rate cannot take more than the transfer amount.
+func validFee(amount, rate decimal.Decimal) bool {
+	return !amount.IsNegative() && amount.Equal(amount.Round(money.DefaultCurrency.Places())) &&
+		!rate.IsNegative() && rate.LessThanOrEqual(decimal.NewFromInt(1))
+}
+
+// TransferLimitKind represents what a transfer limit applies to.
+type TransferLimitKind string
+
+// The kinds of transfer limits. The per-transaction limit caps the amount of
+// each transfer, the daily limit the total transferred in a day and the
+// nighttime limit the total transferred between 20h and 6h.
+const (
+	LimitPerTransaction TransferLimitKind = "per_transaction"
+	LimitDaily          TransferLimitKind = "daily"
+	LimitNighttime      TransferLimitKind = "nighttime"
+)
+
+// TransferLimitKinds lists the kinds of transfer limits in the order they are
+// checked.
+var TransferLimitKinds = []TransferLimitKind{LimitPerTransaction, LimitDaily, LimitNighttime}
+
+// defaultTransferLimits holds the limits of accounts that never changed them,
+// unless the database is given other defaults.
+var defaultTransferLimits = map[TransferLimitKind]decimal.Decimal{
+	LimitPerTransaction: decimal.NewFromInt(5_000),
+	LimitDaily:          decimal.NewFromInt(10_000),
+	LimitNighttime:      decimal.NewFromInt(1_000),
+}
+
+// transferLimitDefaults returns defaultTransferLimits with the amounts of
+// limits replacing the ones of the same kinds.
+func transferLimitDefaults(limits map[TransferLimitKind]decimal.Decimal) map[TransferLimitKind]decimal.Decimal {
+	defaults := make(map[TransferLimitKind]decimal.Decimal, len(defaultTransferLimits))
+	for kind, amount := range defaultTransferLimits {
+		defaults[kind] = amount
+	}
+	for kind, amount := range limits {
+		if _, ok := defaults[kind]; ok {
+			defaults[kind] = amount
+		}
+	}
+	return defaults
+}
+
+// TransferLimitCoolingOff is how long an increase of a transfer limit takes to
+// come into effect. Decreases are effective immediately.
+const TransferLimitCoolingOff = 24 * time.Hour
+
+// TransferLimit represents a transfer limit of an account, in
+// money.DefaultCurrency, which is in effect from EffectiveAt until a newer
+// limit of the same kind comes into effect. Limits are never changed, so the
+// limits of an account are a history of the changes it requested.
+type TransferLimit struct {
+	ID          int64             `json:"-"`
+	AccountID   int64             `json:"-"`
+	Kind        TransferLimitKind `json:"kind"`
+	Amount      decimal.Decimal   `json:"amount" pg:",use_zero"`
+	EffectiveAt time.Time         `json:"-"`
+	CreatedAt   time.Time         `json:"-"`
+}
+
+// defaultTransferLimit returns the limit of given kind of accountID when it
+// never requested a change, taken from defaults.
+func defaultTransferLimit(accountID int64, kind TransferLimitKind, defaults map[TransferLimitKind]decimal.Decimal) *TransferLimit {
+	return &TransferLimit{AccountID: accountID, Kind: kind, Amount: defaults[kind]}
+}
+
+// checkTransferLimit returns the error of requesting limit, if any.
+func checkTransferLimit(limit *TransferLimit) error {
+	if _, ok := defaultTransferLimits[limit.Kind]; !ok {
+		return ErrInvalidTransferLimit
+	}
+	return checkAmount(limit.Amount, money.DefaultCurrency)
+}
+
+// resolveTransferLimits returns the transfer limits of accountID in effect at
+// now, one of each kind, and the increases still waiting for their cooling-off
+// period, given the history of limits of the account in the order they were
+// requested and the defaults of accounts that never changed them. Each request
+// replaces the increase pending at the time, if any.
+func resolveTransferLimits(accountID int64, history []*TransferLimit, defaults map[TransferLimitKind]decimal.Decimal, now time.Time) (current, pending []*TransferLimit) {
+	for _, kind := range TransferLimitKinds {
+		effective := defaultTransferLimit(accountID, kind, defaults)
+		var waiting *TransferLimit
+		for _, limit := range history {
+			if limit.Kind != kind {
+				continue
+			}
+			if waiting != nil && !waiting.EffectiveAt.After(limit.CreatedAt) {
+				effective = waiting
+			}
+			waiting = nil
+			if limit.EffectiveAt.After(limit.CreatedAt) {
+				waiting = limit
+			} else {
+				effective = limit
+			}
+		}
+		if waiting != nil && !waiting.EffectiveAt.After(now) {
+			effective, waiting = waiting, nil
+		}
+
+		current = append(current, effective)
+		if waiting != nil {
+			pending = append(pending, waiting)
+		}
+	}
+	return current, pending
+}
+
+// limitsByKind indexes limits by their kind.
+func limitsByKind(limits []*TransferLimit) map[TransferLimitKind]*TransferLimit {
+	byKind := make(map[TransferLimitKind]*TransferLimit, len(limits))
+	for _, limit := range limits {
+		byKind[limit.Kind] = limit
+	}
+	return byKind
+}
+
+// coolingOff returns when a change of a limit from current to requested comes
+// into effect, given that it was requested at now.
+func coolingOff(current, requested decimal.Decimal, now time.Time) time.Time {
+	if requested.GreaterThan(current) {
+		return now.Add(TransferLimitCoolingOff)
+	}
+	return now
+}
+
+// calendarLocation is the time zone of the days, nights and months of the
+// transfer limits and fees. Brazil no longer observes daylight saving time,
+// so a fixed offset does not depend on the time zone database of the host.
+var calendarLocation = time.FixedZone("BRT", -3*60*60)
+
+// The hours when the nighttime limit starts and ends.
+const (
+	nightStartHour = 20
+	nightEndHour   = 6
+)
+
+// dayOf returns the start and the end of the day containing t.
+func dayOf(t time.Time) (start, end time.Time) {
+	t = t.In(calendarLocation)
+	start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, calendarLocation)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// monthOf returns the start and the end of the month containing t.
+func monthOf(t time.Time) (start, end time.Time) {
+	t = t.In(calendarLocation)
+	start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, calendarLocation)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// nightOf returns the start and the end of the night containing t, or false if
+// t is not at night.
+func nightOf(t time.Time) (start, end time.Time, ok bool) {
+	day, _ := dayOf(t)
+	switch hour := t.In(calendarLocation).Hour(); {
+	case hour >= nightStartHour:
+		start = day.Add(nightStartHour * time.Hour)
+	case hour < nightEndHour:
+		start = day.AddDate(0, 0, -1).Add(nightStartHour * time.Hour)
+	default:
+		return time.Time{}, time.Time{}, false
+	}
+	return start, start.Add((24 - nightStartHour + nightEndHour) * time.Hour), true
+}
+
+// limitedTransfer reports whether transfer counts towards the transfer limits
+// of its origin. Limits apply to the transfers made by account holders, while
+// reversals are made by operators.
+func limitedTransfer(transfer *Transfer) bool {
+	return transfer.ReversedTransferID == 0
+}
+
+// limitTotal returns the sum of totals, the amounts transferred in each
+// currency, in money.DefaultCurrency, the currency of the transfer limits.
+// The totals are converted with rate, which returns the current exchange rate
+// from a currency into money.DefaultCurrency, so currencies without a rate
+// into money.DefaultCurrency cannot be transferred.
+func limitTotal(totals map[money.Currency]decimal.Decimal, rate func(c money.Currency) (decimal.Decimal, error)) (decimal.Decimal, error) {
+	sum := decimal.Zero
+	for c, total := range totals {
+		if total.IsZero() {
+			continue
+		}
+		r, err := rate(c)
+		if err != nil {
+			return decimal.Zero, err
+		}
+		sum = sum.Add(money.Convert(total, r, money.DefaultCurrency))
+	}
+	return sum, nil
+}
+
+// checkLimitTotals returns ErrLimitExceeded if a transfer of amount exceeds
+// any of the current limits of its origin, given the totals transferred by
+// its origin in the day and, if at night, in the night of the transfer,
+// including the transfer itself. All amounts are in money.DefaultCurrency.
+func checkLimitTotals(amount decimal.Decimal, current []*TransferLimit, daily, nightly decimal.Decimal, night bool) error {
+	limits := limitsByKind(current)
+	switch {
+	case amount.GreaterThan(limits[LimitPerTransaction].Amount),
+		daily.GreaterThan(limits[LimitDaily].Amount),
+		night && nightly.GreaterThan(limits[LimitNighttime].Amount):
+		return ErrLimitExceeded
+	}
+	return nil
+}
+
+// ScheduleInterval represents how often a scheduled transfer runs.
+type ScheduleInterval string
+
+// The schedule intervals.
+const (
+	ScheduleOnce    ScheduleInterval = "once"
+	ScheduleMonthly ScheduleInterval = "monthly"
+)
+
+// ScheduleStatus represents the status of a scheduled transfer.
+type ScheduleStatus string
+
+// The schedule statuses.
+const (
+	ScheduleActive    ScheduleStatus = "active"
+	ScheduleCancelled ScheduleStatus = "cancelled"
+	ScheduleCompleted ScheduleStatus = "completed"
+)
+
+// ScheduledTransfer represents a transfer that runs at a future date, once or
+// every month on the day of StartAt.
+type ScheduledTransfer struct {
+	ID                   int64            `json:"id"`
+	AccountOriginID      int64            `json:"account_origin_id"`
+	AccountDestinationID int64            `json:"account_destination_id"`
+	Amount               decimal.Decimal  `json:"amount" pg:",use_zero"`
+	Interval             ScheduleInterval `json:"interval"`
+	StartAt              time.Time        `json:"start_at"`
+	NextRunAt            time.Time        `json:"next_run_at"`
+	Runs                 int              `json:"runs" pg:",use_zero"`
+	Status               ScheduleStatus   `json:"status"`
+	CreatedAt            time.Time        `json:"created_at"`
+}
+
+// advance moves a scheduled transfer to its next run, completing it when there
+// are no more runs.
+func (s *ScheduledTransfer) advance() {
+	s.Runs++
+	if s.Interval == ScheduleOnce {
+		s.Status = ScheduleCompleted
+		return
+	}
+	s.NextRunAt = addMonths(s.StartAt, s.Runs)
+}
+
+// addMonths adds n months to t. Days that do not exist in the resulting month
+// are clamped to its last day, so Jan 31 plus one month is Feb 28 or 29.
+func addMonths(t time.Time, n int) time.Time {
+	year, month, day := t.Date()
+	lastDay := time.Date(year, month+time.Month(n)+1, 0, 0, 0, 0, 0, t.Location()).Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(year, month+time.Month(n), day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+// ExecutionStatus represents the status of an execution of a scheduled
+// transfer.
+type ExecutionStatus string
+
+// The execution statuses.
+const (
+	ExecutionPending   ExecutionStatus = "pending"
+	ExecutionSucceeded ExecutionStatus = "succeeded"
+	ExecutionFailed    ExecutionStatus = "failed"
+)
+
+// ScheduledTransferExecution represents a run of a scheduled transfer. A
+// succeeded execution refers to the transfer it created, while a failed one
+// records the reason of the failure.
+type ScheduledTransferExecution struct {
+	ID                  int64           `json:"id"`
+	ScheduledTransferID int64           `json:"scheduled_transfer_id"`
+	ScheduledFor        time.Time       `json:"scheduled_for"`
+	Status              ExecutionStatus `json:"status"`
+	TransferID          int64           `json:"transfer_id,omitempty"`
+	Failure             string          `json:"failure,omitempty"`
+	CreatedAt           time.Time       `json:"created_at"`
+}
+
+// Session represents a login session of an account. TokenID is the ID of the
+// current access token of the session and RefreshTokenHash is the hash of its
+// current refresh token. Both are replaced whenever the session is refreshed,
+// so the previous tokens stop working.
+type Session struct {
+	ID                       int64
+	AccountID                int64
+	TokenID                  string
+	RefreshTokenHash         string
+	PreviousRefreshTokenHash string
+	ExpiresAt                time.Time
+	RevokedAt                time.Time
+	CreatedAt                time.Time
+}
+
+// APIKeyScope represents an operation allowed to an API key.
+type APIKeyScope string
+
+// The API key scopes.
+const (
+	ScopeReadBalance    APIKeyScope = "read:balance"
+	ScopeReadTransfers  APIKeyScope = "read:transfers"
+	ScopeWriteTransfers APIKeyScope = "write:transfers"
+)
+
+// APIKey represents a key for accessing an account from other servers without
+// logging in. Only the hash of the key is stored; Prefix holds its first
+// characters so the owner can tell the keys apart.
+type APIKey struct {
+	ID        int64         `json:"id"`
+	AccountID int64         `json:"account_id"`
+	Name      string        `json:"name"`
+	Prefix    string        `json:"prefix"`
+	Hash      string        `json:"-"`
+	Scopes    []APIKeyScope `json:"scopes" pg:",array"`
+	RevokedAt time.Time     `json:"-"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// HasScope reports whether the key is allowed to perform the operations of
+// scope.
+func (k *APIKey) HasScope(scope APIKeyScope) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditAction represents an action recorded into the audit log.
+type AuditAction string
+
+// The audited actions.
+const (
+	AuditLogin                AuditAction = "login"
+	AuditSecretChanged        AuditAction = "secret_changed"
+	AuditTOTPEnabled          AuditAction = "totp_enabled"
+	AuditTOTPDisabled         AuditAction = "totp_disabled"
+	AuditAPIKeyCreated        AuditAction = "api_key_created"
+	AuditAPIKeyRevoked        AuditAction = "api_key_revoked"
+	AuditTransferLimitChanged AuditAction = "transfer_limit_changed"
+	AuditCreditLineChanged    AuditAction = "credit_line_changed"
+	AuditAccountActivated     AuditAction = "account_activated"
+	AuditAccountFrozen        AuditAction = "account_frozen"
+	AuditAccountBlocked       AuditAction = "account_blocked"
+	AuditAccountClosed        AuditAction = "account_closed"
+)
+
+// AuditEvent represents an action performed on an account, either by the
+// account itself or by a staff member identified by ActorID.
+type AuditEvent struct {
+	ID        int64       `json:"id"`
+	AccountID int64       `json:"account_id"`
+	ActorID   int64       `json:"actor_id"`
+	Action    AuditAction `json:"action"`
+	Details   string      `json:"details,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// LoginThrottle tracks the failed login attempts for a key, which identifies
+// the document or the IP address used in the attempts.
+type LoginThrottle struct {
+	Key           string `pg:",pk"`
+	Failures      int    `pg:",use_zero"`
+	LastFailureAt time.Time
+}
+
+// CashMovementType represents the type of a cash movement.
+type CashMovementType string
+
+// The cash movement types.
+const (
+	CashMovementDeposit    CashMovementType = "deposit"
+	CashMovementWithdrawal CashMovementType = "withdrawal"
+	CashMovementInterest   CashMovementType = "interest"
+)
+
+// CashMovement represents money entering or leaving the bank through an
+// account. Currency defaults to money.DefaultCurrency. Interest movements are
+// made by DB.AccrueOverdraftInterest.
+type CashMovement struct {
+	ID         int64            `json:"id"`
+	AccountID  int64            `json:"account_id"`
+	Type       CashMovementType `json:"type"`
+	Amount     decimal.Decimal  `json:"amount" pg:",use_zero"`
+	Currency   money.Currency   `json:"currency"`
+	OperatorID int64            `json:"operator_id,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+}
+
+// prepareCashMovement fills the currency of movement and returns the error of
+// making it, if any.
+func prepareCashMovement(movement *CashMovement) error {
+	if movement.Currency == "" {
+		movement.Currency = money.DefaultCurrency
+	}
+	return checkAmount(movement.Amount, movement.Currency)
+}
+
+// InterestAccrual represents the interest charged on the negative balance of
+// an account for a calendar day, starting at Day. The interest is withdrawn
+// from the account by a cash movement of type CashMovementInterest.
+type InterestAccrual struct {
+	AccountID      int64           `json:"account_id" pg:",pk"`
+	Day            time.Time       `json:"day" pg:",pk"`
+	Balance        decimal.Decimal `json:"balance" pg:",use_zero"`
+	Rate           decimal.Decimal `json:"rate" pg:",use_zero"`
+	Amount         decimal.Decimal `json:"amount" pg:",use_zero"`
+	CashMovementID int64           `json:"cash_movement_id"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// AccountSort represents the order of an account listing.
+type AccountSort string
+
+// The account listing orders.
+const (
+	AccountSortCreatedAt AccountSort = "created_at"
+	AccountSortName      AccountSort = "name"
+)
+
+// AccountCursor represents the position of an account in a listing. Only the
+// field matching the order of the listing is used besides ID.
+type AccountCursor struct {
+	CreatedAt time.Time
+	Name      string
+	ID        int64
+}
+
+// AccountFilter contains the criteria for finding accounts. Zero values mean
+// the criteria is not applied.
+type AccountFilter struct {
+	// NamePrefix restricts the accounts to the ones which name starts with it,
+	// ignoring case.
+	NamePrefix string
+
+	// Sort is the order of the accounts, defaulting to AccountSortCreatedAt.
+	// Ties are broken by account ID.
+	Sort AccountSort
+
+	// Descending reverses the order of the accounts.
+	Descending bool
+
+	// After restricts the accounts to the ones after the cursor.
+	After *AccountCursor
+
+	// Limit is the maximum number of accounts to find.
+	Limit int
+}
+
+// TransferDirection represents the direction of a transfer relative to an
+// account.
+type TransferDirection string
+
+// The transfer directions.
+const (
+	TransferDirectionSent     TransferDirection = "sent"
+	TransferDirectionReceived TransferDirection = "received"
+)
+
+// TransferCursor represents the position of a transfer in a listing ordered
+// from the newest to the oldest transfer.
+type TransferCursor struct {
+	CreatedAt time.Time
+	ID        int64
+}
+
+// TransferFilter contains the criteria for finding the transfers of an
+// account. Zero values mean the criteria is not applied.
+type TransferFilter struct {
+	// AccountID is the account that sent or received the transfers.
+	AccountID int64
+
+	// Direction restricts the transfers to the ones sent or received by the
+	// account.
+	Direction TransferDirection
+
+	// From and To restricts the transfers to the ones created in the
+	// interval [From, To).
+	From time.Time
+	To   time.Time
+
+	// MinAmount and MaxAmount restricts the transfers to the ones with amount
+	// in the interval [MinAmount, MaxAmount].
+	MinAmount decimal.NullDecimal
+	MaxAmount decimal.NullDecimal
+
+	// After restricts the transfers to the ones older than the cursor.
+	After *TransferCursor
+
+	// Limit is the maximum number of transfers to find.
+	Limit int
+}
+
+// LedgerEntry represents an immutable change to the balance of an account in a
+// currency. Debits have negative amounts and credits have positive amounts, so
+// the balance of a wallet is the sum of the entries in its currency. Entries
+// created by a transfer always come in pairs, which sum to zero when both are
+// in the same currency, while a cash movement creates a single entry. Entries
+// bound to neither record the opening balance of accounts created before the
+// ledger existed.
+type LedgerEntry struct {
+	ID             int64           `json:"id"`
+	AccountID      int64           `json:"account_id"`
+	TransferID     int64           `json:"transfer_id,omitempty"`
+	CashMovementID int64           `json:"cash_movement_id,omitempty"`
+	Amount         decimal.Decimal `json:"amount" pg:",use_zero"`
+	Currency       money.Currency  `json:"currency"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// IdempotencyKey represents a key sent by a client for safely retrying a
+// request, along with the fingerprint of the request and the response that was
+// rendered for it. A zero StatusCode means the request is still in progress.
+type IdempotencyKey struct {
+	AccountID   int64  `pg:",pk"`
+	Key         string `pg:",pk"`
+	Fingerprint string
+	StatusCode  int `pg:",use_zero"`
+	Response    []byte
+	CreatedAt   time.Time
+}
+
+// The lifetimes of the idempotency keys. A key still in progress after
+// IdempotencyKeyLockTimeout was abandoned by a request that never finished,
+// and the response of a finished key is replayed for IdempotencyKeyRetention.
+// Expired keys can be used again, and are eventually deleted.
+const (
+	IdempotencyKeyLockTimeout = 5 * time.Minute
+	IdempotencyKeyRetention   = 24 * time.Hour
+)
+
+// expired reports whether key expired at now.
+func (k *IdempotencyKey) expired(now time.Time) bool {
+	if k.StatusCode == 0 {
+		return !now.Before(k.CreatedAt.Add(IdempotencyKeyLockTimeout))
+	}
+	return !now.Before(k.CreatedAt.Add(IdempotencyKeyRetention))
+}
+
+// DB provides methods for managing application data. All methods give up and
+// return the error of ctx if it is done before the operation finishes.
 type DB interface {
-	// CreateAccount adds an account into the database. Returns
-	// ErrAccountAlreadyExists if already exists an account with same CPF.
-	CreateAccount(account *Account) error
+	// CreateAccount adds an account with zero balance into the database. The
+	// type defaults to AccountIndividual, the role defaults to RoleCustomer and
+	// the documents are stored in their canonical form. Returns
+	// ErrAccountDocumentMismatch if the account does not have the document of
+	// its type and ErrAccountAlreadyExists if already exists an account with
+	// same document.
+	CreateAccount(ctx context.Context, account *Account) error
 
 	// FindAccountByID finds an account by its ID. Returns ErrAccountNotFound
 	// if the account cannot be found.
-	FindAccountByID(id int64) (*Account, error)
+	FindAccountByID(ctx context.Context, id int64) (*Account, error)
 
-	// FindAccountByCPF finds an account by its CPF. Returns ErrAccountNotFound
-	// if the account cannot be found.
-	FindAccountByCPF(cpf string) (*Account, error)
+	// FindAccountByDocument finds an account by its CPF or CNPJ, either masked
+	// or unmasked. Returns ErrAccountNotFound if the account cannot be found.
+	FindAccountByDocument(ctx context.Context, doc string) (*Account, error)
 
 	// FindAllAccounts finds all accounts from the database.
-	FindAllAccounts() ([]*Account, error)
+	FindAllAccounts(ctx context.Context) ([]*Account, error)
+
+	// FindAccounts finds the accounts matching filter, in the order given by
+	// the filter.
+	FindAccounts(ctx context.Context, filter *AccountFilter) ([]*Account, error)
+
+	// SetAccountStatus changes the status of accountID. Returns
+	// ErrAccountNotFound if the account cannot be found and
+	// ErrInvalidStatusTransition if the account cannot change to status.
+	SetAccountStatus(ctx context.Context, accountID int64, status AccountStatus) error
+
+	// CloseAccount closes accountID, revoking its sessions and API keys and
+	// cancelling its scheduled transfers. If the account still has funds in
+	// any of its wallets, they are transferred to the wallets of the same
+	// currency of sweepAccountID and the transfers are returned; if
+	// sweepAccountID is zero, returns ErrAccountBalanceNotZero instead, as
+	// well as when any of its wallets is overdrawn. Returns
+	// ErrAccountNotFound if any of the accounts cannot be found and
+	// ErrAccountClosed if the account was already closed. The sweeps fail like
+	// any other transfer if money cannot leave the account.
+	CloseAccount(ctx context.Context, accountID, sweepAccountID int64) ([]*Transfer, error)
+
+	// SetAccountCreditLine changes the credit limit and the daily overdraft
+	// rate of accountID. A credit limit lower than the current overdraft of
+	// the account only prevents further debits. Returns ErrAccountNotFound if
+	// the account cannot be found, ErrAccountClosed if it is closed and
+	// ErrInvalidCreditLine if the credit line is not valid.
+	SetAccountCreditLine(ctx context.Context, accountID int64, limit, rate decimal.Decimal) error
+
+	// AccrueOverdraftInterest charges the interest of the calendar day of now
+	// on the negative balance of every account, withdrawing it by a cash
+	// movement and returning the accruals. Each account is charged at most
+	// once a day, even when many callers run concurrently, and accounts
+	// without an overdraft rate are not charged. The interest may take the
+	// balance below the credit limit.
+	AccrueOverdraftInterest(ctx context.Context, now time.Time) ([]*InterestAccrual, error)
+
+	// FindAllWalletsWithAccountID finds the wallets of accountID, starting
+	// with the wallet of money.DefaultCurrency followed by the wallets of
+	// other currencies in alphabetical order. Returns ErrAccountNotFound if
+	// the account cannot be found.
+	FindAllWalletsWithAccountID(ctx context.Context, accountID int64) ([]*Wallet, error)
+
+	// SetExchangeRate adds or replaces the exchange rate from rate.Base to
+	// rate.Quote. Returns ErrInvalidCurrency if any of the currencies is not
+	// supported and ErrInvalidExchangeRate if the rate is not valid.
+	SetExchangeRate(ctx context.Context, rate *ExchangeRate) error
+
+	// FindAllExchangeRates finds all exchange rates, ordered by base and quote
+	// currencies.
+	FindAllExchangeRates(ctx context.Context) ([]*ExchangeRate, error)
+
+	// SetFeeSchedule adds or replaces the fee schedule of
+	// schedule.TransferType. Returns ErrInvalidFeeSchedule if the schedule is
+	// not valid and ErrAccountNotFound if its revenue account cannot be
+	// found.
+	SetFeeSchedule(ctx context.Context, schedule *FeeSchedule) error
+
+	// FindAllFeeSchedules finds all fee schedules, ordered by transfer type.
+	FindAllFeeSchedules(ctx context.Context) ([]*FeeSchedule, error)
+
+	// ChangeAccountSecret replaces the secret hash of accountID and revokes
+	// all of its sessions. Returns ErrAccountNotFound if the account cannot be
+	// found.
+	ChangeAccountSecret(ctx context.Context, accountID int64, secret string) error
+
+	// RehashAccountSecret replaces the secret hash of accountID by newHash,
+	// keeping its sessions. Nothing is changed if the current hash is not
+	// oldHash, so a concurrent secret change is never overwritten.
+	RehashAccountSecret(ctx context.Context, accountID int64, oldHash, newHash string) error
+
+	// EnrollAccountTOTP stores the encrypted TOTP secret and the hashes of the
+	// recovery codes of accountID, replacing a previous enrollment that was
+	// not confirmed. Returns ErrAccountNotFound if the account cannot be found
+	// and ErrTOTPAlreadyEnabled if its enrollment was already confirmed.
+	EnrollAccountTOTP(ctx context.Context, accountID int64, secret string, recoveryCodeHashes []string) error
+
+	// EnableAccountTOTP confirms the TOTP enrollment of accountID with a code
+	// of given time step. Returns ErrTOTPNotEnrolled if the account has no
+	// pending enrollment.
+	EnableAccountTOTP(ctx context.Context, accountID, step int64) error
+
+	// UseAccountTOTPStep records that accountID used a TOTP code of given
+	// time step. Returns ErrTOTPCodeReused if a code of the same or a later
+	// step was already used, or if the account has no TOTP enabled.
+	UseAccountTOTPStep(ctx context.Context, accountID, step int64) error
+
+	// UseAccountRecoveryCode removes the recovery code with given hash from
+	// accountID. Returns ErrRecoveryCodeNotFound if the account has no such
+	// code.
+	UseAccountRecoveryCode(ctx context.Context, accountID int64, hash string) error
+
+	// DisableAccountTOTP removes the TOTP enrollment of accountID. Returns
+	// ErrAccountNotFound if the account cannot be found.
+	DisableAccountTOTP(ctx context.Context, accountID int64) error
 
 	// CreateTransfer creates a transfer between two accounts, adjusting their
-	// balances accordingly. If the origin account does not have enough funds,
-	// returns ErrNotEnoughFunds. If any of the accounts of the operation does
-	// not exist, returns ErrAccountNotFound.
-	CreateTransfer(transfer *Transfer) error
+	// balances accordingly and writing a debit and a credit into the ledger.
+	// Transfers between different currencies are converted by the current
+	// exchange rate, which is recorded into the transfer along with the
+	// converted amount. The fee of the fee schedule of the type of the
+	// transfer, if any, is debited from the origin and credited into the
+	// revenue account of the schedule, unless the origin is the revenue
+	// account itself. If the origin account does not have enough funds for
+	// the amount and the fee, counting its credit line, returns
+	// ErrNotEnoughFunds, and if the transfer exceeds any of its transfer
+	// limits, returns ErrLimitExceeded. If the status of any of the accounts
+	// prevents the transfer, returns
+	// ErrAccountFrozen, ErrAccountBlocked or ErrAccountClosed. If any of the
+	// accounts of the operation does not exist, returns ErrAccountNotFound.
+	// Returns ErrSelfTransfer if both accounts are the same,
+	// ErrInvalidCurrency if any of the currencies is not supported,
+	// ErrExchangeRateNotFound if there is no rate between them and
+	// ErrInvalidAmount if the amount, or the converted amount, is not valid.
+	CreateTransfer(ctx context.Context, transfer *Transfer) error
+
+	// CreateReversal creates a transfer giving back the amount of the transfer
+	// with ID reversal.ReversedTransferID to its origin, converted back at the
+	// rate of the reversed transfer. The amount is in the currency received by
+	// the destination of the reversed transfer, and a zero amount reverses the
+	// whole amount. Returns ErrTransferNotFound if the reversed transfer
+	// cannot be found, ErrTransferAlreadyReversed if it was already reversed,
+	// ErrTransferNotReversible if it is a reversal, ErrReversalAmountExceeded
+	// if the amount is greater than the reversed amount, ErrInvalidAmount if
+	// the amount is not valid and ErrNotEnoughFunds if its destination does
+	// not have enough funds.
+	CreateReversal(ctx context.Context, reversal *Transfer) error
+
+	// FindTransferLimits finds the transfer limits of accountID in effect now,
+	// one of each kind in the order of TransferLimitKinds, and the requested
+	// increases still waiting for their cooling-off period. Returns
+	// ErrAccountNotFound if the account cannot be found.
+	FindTransferLimits(ctx context.Context, accountID int64) (current, pending []*TransferLimit, err error)
+
+	// RequestTransferLimitChange requests changing a transfer limit of
+	// limit.AccountID to limit.Amount. Decreases are effective immediately,
+	// while increases only come into effect after TransferLimitCoolingOff;
+	// either way, the request replaces any pending change of the same kind.
+	// Returns ErrAccountNotFound if the account cannot be found,
+	// ErrInvalidTransferLimit if the kind is not valid and ErrInvalidAmount if
+	// the amount is not valid.
+	RequestTransferLimitChange(ctx context.Context, limit *TransferLimit) error
+
+	// CreateScheduledTransfer schedules a transfer starting at StartAt. If any
+	// of the accounts of the transfer does not exist, returns
+	// ErrAccountNotFound. Returns ErrSelfTransfer if both accounts are the
+	// same, ErrInvalidAmount if the amount is not valid and the error of the
+	// status of an account that cannot make or receive transfers.
+	CreateScheduledTransfer(ctx context.Context, scheduled *ScheduledTransfer) error
+
+	// FindAllScheduledTransfersWithAccountID finds all scheduled transfers
+	// with accountID as origin, from the newest to the oldest.
+	FindAllScheduledTransfersWithAccountID(ctx context.Context, accountID int64) ([]*ScheduledTransfer, error)
+
+	// CancelScheduledTransfer cancels the scheduled transfer with given id and
+	// accountID as origin. Returns ErrScheduledTransferNotFound if it cannot be
+	// found and ErrScheduledTransferNotActive if it is not active.
+	CancelScheduledTransfer(ctx context.Context, accountID, id int64) (*ScheduledTransfer, error)
+
+	// ClaimDueScheduledTransfer picks an active scheduled transfer due at now,
+	// advances it to its next run and records a pending execution for the
+	// run. A scheduled transfer is claimed by a single caller even when many
+	// of them run concurrently. Returns ErrScheduledTransferNotFound if no
+	// scheduled transfer is due.
+	ClaimDueScheduledTransfer(ctx context.Context, now time.Time) (*ScheduledTransfer, *ScheduledTransferExecution, error)
+
+	// FinishScheduledTransferExecution stores the status, transfer and failure
+	// of an execution.
+	FinishScheduledTransferExecution(ctx context.Context, execution *ScheduledTransferExecution) error
+
+	// FindAllScheduledTransferExecutions finds all executions of the scheduled
+	// transfer with given id, from the newest to the oldest.
+	FindAllScheduledTransferExecutions(ctx context.Context, scheduledTransferID int64) ([]*ScheduledTransferExecution, error)
 
 	// FindAllTransfersWithAccountId finds all transfers with accountID as origin or
 	// destination.
-	FindAllTransfersWithAccountID(accountID int64) ([]*Transfer, error)
+	FindAllTransfersWithAccountID(ctx context.Context, accountID int64) ([]*Transfer, error)
+
+	// FindTransfers finds the transfers matching filter, ordered from the
+	// newest to the oldest.
+	FindTransfers(ctx context.Context, filter *TransferFilter) ([]*Transfer, error)
+
+	// CreateCashMovement deposits or withdraws money from the wallet of the
+	// movement currency of an account, writing the movement into the ledger.
+	// If a withdrawal exceeds the wallet funds, counting the credit line of
+	// the account, returns ErrNotEnoughFunds. Withdrawals count towards the
+	// transfer limits of the account, returning ErrLimitExceeded if they
+	// exceed any of them. If the status of the account prevents the movement,
+	// returns ErrAccountFrozen, ErrAccountBlocked or ErrAccountClosed. If the account does not exist, returns
+	// ErrAccountNotFound. Returns ErrInvalidCurrency if the currency is not
+	// supported and ErrInvalidAmount if the amount is not valid.
+	CreateCashMovement(ctx context.Context, movement *CashMovement) error
+
+	// FindAllCashMovementsWithAccountID finds all cash movements of accountID,
+	// from the newest to the oldest.
+	FindAllCashMovementsWithAccountID(ctx context.Context, accountID int64) ([]*CashMovement, error)
+
+	// FindAllLedgerEntriesWithAccountID finds all ledger entries of accountID
+	// in the order they were created.
+	FindAllLedgerEntriesWithAccountID(ctx context.Context, accountID int64) ([]*LedgerEntry, error)
+
+	// ComputeLedgerBalance returns the balance of the wallet of currency c of
+	// accountID as the sum of its ledger entries in c. Returns
+	// ErrAccountNotFound if the account cannot be found.
+	ComputeLedgerBalance(ctx context.Context, accountID int64, c money.Currency) (decimal.Decimal, error)
+
+	// CreateSession adds a session into the database.
+	CreateSession(ctx context.Context, session *Session) error
+
+	// FindSessionByTokenID finds the session whose current access token has
+	// tokenID. Returns ErrSessionNotFound if the session cannot be found or
+	// was revoked.
+	FindSessionByTokenID(ctx context.Context, tokenID string) (*Session, error)
+
+	// RefreshSession rotates the tokens of the session whose current refresh
+	// token has refreshTokenHash, replacing them with the TokenID,
+	// RefreshTokenHash and ExpiresAt of refreshed and filling the remaining
+	// fields of refreshed. Returns ErrSessionNotFound if no active session
+	// has the refresh token. Returns ErrRefreshTokenReused and revokes the
+	// session if the refresh token was already rotated.
+	RefreshSession(ctx context.Context, refreshTokenHash string, refreshed *Session) error
+
+	// RevokeSession revokes the session with given id. Returns
+	// ErrSessionNotFound if the session cannot be found.
+	RevokeSession(ctx context.Context, id int64) error
+
+	// CreateAPIKey adds an API key into the database.
+	CreateAPIKey(ctx context.Context, key *APIKey) error
+
+	// FindAPIKeyByHash finds the API key with given hash. Returns
+	// ErrAPIKeyNotFound if the key cannot be found or was revoked.
+	FindAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error)
+
+	// FindAllAPIKeysWithAccountID finds the API keys of accountID that were
+	// not revoked, from the newest to the oldest.
+	FindAllAPIKeysWithAccountID(ctx context.Context, accountID int64) ([]*APIKey, error)
+
+	// RevokeAPIKey revokes the API key with given id owned by accountID.
+	// Returns ErrAPIKeyNotFound if the account has no such key or it was
+	// already revoked.
+	RevokeAPIKey(ctx context.Context, accountID, id int64) error
+
+	// CreateAuditEvent adds an event into the audit log.
+	CreateAuditEvent(ctx context.Context, event *AuditEvent) error
+
+	// FindAllAuditEventsWithAccountID finds the audit events of accountID,
+	// from the newest to the oldest.
+	FindAllAuditEventsWithAccountID(ctx context.Context, accountID int64) ([]*AuditEvent, error)
+
+	// FindLoginThrottle finds the failed login attempts for key. Returns
+	// ErrLoginThrottleNotFound if there are none.
+	FindLoginThrottle(ctx context.Context, key string) (*LoginThrottle, error)
+
+	// ReserveLoginAttempt counts a login attempt for key made at given time as
+	// a failure before it is verified, so concurrent attempts cannot get past
+	// the throttle together. Returns the failures before the attempt, which
+	// are forgotten if the last of them happened more than window before. If
+	// those failures lock the attempt, for lockout of their number after the
+	// last one, it is not counted and ErrLoginLocked is returned.
+	ReserveLoginAttempt(ctx context.Context, key string, at time.Time, window time.Duration, lockout func(failures int) time.Duration) (*LoginThrottle, error)
+
+	// ReleaseLoginAttempt uncounts the attempt for key made at given time,
+	// which turned out not to be a failure, restoring the last failure time of
+	// previous, the failures returned by ReserveLoginAttempt, unless other
+	// attempts were counted since.
+	ReleaseLoginAttempt(ctx context.Context, key string, at time.Time, previous *LoginThrottle) error
+
+	// DeleteLoginThrottle forgets the failed login attempts for key.
+	DeleteLoginThrottle(ctx context.Context, key string) error
+
+	// CreateIdempotencyKey adds an idempotency key into the database,
+	// replacing an expired key of the account with the same name. Returns
+	// ErrIdempotencyKeyAlreadyExists if the account already used the same key
+	// and it did not expire.
+	CreateIdempotencyKey(ctx context.Context, key *IdempotencyKey) error
+
+	// FindIdempotencyKey finds an idempotency key used by accountID. Returns
+	// ErrIdempotencyKeyNotFound if the key cannot be found.
+	FindIdempotencyKey(ctx context.Context, accountID int64, key string) (*IdempotencyKey, error)
+
+	// UpdateIdempotencyKey stores the response of the request that used an
+	// idempotency key. Returns ErrIdempotencyKeyNotFound if the key cannot be
+	// found.
+	UpdateIdempotencyKey(ctx context.Context, key *IdempotencyKey) error
+
+	// DeleteIdempotencyKey removes an idempotency key from the database,
+	// allowing it to be used again.
+	DeleteIdempotencyKey(ctx context.Context, accountID int64, key string) error
+
+	// DeleteExpiredIdempotencyKeys removes the idempotency keys that expired,
+	// returning how many of them were removed.
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error)
 }
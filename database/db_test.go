@@ -1,31 +1,57 @@
 package database
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/require"
+
+	"github.com/lindebergue/desafio-go-stone/money"
 )
 
 func runDBTests(t *testing.T, db DB) {
+	ctx := context.Background()
+
 	acc1 := &Account{
-		Name:    "first account",
-		CPF:     "111.111.111-11",
-		Secret:  "verysecretpassword",
-		Balance: decimal.NewFromFloat(0.1),
+		Name:   "first account",
+		CPF:    "111.111.111-11",
+		Secret: "verysecretpassword",
 	}
 	acc2 := &Account{
-		Name:    "second account",
-		CPF:     "222.222.222-22",
-		Secret:  "othersecretpassword",
-		Balance: decimal.NewFromFloat(0.2),
+		Name:   "second account",
+		CPF:    "222.222.222-22",
+		Secret: "othersecretpassword",
 	}
 
 	t.Run("create", func(t *testing.T) {
-		require.NoError(t, db.CreateAccount(acc1))
-		require.NoError(t, db.CreateAccount(acc2))
+		require.NoError(t, db.CreateAccount(ctx, acc1))
+		require.NoError(t, db.CreateAccount(ctx, acc2))
 		require.NotEmpty(t, acc1.ID)
 		require.NotEmpty(t, acc2.ID)
+		require.Equal(t, RoleCustomer, acc1.Role)
+		require.True(t, acc1.Balance.IsZero())
+
+		deposits := []*CashMovement{
+			{AccountID: acc1.ID, Type: CashMovementDeposit, Amount: decimal.NewFromFloat(0.1)},
+			{AccountID: acc2.ID, Type: CashMovementDeposit, Amount: decimal.NewFromFloat(0.2)},
+		}
+		for _, deposit := range deposits {
+			require.NoError(t, db.CreateCashMovement(ctx, deposit))
+		}
+
+		var err error
+		acc1, err = db.FindAccountByID(ctx, acc1.ID)
+		require.NoError(t, err)
+		require.True(t, acc1.Balance.Equal(decimal.NewFromFloat(0.1)))
+
+		acc2, err = db.FindAccountByID(ctx, acc2.ID)
+		require.NoError(t, err)
+		require.True(t, acc2.Balance.Equal(decimal.NewFromFloat(0.2)))
 	})
 
 	t.Run("create with same cpf", func(t *testing.T) {
@@ -35,27 +61,68 @@ func runDBTests(t *testing.T, db DB) {
 			Secret:  "secret",
 			Balance: decimal.Zero,
 		}
-		require.Equal(t, ErrAccountAlreadyExists, db.CreateAccount(acc3))
+		require.Equal(t, ErrAccountAlreadyExists, db.CreateAccount(ctx, acc3))
 	})
 
 	t.Run("find", func(t *testing.T) {
-		foundByID, err := db.FindAccountByID(acc1.ID)
+		foundByID, err := db.FindAccountByID(ctx, acc1.ID)
 		require.NoError(t, err)
 		require.Equal(t, acc1, foundByID)
 
-		foundByCPF, err := db.FindAccountByCPF(acc1.CPF)
+		foundByDocument, err := db.FindAccountByDocument(ctx, acc1.CPF)
+		require.NoError(t, err)
+		require.Equal(t, acc1, foundByDocument)
+
+		foundByDocument, err = db.FindAccountByDocument(ctx, strings.NewReplacer(".", "", "-", "").Replace(acc1.CPF))
 		require.NoError(t, err)
-		require.Equal(t, acc1, foundByCPF)
+		require.Equal(t, acc1, foundByDocument)
 
-		foundAll, err := db.FindAllAccounts()
+		foundAll, err := db.FindAllAccounts(ctx)
 		require.Len(t, foundAll, 2)
 	})
 
+	t.Run("find accounts with filter", func(t *testing.T) {
+		byName, err := db.FindAccounts(ctx, &AccountFilter{NamePrefix: "SECOND"})
+		require.NoError(t, err)
+		require.Len(t, byName, 1)
+		require.Equal(t, acc2.ID, byName[0].ID)
+
+		none, err := db.FindAccounts(ctx, &AccountFilter{NamePrefix: "%"})
+		require.NoError(t, err)
+		require.Empty(t, none)
+
+		desc, err := db.FindAccounts(ctx, &AccountFilter{Sort: AccountSortName, Descending: true})
+		require.NoError(t, err)
+		require.Len(t, desc, 2)
+		require.Equal(t, acc2.ID, desc[0].ID)
+		require.Equal(t, acc1.ID, desc[1].ID)
+
+		page, err := db.FindAccounts(ctx, &AccountFilter{Limit: 1})
+		require.NoError(t, err)
+		require.Len(t, page, 1)
+		require.Equal(t, acc1.ID, page[0].ID)
+
+		page, err = db.FindAccounts(ctx, &AccountFilter{
+			After: &AccountCursor{CreatedAt: page[0].CreatedAt, ID: page[0].ID},
+			Limit: 1,
+		})
+		require.NoError(t, err)
+		require.Len(t, page, 1)
+		require.Equal(t, acc2.ID, page[0].ID)
+
+		page, err = db.FindAccounts(ctx, &AccountFilter{
+			Sort:  AccountSortName,
+			After: &AccountCursor{Name: acc2.Name, ID: acc2.ID},
+		})
+		require.NoError(t, err)
+		require.Empty(t, page)
+	})
+
 	t.Run("find accounts that does not exist", func(t *testing.T) {
-		_, err := db.FindAccountByID(42)
+		_, err := db.FindAccountByID(ctx, 42)
 		require.Equal(t, ErrAccountNotFound, err)
 
-		_, err = db.FindAccountByCPF("000.000.000-00")
+		_, err = db.FindAccountByDocument(ctx, "000.000.000-00")
 		require.Equal(t, ErrAccountNotFound, err)
 	})
 
@@ -65,27 +132,55 @@ func runDBTests(t *testing.T, db DB) {
 			AccountDestinationID: acc2.ID,
 			Amount:               acc1.Balance,
 		}
-		require.NoError(t, db.CreateTransfer(transf))
+		require.NoError(t, db.CreateTransfer(ctx, transf))
 
-		src, err := db.FindAccountByID(acc1.ID)
+		src, err := db.FindAccountByID(ctx, acc1.ID)
 		require.NoError(t, err)
 		require.True(t, src.Balance.IsZero())
 
-		dst, err := db.FindAccountByID(acc2.ID)
+		dst, err := db.FindAccountByID(ctx, acc2.ID)
 		require.NoError(t, err)
 		require.True(t, dst.Balance.Equal(decimal.NewFromFloat(0.3)))
 
-		transfers, err := db.FindAllTransfersWithAccountID(acc1.ID)
+		transfers, err := db.FindAllTransfersWithAccountID(ctx, acc1.ID)
 		require.NotEmpty(t, transfers)
 	})
 
+	t.Run("ledger", func(t *testing.T) {
+		srcEntries, err := db.FindAllLedgerEntriesWithAccountID(ctx, acc1.ID)
+		require.NoError(t, err)
+		require.Len(t, srcEntries, 2)
+		require.Zero(t, srcEntries[0].TransferID)
+		require.NotZero(t, srcEntries[0].CashMovementID)
+		require.True(t, srcEntries[0].Amount.Equal(decimal.NewFromFloat(0.1)))
+		require.True(t, srcEntries[1].Amount.Equal(decimal.NewFromFloat(-0.1)))
+
+		dstEntries, err := db.FindAllLedgerEntriesWithAccountID(ctx, acc2.ID)
+		require.NoError(t, err)
+		require.Len(t, dstEntries, 2)
+		require.Equal(t, srcEntries[1].TransferID, dstEntries[1].TransferID)
+		require.True(t, srcEntries[1].Amount.Add(dstEntries[1].Amount).IsZero())
+
+		for _, acc := range []*Account{acc1, acc2} {
+			found, err := db.FindAccountByID(ctx, acc.ID)
+			require.NoError(t, err)
+
+			balance, err := db.ComputeLedgerBalance(ctx, acc.ID, money.DefaultCurrency)
+			require.NoError(t, err)
+			require.True(t, found.Balance.Equal(balance))
+		}
+
+		_, err = db.ComputeLedgerBalance(ctx, 42, money.DefaultCurrency)
+		require.Equal(t, ErrAccountNotFound, err)
+	})
+
 	t.Run("transfer without enough funds", func(t *testing.T) {
 		transf := &Transfer{
 			AccountOriginID:      acc1.ID,
 			AccountDestinationID: acc2.ID,
 			Amount:               decimal.NewFromFloat(1_000_000),
 		}
-		require.Equal(t, ErrNotEnoughFunds, db.CreateTransfer(transf))
+		require.Equal(t, ErrNotEnoughFunds, db.CreateTransfer(ctx, transf))
 	})
 
 	t.Run("transfer from account that does not exist", func(t *testing.T) {
@@ -94,7 +189,7 @@ func runDBTests(t *testing.T, db DB) {
 			AccountDestinationID: acc2.ID,
 			Amount:               decimal.NewFromFloat(1),
 		}
-		require.Equal(t, ErrAccountNotFound, db.CreateTransfer(transf))
+		require.Equal(t, ErrAccountNotFound, db.CreateTransfer(ctx, transf))
 	})
 
 	t.Run("transfer to an account that does not exist", func(t *testing.T) {
@@ -103,7 +198,7 @@ func runDBTests(t *testing.T, db DB) {
 			AccountDestinationID: 1001,
 			Amount:               decimal.NewFromFloat(1),
 		}
-		require.Equal(t, ErrAccountNotFound, db.CreateTransfer(transf))
+		require.Equal(t, ErrAccountNotFound, db.CreateTransfer(ctx, transf))
 	})
 
 	t.Run("transfer between accounts that does not exist", func(t *testing.T) {
@@ -112,6 +207,1051 @@ func runDBTests(t *testing.T, db DB) {
 			AccountDestinationID: 1001,
 			Amount:               decimal.NewFromFloat(1),
 		}
-		require.Equal(t, ErrAccountNotFound, db.CreateTransfer(transf))
+		require.Equal(t, ErrAccountNotFound, db.CreateTransfer(ctx, transf))
+	})
+
+	t.Run("find transfers", func(t *testing.T) {
+		for _, amount := range []float64{0.05, 0.1, 0.15} {
+			transf := &Transfer{
+				AccountOriginID:      acc2.ID,
+				AccountDestinationID: acc1.ID,
+				Amount:               decimal.NewFromFloat(amount),
+			}
+			require.NoError(t, db.CreateTransfer(ctx, transf))
+		}
+
+		all, err := db.FindTransfers(ctx, &TransferFilter{AccountID: acc1.ID})
+		require.NoError(t, err)
+		require.Len(t, all, 4)
+		for n := 1; n < len(all); n++ {
+			require.False(t, all[n].CreatedAt.After(all[n-1].CreatedAt))
+		}
+
+		sent, err := db.FindTransfers(ctx, &TransferFilter{AccountID: acc1.ID, Direction: TransferDirectionSent})
+		require.NoError(t, err)
+		require.Len(t, sent, 1)
+
+		received, err := db.FindTransfers(ctx, &TransferFilter{AccountID: acc1.ID, Direction: TransferDirectionReceived})
+		require.NoError(t, err)
+		require.Len(t, received, 3)
+
+		filtered, err := db.FindTransfers(ctx, &TransferFilter{
+			AccountID: acc1.ID,
+			MinAmount: decimal.NullDecimal{Decimal: decimal.NewFromFloat(0.1), Valid: true},
+			MaxAmount: decimal.NullDecimal{Decimal: decimal.NewFromFloat(0.1), Valid: true},
+		})
+		require.NoError(t, err)
+		require.Len(t, filtered, 2)
+
+		future, err := db.FindTransfers(ctx, &TransferFilter{AccountID: acc1.ID, From: time.Now().Add(time.Hour)})
+		require.NoError(t, err)
+		require.Empty(t, future)
+
+		past, err := db.FindTransfers(ctx, &TransferFilter{AccountID: acc1.ID, To: time.Now().Add(-time.Hour)})
+		require.NoError(t, err)
+		require.Empty(t, past)
+
+		var (
+			paged  []*Transfer
+			cursor *TransferCursor
+		)
+		for {
+			page, err := db.FindTransfers(ctx, &TransferFilter{AccountID: acc1.ID, After: cursor, Limit: 3})
+			require.NoError(t, err)
+			if len(page) == 0 {
+				break
+			}
+			paged = append(paged, page...)
+			last := page[len(page)-1]
+			cursor = &TransferCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+		}
+		require.Equal(t, all, paged)
+	})
+
+	t.Run("reversal", func(t *testing.T) {
+		sent, err := db.FindTransfers(ctx, &TransferFilter{AccountID: acc1.ID, Direction: TransferDirectionSent})
+		require.NoError(t, err)
+		require.Len(t, sent, 1)
+		original := sent[0]
+
+		exceeded := &Transfer{ReversedTransferID: original.ID, Amount: original.Amount.Add(decimal.NewFromInt(1))}
+		require.Equal(t, ErrReversalAmountExceeded, db.CreateReversal(ctx, exceeded))
+
+		// the destination of the original transfer sent all its funds away
+		full := &Transfer{ReversedTransferID: original.ID, Reason: "sent by mistake"}
+		require.Equal(t, ErrNotEnoughFunds, db.CreateReversal(ctx, full))
+
+		deposit := &CashMovement{AccountID: acc2.ID, Type: CashMovementDeposit, Amount: original.Amount}
+		require.NoError(t, db.CreateCashMovement(ctx, deposit))
+
+		full = &Transfer{ReversedTransferID: original.ID, Reason: "sent by mistake"}
+		require.NoError(t, db.CreateReversal(ctx, full))
+		require.NotEmpty(t, full.ID)
+		require.Equal(t, acc2.ID, full.AccountOriginID)
+		require.Equal(t, acc1.ID, full.AccountDestinationID)
+		require.True(t, full.Amount.Equal(original.Amount))
+
+		again := &Transfer{ReversedTransferID: original.ID, Amount: decimal.NewFromFloat(0.01)}
+		require.Equal(t, ErrTransferAlreadyReversed, db.CreateReversal(ctx, again))
+
+		ofReversal := &Transfer{ReversedTransferID: full.ID}
+		require.Equal(t, ErrTransferNotReversible, db.CreateReversal(ctx, ofReversal))
+
+		missing := &Transfer{ReversedTransferID: 1000}
+		require.Equal(t, ErrTransferNotFound, db.CreateReversal(ctx, missing))
+	})
+
+	t.Run("idempotency key", func(t *testing.T) {
+		key := &IdempotencyKey{
+			AccountID:   acc1.ID,
+			Key:         "5d3a4c7e",
+			Fingerprint: "fingerprint",
+		}
+		require.NoError(t, db.CreateIdempotencyKey(ctx, key))
+
+		found, err := db.FindIdempotencyKey(ctx, acc1.ID, key.Key)
+		require.NoError(t, err)
+		require.Equal(t, key.Fingerprint, found.Fingerprint)
+		require.Zero(t, found.StatusCode)
+
+		key.StatusCode = 201
+		key.Response = []byte(`{"id":1}`)
+		require.NoError(t, db.UpdateIdempotencyKey(ctx, key))
+
+		found, err = db.FindIdempotencyKey(ctx, acc1.ID, key.Key)
+		require.NoError(t, err)
+		require.Equal(t, 201, found.StatusCode)
+		require.Equal(t, key.Response, found.Response)
+
+		require.NoError(t, db.DeleteIdempotencyKey(ctx, acc1.ID, key.Key))
+		_, err = db.FindIdempotencyKey(ctx, acc1.ID, key.Key)
+		require.Equal(t, ErrIdempotencyKeyNotFound, err)
+	})
+
+	t.Run("idempotency key already used", func(t *testing.T) {
+		key := &IdempotencyKey{
+			AccountID:   acc1.ID,
+			Key:         "9f1b2e6d",
+			Fingerprint: "fingerprint",
+		}
+		require.NoError(t, db.CreateIdempotencyKey(ctx, key))
+
+		dup := &IdempotencyKey{
+			AccountID:   acc1.ID,
+			Key:         key.Key,
+			Fingerprint: "other fingerprint",
+		}
+		require.Equal(t, ErrIdempotencyKeyAlreadyExists, db.CreateIdempotencyKey(ctx, dup))
+
+		other := &IdempotencyKey{
+			AccountID:   acc2.ID,
+			Key:         key.Key,
+			Fingerprint: "fingerprint",
+		}
+		require.NoError(t, db.CreateIdempotencyKey(ctx, other))
+	})
+
+	t.Run("idempotency key that does not exist", func(t *testing.T) {
+		_, err := db.FindIdempotencyKey(ctx, acc1.ID, "notfound")
+		require.Equal(t, ErrIdempotencyKeyNotFound, err)
+
+		key := &IdempotencyKey{AccountID: acc1.ID, Key: "notfound", StatusCode: 201}
+		require.Equal(t, ErrIdempotencyKeyNotFound, db.UpdateIdempotencyKey(ctx, key))
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		expiresAt := time.Now().Add(time.Hour)
+		session := &Session{
+			AccountID:        acc1.ID,
+			TokenID:          "token1",
+			RefreshTokenHash: "refresh1",
+			ExpiresAt:        expiresAt,
+		}
+		require.NoError(t, db.CreateSession(ctx, session))
+		require.NotEmpty(t, session.ID)
+
+		found, err := db.FindSessionByTokenID(ctx, "token1")
+		require.NoError(t, err)
+		require.Equal(t, session.ID, found.ID)
+		require.Equal(t, acc1.ID, found.AccountID)
+
+		refreshed := &Session{TokenID: "token2", RefreshTokenHash: "refresh2", ExpiresAt: expiresAt}
+		require.NoError(t, db.RefreshSession(ctx, "refresh1", refreshed))
+		require.Equal(t, session.ID, refreshed.ID)
+		require.Equal(t, acc1.ID, refreshed.AccountID)
+
+		// the rotated access token stops working
+		_, err = db.FindSessionByTokenID(ctx, "token1")
+		require.Equal(t, ErrSessionNotFound, err)
+
+		_, err = db.FindSessionByTokenID(ctx, "token2")
+		require.NoError(t, err)
+
+		unknown := &Session{TokenID: "token3", RefreshTokenHash: "refresh3", ExpiresAt: expiresAt}
+		require.Equal(t, ErrSessionNotFound, db.RefreshSession(ctx, "unknown", unknown))
+
+		// reusing a rotated refresh token revokes the session
+		reused := &Session{TokenID: "token3", RefreshTokenHash: "refresh3", ExpiresAt: expiresAt}
+		require.Equal(t, ErrRefreshTokenReused, db.RefreshSession(ctx, "refresh1", reused))
+
+		_, err = db.FindSessionByTokenID(ctx, "token2")
+		require.Equal(t, ErrSessionNotFound, err)
+
+		revoked := &Session{TokenID: "token3", RefreshTokenHash: "refresh3", ExpiresAt: expiresAt}
+		require.Equal(t, ErrSessionNotFound, db.RefreshSession(ctx, "refresh2", revoked))
+
+		other := &Session{
+			AccountID:        acc2.ID,
+			TokenID:          "token4",
+			RefreshTokenHash: "refresh4",
+			ExpiresAt:        expiresAt,
+		}
+		require.NoError(t, db.CreateSession(ctx, other))
+		require.NoError(t, db.RevokeSession(ctx, other.ID))
+
+		_, err = db.FindSessionByTokenID(ctx, "token4")
+		require.Equal(t, ErrSessionNotFound, err)
+		require.Equal(t, ErrSessionNotFound, db.RevokeSession(ctx, 1000))
+	})
+
+	t.Run("change secret", func(t *testing.T) {
+		acc := &Account{Name: "secret account", CPF: "000.000.001-91", Secret: "hash1"}
+		require.NoError(t, db.CreateAccount(ctx, acc))
+
+		session := &Session{AccountID: acc.ID, TokenID: "secret-token", RefreshTokenHash: "secret-refresh", ExpiresAt: time.Now().Add(time.Hour)}
+		require.NoError(t, db.CreateSession(ctx, session))
+
+		// rehashes keep the sessions and are skipped if the hash changed
+		require.NoError(t, db.RehashAccountSecret(ctx, acc.ID, "hash1", "hash2"))
+		require.NoError(t, db.RehashAccountSecret(ctx, acc.ID, "hash1", "hash3"))
+		found, err := db.FindAccountByID(ctx, acc.ID)
+		require.NoError(t, err)
+		require.Equal(t, "hash2", found.Secret)
+		_, err = db.FindSessionByTokenID(ctx, "secret-token")
+		require.NoError(t, err)
+
+		require.NoError(t, db.ChangeAccountSecret(ctx, acc.ID, "hash4"))
+		found, err = db.FindAccountByID(ctx, acc.ID)
+		require.NoError(t, err)
+		require.Equal(t, "hash4", found.Secret)
+		_, err = db.FindSessionByTokenID(ctx, "secret-token")
+		require.Equal(t, ErrSessionNotFound, err)
+
+		require.Equal(t, ErrAccountNotFound, db.ChangeAccountSecret(ctx, 1000, "hash"))
+	})
+
+	t.Run("totp", func(t *testing.T) {
+		acc := &Account{Name: "totp account", CPF: "390.533.447-05", Secret: "secret"}
+		require.NoError(t, db.CreateAccount(ctx, acc))
+
+		require.Equal(t, ErrTOTPNotEnrolled, db.EnableAccountTOTP(ctx, acc.ID, 10))
+		require.NoError(t, db.EnrollAccountTOTP(ctx, acc.ID, "encrypted", []string{"code1", "code2"}))
+
+		// codes are not accepted before the enrollment is confirmed
+		require.Equal(t, ErrTOTPCodeReused, db.UseAccountTOTPStep(ctx, acc.ID, 11))
+		require.Equal(t, ErrRecoveryCodeNotFound, db.UseAccountRecoveryCode(ctx, acc.ID, "code1"))
+
+		require.NoError(t, db.EnableAccountTOTP(ctx, acc.ID, 10))
+		require.Equal(t, ErrTOTPAlreadyEnabled, db.EnrollAccountTOTP(ctx, acc.ID, "other", nil))
+
+		found, err := db.FindAccountByID(ctx, acc.ID)
+		require.NoError(t, err)
+		require.True(t, found.TOTPEnabled)
+		require.Equal(t, "encrypted", found.TOTPSecret)
+		require.Equal(t, []string{"code1", "code2"}, found.TOTPRecoveryCodes)
+
+		// each time step is accepted only once
+		require.Equal(t, ErrTOTPCodeReused, db.UseAccountTOTPStep(ctx, acc.ID, 10))
+		require.NoError(t, db.UseAccountTOTPStep(ctx, acc.ID, 11))
+		require.Equal(t, ErrTOTPCodeReused, db.UseAccountTOTPStep(ctx, acc.ID, 11))
+
+		// each recovery code is accepted only once
+		require.NoError(t, db.UseAccountRecoveryCode(ctx, acc.ID, "code1"))
+		require.Equal(t, ErrRecoveryCodeNotFound, db.UseAccountRecoveryCode(ctx, acc.ID, "code1"))
+
+		require.NoError(t, db.DisableAccountTOTP(ctx, acc.ID))
+		found, err = db.FindAccountByID(ctx, acc.ID)
+		require.NoError(t, err)
+		require.False(t, found.TOTPEnabled)
+		require.Empty(t, found.TOTPSecret)
+
+		require.Equal(t, ErrAccountNotFound, db.EnrollAccountTOTP(ctx, 1000, "encrypted", nil))
+		require.Equal(t, ErrAccountNotFound, db.DisableAccountTOTP(ctx, 1000))
+	})
+
+	t.Run("api keys", func(t *testing.T) {
+		key1 := &APIKey{AccountID: acc1.ID, Name: "first", Prefix: "sk_abc", Hash: "hash1", Scopes: []APIKeyScope{ScopeReadBalance}}
+		require.NoError(t, db.CreateAPIKey(ctx, key1))
+		require.NotEmpty(t, key1.ID)
+		key2 := &APIKey{AccountID: acc1.ID, Name: "second", Prefix: "sk_def", Hash: "hash2", Scopes: []APIKeyScope{ScopeReadTransfers, ScopeWriteTransfers}}
+		require.NoError(t, db.CreateAPIKey(ctx, key2))
+
+		found, err := db.FindAPIKeyByHash(ctx, "hash2")
+		require.NoError(t, err)
+		require.Equal(t, key2.ID, found.ID)
+		require.True(t, found.HasScope(ScopeWriteTransfers))
+		require.False(t, found.HasScope(ScopeReadBalance))
+
+		keys, err := db.FindAllAPIKeysWithAccountID(ctx, acc1.ID)
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		require.Equal(t, key2.ID, keys[0].ID)
+
+		// only the owner can revoke a key
+		require.Equal(t, ErrAPIKeyNotFound, db.RevokeAPIKey(ctx, acc2.ID, key1.ID))
+		require.NoError(t, db.RevokeAPIKey(ctx, acc1.ID, key1.ID))
+		require.Equal(t, ErrAPIKeyNotFound, db.RevokeAPIKey(ctx, acc1.ID, key1.ID))
+
+		_, err = db.FindAPIKeyByHash(ctx, "hash1")
+		require.Equal(t, ErrAPIKeyNotFound, err)
+		keys, err = db.FindAllAPIKeysWithAccountID(ctx, acc1.ID)
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+
+		require.Equal(t, ErrAccountNotFound, db.CreateAPIKey(ctx, &APIKey{AccountID: 1000, Name: "x", Prefix: "sk_x", Hash: "hash3", Scopes: []APIKeyScope{ScopeReadBalance}}))
+	})
+
+	t.Run("login throttles", func(t *testing.T) {
+		_, err := db.FindLoginThrottle(ctx, "ip:192.0.2.1")
+		require.Equal(t, ErrLoginThrottleNotFound, err)
+
+		// locks for a minute after the second failure
+		lockout := func(failures int) time.Duration {
+			if failures < 2 {
+				return 0
+			}
+			return time.Minute
+		}
+		at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		previous, err := db.ReserveLoginAttempt(ctx, "ip:192.0.2.1", at, time.Hour, lockout)
+		require.NoError(t, err)
+		require.Equal(t, 0, previous.Failures)
+
+		previous, err = db.ReserveLoginAttempt(ctx, "ip:192.0.2.1", at.Add(time.Second), time.Hour, lockout)
+		require.NoError(t, err)
+		require.Equal(t, 1, previous.Failures)
+
+		found, err := db.FindLoginThrottle(ctx, "ip:192.0.2.1")
+		require.NoError(t, err)
+		require.Equal(t, 2, found.Failures)
+		require.True(t, at.Add(time.Second).Equal(found.LastFailureAt))
+
+		// locked attempts are not counted
+		previous, err = db.ReserveLoginAttempt(ctx, "ip:192.0.2.1", at.Add(time.Minute), time.Hour, lockout)
+		require.Equal(t, ErrLoginLocked, err)
+		require.Equal(t, 2, previous.Failures)
+
+		// released attempts restore the previous failures
+		previous, err = db.ReserveLoginAttempt(ctx, "ip:192.0.2.1", at.Add(2*time.Minute), time.Hour, lockout)
+		require.NoError(t, err)
+		require.NoError(t, db.ReleaseLoginAttempt(ctx, "ip:192.0.2.1", at.Add(2*time.Minute), previous))
+		found, err = db.FindLoginThrottle(ctx, "ip:192.0.2.1")
+		require.NoError(t, err)
+		require.Equal(t, 2, found.Failures)
+		require.True(t, at.Add(time.Second).Equal(found.LastFailureAt))
+
+		// failures older than the window are forgotten
+		previous, err = db.ReserveLoginAttempt(ctx, "ip:192.0.2.1", at.Add(2*time.Hour), time.Hour, lockout)
+		require.NoError(t, err)
+		require.Equal(t, 0, previous.Failures)
+		require.NoError(t, db.ReleaseLoginAttempt(ctx, "ip:192.0.2.1", at.Add(2*time.Hour), previous))
+		_, err = db.FindLoginThrottle(ctx, "ip:192.0.2.1")
+		require.Equal(t, ErrLoginThrottleNotFound, err)
+
+		_, err = db.ReserveLoginAttempt(ctx, "ip:192.0.2.1", at.Add(3*time.Hour), time.Hour, lockout)
+		require.NoError(t, err)
+		require.NoError(t, db.DeleteLoginThrottle(ctx, "ip:192.0.2.1"))
+		_, err = db.FindLoginThrottle(ctx, "ip:192.0.2.1")
+		require.Equal(t, ErrLoginThrottleNotFound, err)
+	})
+
+	t.Run("money rules", func(t *testing.T) {
+		for _, amount := range []decimal.Decimal{decimal.Zero, decimal.NewFromInt(-1), decimal.RequireFromString("0.001")} {
+			transfer := &Transfer{AccountOriginID: acc1.ID, AccountDestinationID: acc2.ID, Amount: amount}
+			require.Equal(t, ErrInvalidAmount, db.CreateTransfer(ctx, transfer), amount.String())
+			scheduled := &ScheduledTransfer{AccountOriginID: acc1.ID, AccountDestinationID: acc2.ID, Amount: amount, Interval: ScheduleOnce, StartAt: time.Now().Add(time.Hour)}
+			require.Equal(t, ErrInvalidAmount, db.CreateScheduledTransfer(ctx, scheduled), amount.String())
+			movement := &CashMovement{AccountID: acc1.ID, Type: CashMovementDeposit, Amount: amount}
+			require.Equal(t, ErrInvalidAmount, db.CreateCashMovement(ctx, movement), amount.String())
+		}
+
+		self := &Transfer{AccountOriginID: acc1.ID, AccountDestinationID: acc1.ID, Amount: decimal.NewFromInt(1)}
+		require.Equal(t, ErrSelfTransfer, db.CreateTransfer(ctx, self))
+		scheduled := &ScheduledTransfer{AccountOriginID: acc1.ID, AccountDestinationID: acc1.ID, Amount: decimal.NewFromInt(1), Interval: ScheduleOnce, StartAt: time.Now().Add(time.Hour)}
+		require.Equal(t, ErrSelfTransfer, db.CreateScheduledTransfer(ctx, scheduled))
+	})
+
+	t.Run("frozen accounts", func(t *testing.T) {
+		frozen := &Account{Name: "frozen account", CPF: "555.555.555-55", Secret: "frozensecret"}
+		require.NoError(t, db.CreateAccount(ctx, frozen))
+		require.Equal(t, AccountActive, frozen.Status)
+		other := &Account{Name: "other account", CPF: "666.666.666-66", Secret: "othersecret"}
+		require.NoError(t, db.CreateAccount(ctx, other))
+		require.NoError(t, db.CreateCashMovement(ctx, &CashMovement{AccountID: frozen.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(10)}))
+		require.NoError(t, db.CreateCashMovement(ctx, &CashMovement{AccountID: other.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(10)}))
+
+		sent := &Transfer{AccountOriginID: frozen.ID, AccountDestinationID: other.ID, Amount: decimal.NewFromInt(4)}
+		require.NoError(t, db.CreateTransfer(ctx, sent))
+
+		require.NoError(t, db.SetAccountStatus(ctx, frozen.ID, AccountFrozen))
+		found, err := db.FindAccountByID(ctx, frozen.ID)
+		require.NoError(t, err)
+		require.Equal(t, AccountFrozen, found.Status)
+
+		// frozen accounts cannot send money but still receive it
+		transfer := &Transfer{AccountOriginID: frozen.ID, AccountDestinationID: other.ID, Amount: decimal.NewFromInt(1)}
+		require.Equal(t, ErrAccountFrozen, db.CreateTransfer(ctx, transfer))
+		withdrawal := &CashMovement{AccountID: frozen.ID, Type: CashMovementWithdrawal, Amount: decimal.NewFromInt(1)}
+		require.Equal(t, ErrAccountFrozen, db.CreateCashMovement(ctx, withdrawal))
+		require.NoError(t, db.CreateTransfer(ctx, &Transfer{AccountOriginID: other.ID, AccountDestinationID: frozen.ID, Amount: decimal.NewFromInt(1)}))
+
+		// reversals are not blocked by the freeze
+		require.NoError(t, db.CreateReversal(ctx, &Transfer{ReversedTransferID: sent.ID, Reason: "fraud"}))
+
+		require.NoError(t, db.SetAccountStatus(ctx, frozen.ID, AccountActive))
+		require.NoError(t, db.CreateTransfer(ctx, &Transfer{AccountOriginID: frozen.ID, AccountDestinationID: other.ID, Amount: decimal.NewFromInt(1)}))
+
+		require.Equal(t, ErrAccountNotFound, db.SetAccountStatus(ctx, 1000, AccountFrozen))
+	})
+
+	t.Run("account lifecycle", func(t *testing.T) {
+		closing := &Account{Name: "closing account", CPF: "777.777.777-77", Secret: "closingsecret"}
+		require.NoError(t, db.CreateAccount(ctx, closing))
+		sweep := &Account{Name: "sweep account", CPF: "888.888.888-88", Secret: "sweepsecret"}
+		require.NoError(t, db.CreateAccount(ctx, sweep))
+		require.NoError(t, db.CreateCashMovement(ctx, &CashMovement{AccountID: closing.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(10)}))
+
+		require.Equal(t, ErrInvalidStatusTransition, db.SetAccountStatus(ctx, closing.ID, AccountActive))
+		require.Equal(t, ErrInvalidStatusTransition, db.SetAccountStatus(ctx, closing.ID, AccountClosed))
+
+		// blocked accounts neither send nor receive money
+		require.NoError(t, db.SetAccountStatus(ctx, closing.ID, AccountBlocked))
+		require.Equal(t, ErrAccountBlocked, db.CreateTransfer(ctx, &Transfer{AccountOriginID: closing.ID, AccountDestinationID: sweep.ID, Amount: decimal.NewFromInt(1)}))
+		require.Equal(t, ErrAccountBlocked, db.CreateCashMovement(ctx, &CashMovement{AccountID: closing.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(1)}))
+		require.Equal(t, ErrAccountBlocked, db.CreateCashMovement(ctx, &CashMovement{AccountID: closing.ID, Type: CashMovementWithdrawal, Amount: decimal.NewFromInt(1)}))
+		require.NoError(t, db.SetAccountStatus(ctx, closing.ID, AccountActive))
+
+		session := &Session{AccountID: closing.ID, TokenID: "closing-token", RefreshTokenHash: "closing-refresh", ExpiresAt: time.Now().Add(time.Hour)}
+		require.NoError(t, db.CreateSession(ctx, session))
+		require.NoError(t, db.CreateAPIKey(ctx, &APIKey{AccountID: closing.ID, Name: "closing", Prefix: "sk_cls", Hash: "closing-hash", Scopes: []APIKeyScope{ScopeReadBalance}}))
+		scheduled := &ScheduledTransfer{
+			AccountOriginID:      closing.ID,
+			AccountDestinationID: sweep.ID,
+			Amount:               decimal.NewFromInt(1),
+			Interval:             ScheduleMonthly,
+			StartAt:              time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+		require.NoError(t, db.CreateScheduledTransfer(ctx, scheduled))
+
+		// accounts with funds are only closed by sweeping them elsewhere
+		_, err := db.CloseAccount(ctx, closing.ID, 0)
+		require.Equal(t, ErrAccountBalanceNotZero, err)
+		_, err = db.CloseAccount(ctx, closing.ID, 1000)
+		require.Equal(t, ErrAccountNotFound, err)
+
+		transfers, err := db.CloseAccount(ctx, closing.ID, sweep.ID)
+		require.NoError(t, err)
+		require.Len(t, transfers, 1)
+		require.Equal(t, sweep.ID, transfers[0].AccountDestinationID)
+		require.True(t, transfers[0].Amount.Equal(decimal.NewFromInt(10)))
+
+		found, err := db.FindAccountByID(ctx, closing.ID)
+		require.NoError(t, err)
+		require.Equal(t, AccountClosed, found.Status)
+		require.True(t, found.Balance.IsZero())
+		found, err = db.FindAccountByID(ctx, sweep.ID)
+		require.NoError(t, err)
+		require.True(t, found.Balance.Equal(decimal.NewFromInt(10)))
+
+		_, err = db.FindSessionByTokenID(ctx, "closing-token")
+		require.Equal(t, ErrSessionNotFound, err)
+		_, err = db.FindAPIKeyByHash(ctx, "closing-hash")
+		require.Equal(t, ErrAPIKeyNotFound, err)
+		schedules, err := db.FindAllScheduledTransfersWithAccountID(ctx, closing.ID)
+		require.NoError(t, err)
+		require.Equal(t, ScheduleCancelled, schedules[0].Status)
+
+		// closed accounts are permanently disabled
+		require.Equal(t, ErrAccountClosed, db.CreateTransfer(ctx, &Transfer{AccountOriginID: sweep.ID, AccountDestinationID: closing.ID, Amount: decimal.NewFromInt(1)}))
+		require.Equal(t, ErrAccountClosed, db.CreateCashMovement(ctx, &CashMovement{AccountID: closing.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(1)}))
+		require.Equal(t, ErrInvalidStatusTransition, db.SetAccountStatus(ctx, closing.ID, AccountActive))
+		_, err = db.CloseAccount(ctx, closing.ID, 0)
+		require.Equal(t, ErrAccountClosed, err)
+
+		// accounts without funds are closed without a sweep
+		empty := &Account{Name: "empty account", CPF: "999.999.999-99", Secret: "emptysecret"}
+		require.NoError(t, db.CreateAccount(ctx, empty))
+		transfers, err = db.CloseAccount(ctx, empty.ID, 0)
+		require.NoError(t, err)
+		require.Empty(t, transfers)
+	})
+
+	t.Run("audit events", func(t *testing.T) {
+		login := &AuditEvent{AccountID: acc1.ID, ActorID: acc1.ID, Action: AuditLogin, Details: "192.0.2.1"}
+		require.NoError(t, db.CreateAuditEvent(ctx, login))
+		require.NotEmpty(t, login.ID)
+		require.False(t, login.CreatedAt.IsZero())
+		freeze := &AuditEvent{AccountID: acc1.ID, ActorID: acc2.ID, Action: AuditAccountFrozen, Details: "fraud"}
+		require.NoError(t, db.CreateAuditEvent(ctx, freeze))
+		require.NoError(t, db.CreateAuditEvent(ctx, &AuditEvent{AccountID: acc2.ID, ActorID: acc2.ID, Action: AuditLogin}))
+
+		events, err := db.FindAllAuditEventsWithAccountID(ctx, acc1.ID)
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		require.Equal(t, freeze.ID, events[0].ID)
+		require.Equal(t, acc2.ID, events[0].ActorID)
+		require.Equal(t, login.ID, events[1].ID)
+
+		require.Equal(t, ErrAccountNotFound, db.CreateAuditEvent(ctx, &AuditEvent{AccountID: 1000, ActorID: acc1.ID, Action: AuditLogin}))
+	})
+
+	t.Run("cash movements", func(t *testing.T) {
+		acc := &Account{
+			Name:   "cash account",
+			CPF:    "444.444.444-44",
+			Secret: "cashsecret",
+		}
+		require.NoError(t, db.CreateAccount(ctx, acc))
+
+		deposit := &CashMovement{AccountID: acc.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(10)}
+		require.NoError(t, db.CreateCashMovement(ctx, deposit))
+		require.NotEmpty(t, deposit.ID)
+
+		withdrawal := &CashMovement{AccountID: acc.ID, Type: CashMovementWithdrawal, Amount: decimal.NewFromInt(4)}
+		require.NoError(t, db.CreateCashMovement(ctx, withdrawal))
+
+		overdraft := &CashMovement{AccountID: acc.ID, Type: CashMovementWithdrawal, Amount: decimal.NewFromInt(7)}
+		require.Equal(t, ErrNotEnoughFunds, db.CreateCashMovement(ctx, overdraft))
+
+		missing := &CashMovement{AccountID: 1000, Type: CashMovementDeposit, Amount: decimal.NewFromInt(1)}
+		require.Equal(t, ErrAccountNotFound, db.CreateCashMovement(ctx, missing))
+
+		movements, err := db.FindAllCashMovementsWithAccountID(ctx, acc.ID)
+		require.NoError(t, err)
+		require.Len(t, movements, 2)
+		require.Equal(t, withdrawal.ID, movements[0].ID)
+		require.Equal(t, deposit.ID, movements[1].ID)
+
+		found, err := db.FindAccountByID(ctx, acc.ID)
+		require.NoError(t, err)
+		require.True(t, found.Balance.Equal(decimal.NewFromInt(6)))
+
+		balance, err := db.ComputeLedgerBalance(ctx, acc.ID, money.DefaultCurrency)
+		require.NoError(t, err)
+		require.True(t, balance.Equal(found.Balance))
+	})
+
+	t.Run("multiple currencies", func(t *testing.T) {
+		sender := &Account{Name: "dollar account", CPF: "123.123.123-12", Secret: "dollarsecret"}
+		require.NoError(t, db.CreateAccount(ctx, sender))
+		receiver := &Account{Name: "real account", CPF: "321.321.321-32", Secret: "realsecret"}
+		require.NoError(t, db.CreateAccount(ctx, receiver))
+
+		deposit := &CashMovement{AccountID: sender.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(100), Currency: money.USD}
+		require.NoError(t, db.CreateCashMovement(ctx, deposit))
+		invalid := &CashMovement{AccountID: sender.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(1), Currency: "XYZ"}
+		require.Equal(t, ErrInvalidCurrency, db.CreateCashMovement(ctx, invalid))
+
+		// the deposit went into the dollar wallet only
+		found, err := db.FindAccountByID(ctx, sender.ID)
+		require.NoError(t, err)
+		require.True(t, found.Balance.IsZero())
+
+		transfer := &Transfer{AccountOriginID: sender.ID, AccountDestinationID: receiver.ID, Amount: decimal.NewFromInt(10), Currency: money.USD, DestinationCurrency: money.BRL}
+		require.Equal(t, ErrExchangeRateNotFound, db.CreateTransfer(ctx, transfer))
+
+		require.Equal(t, ErrInvalidExchangeRate, db.SetExchangeRate(ctx, &ExchangeRate{Base: money.USD, Quote: money.BRL, Rate: decimal.Zero}))
+		require.Equal(t, ErrInvalidExchangeRate, db.SetExchangeRate(ctx, &ExchangeRate{Base: money.USD, Quote: money.USD, Rate: decimal.NewFromInt(1)}))
+		require.Equal(t, ErrInvalidCurrency, db.SetExchangeRate(ctx, &ExchangeRate{Base: "XYZ", Quote: money.BRL, Rate: decimal.NewFromInt(1)}))
+		require.NoError(t, db.SetExchangeRate(ctx, &ExchangeRate{Base: money.USD, Quote: money.BRL, Rate: decimal.NewFromInt(4)}))
+		rate := &ExchangeRate{Base: money.USD, Quote: money.BRL, Rate: decimal.RequireFromString("5.1234")}
+		require.NoError(t, db.SetExchangeRate(ctx, rate))
+		require.False(t, rate.UpdatedAt.IsZero())
+		require.NoError(t, db.SetExchangeRate(ctx, &ExchangeRate{Base: money.BRL, Quote: money.USD, Rate: decimal.RequireFromString("0.19")}))
+
+		rates, err := db.FindAllExchangeRates(ctx)
+		require.NoError(t, err)
+		require.Len(t, rates, 2)
+		require.Equal(t, money.BRL, rates[0].Base)
+		require.Equal(t, money.USD, rates[1].Base)
+		require.True(t, rates[1].Rate.Equal(decimal.RequireFromString("5.1234")))
+
+		require.NoError(t, db.CreateTransfer(ctx, transfer))
+		require.True(t, transfer.ExchangeRate.Equal(decimal.RequireFromString("5.1234")))
+		require.True(t, transfer.DestinationAmount.Equal(decimal.RequireFromString("51.23")))
+
+		// converted amounts that round to zero cannot be transferred
+		tiny := &Transfer{AccountOriginID: receiver.ID, AccountDestinationID: sender.ID, Amount: decimal.RequireFromString("0.01"), DestinationCurrency: money.USD}
+		require.Equal(t, ErrInvalidAmount, db.CreateTransfer(ctx, tiny))
+
+		wallets, err := db.FindAllWalletsWithAccountID(ctx, sender.ID)
+		require.NoError(t, err)
+		require.Len(t, wallets, 2)
+		require.Equal(t, money.BRL, wallets[0].Currency)
+		require.True(t, wallets[0].Balance.IsZero())
+		require.Equal(t, money.USD, wallets[1].Currency)
+		require.True(t, wallets[1].Balance.Equal(decimal.NewFromInt(90)))
+		_, err = db.FindAllWalletsWithAccountID(ctx, 1000)
+		require.Equal(t, ErrAccountNotFound, err)
+
+		found, err = db.FindAccountByID(ctx, receiver.ID)
+		require.NoError(t, err)
+		require.True(t, found.Balance.Equal(decimal.RequireFromString("51.23")))
+
+		// a full reversal gives back exactly the amount that was sent
+		reversal := &Transfer{ReversedTransferID: transfer.ID}
+		require.NoError(t, db.CreateReversal(ctx, reversal))
+		require.Equal(t, money.BRL, reversal.Currency)
+		require.Equal(t, money.USD, reversal.DestinationCurrency)
+		require.True(t, reversal.Amount.Equal(decimal.RequireFromString("51.23")))
+		require.True(t, reversal.DestinationAmount.Equal(decimal.NewFromInt(10)))
+
+		for _, acc := range []*Account{sender, receiver} {
+			wallets, err := db.FindAllWalletsWithAccountID(ctx, acc.ID)
+			require.NoError(t, err)
+			for _, wallet := range wallets {
+				balance, err := db.ComputeLedgerBalance(ctx, acc.ID, wallet.Currency)
+				require.NoError(t, err)
+				require.True(t, wallet.Balance.Equal(balance), wallet.Currency)
+			}
+		}
+
+		balance, err := db.ComputeLedgerBalance(ctx, sender.ID, money.USD)
+		require.NoError(t, err)
+		require.True(t, balance.Equal(decimal.NewFromInt(100)))
+	})
+
+	t.Run("transfer limits", func(t *testing.T) {
+		sender := &Account{Name: "limited account", CPF: "456.456.456-45", Secret: "limitedsecret"}
+		require.NoError(t, db.CreateAccount(ctx, sender))
+		receiver := &Account{Name: "receiving account", CPF: "654.654.654-65", Secret: "receivingsecret"}
+		require.NoError(t, db.CreateAccount(ctx, receiver))
+		deposit := &CashMovement{AccountID: sender.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(500)}
+		require.NoError(t, db.CreateCashMovement(ctx, deposit))
+
+		limits, pending, err := db.FindTransferLimits(ctx, sender.ID)
+		require.NoError(t, err)
+		require.Len(t, limits, len(TransferLimitKinds))
+		require.Equal(t, LimitDaily, limits[1].Kind)
+		require.True(t, limits[1].Amount.Equal(decimal.NewFromInt(10_000)))
+		require.Empty(t, pending)
+		_, _, err = db.FindTransferLimits(ctx, 1000)
+		require.Equal(t, ErrAccountNotFound, err)
+
+		require.Equal(t, ErrInvalidTransferLimit, db.RequestTransferLimitChange(ctx, &TransferLimit{AccountID: sender.ID, Kind: "weekly", Amount: decimal.NewFromInt(1)}))
+		require.Equal(t, ErrInvalidAmount, db.RequestTransferLimitChange(ctx, &TransferLimit{AccountID: sender.ID, Kind: LimitDaily, Amount: decimal.Zero}))
+		require.Equal(t, ErrAccountNotFound, db.RequestTransferLimitChange(ctx, &TransferLimit{AccountID: 1000, Kind: LimitDaily, Amount: decimal.NewFromInt(1)}))
+
+		// decreases are effective immediately
+		decrease := &TransferLimit{AccountID: sender.ID, Kind: LimitDaily, Amount: decimal.NewFromInt(100)}
+		require.NoError(t, db.RequestTransferLimitChange(ctx, decrease))
+		require.True(t, decrease.EffectiveAt.Equal(decrease.CreatedAt))
+
+		require.NoError(t, db.CreateTransfer(ctx, &Transfer{AccountOriginID: sender.ID, AccountDestinationID: receiver.ID, Amount: decimal.NewFromInt(60)}))
+		exceeding := &Transfer{AccountOriginID: sender.ID, AccountDestinationID: receiver.ID, Amount: decimal.NewFromInt(50)}
+		require.Equal(t, ErrLimitExceeded, db.CreateTransfer(ctx, exceeding))
+		// funds are checked before limits
+		require.Equal(t, ErrNotEnoughFunds, db.CreateTransfer(ctx, &Transfer{AccountOriginID: sender.ID, AccountDestinationID: receiver.ID, Amount: decimal.NewFromInt(1000)}))
+
+		found, err := db.FindAccountByID(ctx, sender.ID)
+		require.NoError(t, err)
+		require.True(t, found.Balance.Equal(decimal.NewFromInt(440)))
+
+		// increases only come into effect after the cooling-off period
+		increase := &TransferLimit{AccountID: sender.ID, Kind: LimitDaily, Amount: decimal.NewFromInt(200)}
+		require.NoError(t, db.RequestTransferLimitChange(ctx, increase))
+		require.True(t, increase.EffectiveAt.Equal(increase.CreatedAt.Add(TransferLimitCoolingOff)))
+		require.Equal(t, ErrLimitExceeded, db.CreateTransfer(ctx, exceeding))
+
+		limits, pending, err = db.FindTransferLimits(ctx, sender.ID)
+		require.NoError(t, err)
+		require.True(t, limits[1].Amount.Equal(decimal.NewFromInt(100)))
+		require.Len(t, pending, 1)
+		require.Equal(t, increase.ID, pending[0].ID)
+
+		// transfers in other currencies count converted into reais at the
+		// current exchange rate of 5.1234
+		dollars := &CashMovement{AccountID: sender.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(100), Currency: money.USD}
+		require.NoError(t, db.CreateCashMovement(ctx, dollars))
+		require.NoError(t, db.CreateTransfer(ctx, &Transfer{AccountOriginID: sender.ID, AccountDestinationID: receiver.ID, Amount: decimal.NewFromInt(5), Currency: money.USD, DestinationCurrency: money.USD}))
+		require.Equal(t, ErrLimitExceeded, db.CreateTransfer(ctx, &Transfer{AccountOriginID: sender.ID, AccountDestinationID: receiver.ID, Amount: decimal.NewFromInt(3), Currency: money.USD, DestinationCurrency: money.USD}))
+
+		// withdrawals count towards the same limits as transfers
+		require.Equal(t, ErrLimitExceeded, db.CreateCashMovement(ctx, &CashMovement{AccountID: sender.ID, Type: CashMovementWithdrawal, Amount: decimal.NewFromInt(20)}))
+		require.NoError(t, db.CreateCashMovement(ctx, &CashMovement{AccountID: sender.ID, Type: CashMovementWithdrawal, Amount: decimal.NewFromInt(10)}))
+		require.Equal(t, ErrLimitExceeded, db.CreateTransfer(ctx, &Transfer{AccountOriginID: sender.ID, AccountDestinationID: receiver.ID, Amount: decimal.NewFromInt(5)}))
+	})
+
+	t.Run("credit line", func(t *testing.T) {
+		borrower := &Account{Name: "borrowing account", CPF: "147.258.369-82", Secret: "borrowingsecret"}
+		require.NoError(t, db.CreateAccount(ctx, borrower))
+
+		require.Equal(t, ErrInvalidCreditLine, db.SetAccountCreditLine(ctx, borrower.ID, decimal.NewFromInt(-1), decimal.Zero))
+		require.Equal(t, ErrInvalidCreditLine, db.SetAccountCreditLine(ctx, borrower.ID, decimal.RequireFromString("0.001"), decimal.Zero))
+		require.Equal(t, ErrInvalidCreditLine, db.SetAccountCreditLine(ctx, borrower.ID, decimal.NewFromInt(100), decimal.NewFromInt(-1)))
+		require.Equal(t, ErrAccountNotFound, db.SetAccountCreditLine(ctx, 1000, decimal.NewFromInt(100), decimal.Zero))
+
+		// without a credit line the balance cannot go negative
+		require.Equal(t, ErrNotEnoughFunds, db.CreateTransfer(ctx, &Transfer{AccountOriginID: borrower.ID, AccountDestinationID: acc1.ID, Amount: decimal.NewFromInt(1)}))
+
+		require.NoError(t, db.SetAccountCreditLine(ctx, borrower.ID, decimal.NewFromInt(100), decimal.RequireFromString("0.01")))
+		require.NoError(t, db.CreateTransfer(ctx, &Transfer{AccountOriginID: borrower.ID, AccountDestinationID: acc1.ID, Amount: decimal.NewFromInt(60)}))
+		require.NoError(t, db.CreateCashMovement(ctx, &CashMovement{AccountID: borrower.ID, Type: CashMovementWithdrawal, Amount: decimal.NewFromInt(40)}))
+		require.Equal(t, ErrNotEnoughFunds, db.CreateCashMovement(ctx, &CashMovement{AccountID: borrower.ID, Type: CashMovementWithdrawal, Amount: decimal.RequireFromString("0.01")}))
+
+		found, err := db.FindAccountByID(ctx, borrower.ID)
+		require.NoError(t, err)
+		require.Equal(t, "-100", found.Balance.String())
+		require.True(t, found.AvailableBalance().IsZero())
+
+		// the interest is charged once a day, even beyond the credit limit
+		now := time.Now()
+		accruals, err := db.AccrueOverdraftInterest(ctx, now)
+		require.NoError(t, err)
+		require.Len(t, accruals, 1)
+		require.Equal(t, borrower.ID, accruals[0].AccountID)
+		require.Equal(t, "-100", accruals[0].Balance.String())
+		require.Equal(t, "1", accruals[0].Amount.String())
+
+		accruals, err = db.AccrueOverdraftInterest(ctx, now)
+		require.NoError(t, err)
+		require.Empty(t, accruals)
+
+		found, err = db.FindAccountByID(ctx, borrower.ID)
+		require.NoError(t, err)
+		require.Equal(t, "-101", found.Balance.String())
+		balance, err := db.ComputeLedgerBalance(ctx, borrower.ID, money.DefaultCurrency)
+		require.NoError(t, err)
+		require.True(t, found.Balance.Equal(balance))
+
+		movements, err := db.FindAllCashMovementsWithAccountID(ctx, borrower.ID)
+		require.NoError(t, err)
+		require.Equal(t, CashMovementInterest, movements[0].Type)
+
+		// overdrawn accounts cannot be closed, not even by sweeping
+		_, err = db.CloseAccount(ctx, borrower.ID, acc1.ID)
+		require.Equal(t, ErrAccountBalanceNotZero, err)
+
+		// paid off overdrafts are not charged
+		require.NoError(t, db.CreateCashMovement(ctx, &CashMovement{AccountID: borrower.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(101)}))
+		accruals, err = db.AccrueOverdraftInterest(ctx, now.AddDate(0, 0, 1))
+		require.NoError(t, err)
+		require.Empty(t, accruals)
+	})
+
+	t.Run("business accounts", func(t *testing.T) {
+		business := &Account{
+			Name:   "business account",
+			Type:   AccountBusiness,
+			CNPJ:   "11222333000181",
+			Secret: "businesssecret",
+		}
+		require.NoError(t, db.CreateAccount(ctx, business))
+		require.Equal(t, "11.222.333/0001-81", business.CNPJ)
+		require.Empty(t, business.CPF)
+
+		duplicated := &Account{
+			Name:   "duplicated business account",
+			Type:   AccountBusiness,
+			CNPJ:   "11.222.333/0001-81",
+			Secret: "businesssecret",
+		}
+		require.Equal(t, ErrAccountAlreadyExists, db.CreateAccount(ctx, duplicated))
+
+		mismatch := &Account{
+			Name:   "business account with cpf",
+			Type:   AccountBusiness,
+			CPF:    "529.982.247-25",
+			Secret: "businesssecret",
+		}
+		require.Equal(t, ErrAccountDocumentMismatch, db.CreateAccount(ctx, mismatch))
+
+		found, err := db.FindAccountByDocument(ctx, "11222333000181")
+		require.NoError(t, err)
+		require.Equal(t, business.ID, found.ID)
+		require.Equal(t, AccountBusiness, found.Type)
+
+		individual, err := db.FindAccountByDocument(ctx, acc2.CPF)
+		require.NoError(t, err)
+		require.Equal(t, AccountIndividual, individual.Type)
+
+		deposit := &CashMovement{AccountID: business.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(5)}
+		require.NoError(t, db.CreateCashMovement(ctx, deposit))
+
+		transfers := []*Transfer{
+			{AccountOriginID: business.ID, AccountDestinationID: individual.ID, Amount: decimal.NewFromInt(3)},
+			{AccountOriginID: individual.ID, AccountDestinationID: business.ID, Amount: decimal.NewFromInt(1)},
+		}
+		for _, transf := range transfers {
+			require.NoError(t, db.CreateTransfer(ctx, transf))
+		}
+
+		found, err = db.FindAccountByID(ctx, business.ID)
+		require.NoError(t, err)
+		require.True(t, found.Balance.Equal(decimal.NewFromInt(3)))
+	})
+
+	t.Run("scheduled transfers", func(t *testing.T) {
+		startAt := time.Date(2030, 1, 31, 12, 0, 0, 0, time.UTC)
+
+		missing := &ScheduledTransfer{
+			AccountOriginID:      acc1.ID,
+			AccountDestinationID: 1000,
+			Amount:               decimal.NewFromInt(1),
+			Interval:             ScheduleOnce,
+			StartAt:              startAt,
+		}
+		require.Equal(t, ErrAccountNotFound, db.CreateScheduledTransfer(ctx, missing))
+
+		monthly := &ScheduledTransfer{
+			AccountOriginID:      acc1.ID,
+			AccountDestinationID: acc2.ID,
+			Amount:               decimal.NewFromInt(1),
+			Interval:             ScheduleMonthly,
+			StartAt:              startAt,
+		}
+		require.NoError(t, db.CreateScheduledTransfer(ctx, monthly))
+		require.NotEmpty(t, monthly.ID)
+		require.Equal(t, ScheduleActive, monthly.Status)
+		require.True(t, monthly.NextRunAt.Equal(startAt))
+
+		once := &ScheduledTransfer{
+			AccountOriginID:      acc1.ID,
+			AccountDestinationID: acc2.ID,
+			Amount:               decimal.NewFromInt(2),
+			Interval:             ScheduleOnce,
+			StartAt:              startAt.Add(time.Hour),
+		}
+		require.NoError(t, db.CreateScheduledTransfer(ctx, once))
+
+		_, _, err := db.ClaimDueScheduledTransfer(ctx, startAt.Add(-time.Second))
+		require.Equal(t, ErrScheduledTransferNotFound, err)
+
+		// concurrent claims of the same run are given to a single caller
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			claimed []*ScheduledTransferExecution
+		)
+		for n := 0; n < 10; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, execution, err := db.ClaimDueScheduledTransfer(ctx, startAt)
+				if err == nil {
+					mu.Lock()
+					claimed = append(claimed, execution)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		require.Len(t, claimed, 1)
+		require.Equal(t, monthly.ID, claimed[0].ScheduledTransferID)
+		require.Equal(t, ExecutionPending, claimed[0].Status)
+		require.True(t, claimed[0].ScheduledFor.Equal(startAt))
+
+		scheduled, execution, err := db.ClaimDueScheduledTransfer(ctx, startAt.AddDate(0, 1, 0))
+		require.NoError(t, err)
+		require.Equal(t, once.ID, scheduled.ID)
+		require.Equal(t, ScheduleCompleted, scheduled.Status)
+
+		execution.Status = ExecutionFailed
+		execution.Failure = ErrNotEnoughFunds.Error()
+		require.NoError(t, db.FinishScheduledTransferExecution(ctx, execution))
+
+		// the second run is clamped to the last day of february
+		scheduled, execution, err = db.ClaimDueScheduledTransfer(ctx, startAt.AddDate(0, 1, 0))
+		require.NoError(t, err)
+		require.Equal(t, monthly.ID, scheduled.ID)
+		require.True(t, execution.ScheduledFor.Equal(time.Date(2030, 2, 28, 12, 0, 0, 0, time.UTC)))
+		require.Equal(t, 2, scheduled.Runs)
+		require.True(t, scheduled.NextRunAt.Equal(time.Date(2030, 3, 31, 12, 0, 0, 0, time.UTC)))
+
+		executions, err := db.FindAllScheduledTransferExecutions(ctx, once.ID)
+		require.NoError(t, err)
+		require.Len(t, executions, 1)
+		require.Equal(t, ExecutionFailed, executions[0].Status)
+		require.Equal(t, ErrNotEnoughFunds.Error(), executions[0].Failure)
+
+		_, err = db.CancelScheduledTransfer(ctx, acc2.ID, monthly.ID)
+		require.Equal(t, ErrScheduledTransferNotFound, err)
+
+		cancelled, err := db.CancelScheduledTransfer(ctx, acc1.ID, monthly.ID)
+		require.NoError(t, err)
+		require.Equal(t, ScheduleCancelled, cancelled.Status)
+
+		_, err = db.CancelScheduledTransfer(ctx, acc1.ID, once.ID)
+		require.Equal(t, ErrScheduledTransferNotActive, err)
+
+		_, _, err = db.ClaimDueScheduledTransfer(ctx, startAt.AddDate(1, 0, 0))
+		require.Equal(t, ErrScheduledTransferNotFound, err)
+
+		schedules, err := db.FindAllScheduledTransfersWithAccountID(ctx, acc1.ID)
+		require.NoError(t, err)
+		require.Len(t, schedules, 2)
+		require.Equal(t, once.ID, schedules[0].ID)
+		require.Equal(t, monthly.ID, schedules[1].ID)
+	})
+
+	t.Run("concurrent transfers", func(t *testing.T) {
+		const (
+			numAccounts  = 5
+			numTransfers = 500
+		)
+
+		var accounts []*Account
+		for n := 0; n < numAccounts; n++ {
+			acc := &Account{
+				Name:   fmt.Sprintf("concurrent account %d", n),
+				CPF:    fmt.Sprintf("%03d.000.000-00", n+500),
+				Secret: "secret",
+			}
+			require.NoError(t, db.CreateAccount(ctx, acc))
+			accounts = append(accounts, acc)
+
+			deposit := &CashMovement{AccountID: acc.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(100)}
+			require.NoError(t, db.CreateCashMovement(ctx, deposit))
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, numTransfers)
+		for n := 0; n < numTransfers; n++ {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				// the destination is offset from the origin by 1 to
+				// numAccounts-1, so accounts never transfer to themselves
+				offset := 1 + n/numAccounts%(numAccounts-1)
+				transf := &Transfer{
+					AccountOriginID:      accounts[n%numAccounts].ID,
+					AccountDestinationID: accounts[(n+offset)%numAccounts].ID,
+					Amount:               decimal.NewFromInt(int64(n%30 + 1)),
+				}
+				err := db.CreateTransfer(ctx, transf)
+				if err != nil && err != ErrNotEnoughFunds && err != ErrLimitExceeded {
+					errs <- err
+				}
+			}(n)
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
+
+		total := decimal.Zero
+		for _, acc := range accounts {
+			found, err := db.FindAccountByID(ctx, acc.ID)
+			require.NoError(t, err)
+			require.False(t, found.Balance.IsNegative())
+
+			balance, err := db.ComputeLedgerBalance(ctx, acc.ID, money.DefaultCurrency)
+			require.NoError(t, err)
+			require.True(t, found.Balance.Equal(balance))
+
+			total = total.Add(found.Balance)
+		}
+		require.True(t, total.Equal(decimal.NewFromInt(100*numAccounts)))
+	})
+
+	// fee schedules apply to all transfers of their type, so this runs after
+	// the other transfers
+	t.Run("fees", func(t *testing.T) {
+		house := &Account{Name: "house account", CPF: "789.789.789-78", Secret: "housesecret"}
+		require.NoError(t, db.CreateAccount(ctx, house))
+		sender := &Account{Name: "paying account", CPF: "987.987.987-98", Secret: "payingsecret"}
+		require.NoError(t, db.CreateAccount(ctx, sender))
+		deposit := &CashMovement{AccountID: sender.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(1000)}
+		require.NoError(t, db.CreateCashMovement(ctx, deposit))
+
+		invalid := []*FeeSchedule{
+			{TransferType: "wire", Type: FeeFlat, Amount: decimal.NewFromInt(1), RevenueAccountID: house.ID},
+			{TransferType: TransferIndividual, Type: FeeFlat, Amount: decimal.RequireFromString("0.001"), RevenueAccountID: house.ID},
+			{TransferType: TransferIndividual, Type: FeePercentage, Rate: decimal.NewFromInt(2), RevenueAccountID: house.ID},
+			{TransferType: TransferIndividual, Type: FeeTiered, Tiers: []*FeeTier{{UpTo: decimal.NewFromInt(100)}}, RevenueAccountID: house.ID},
+			{TransferType: TransferIndividual, Type: FeeFlat, FreeMonthlyQuota: -1, RevenueAccountID: house.ID},
+		}
+		for _, schedule := range invalid {
+			require.Equal(t, ErrInvalidFeeSchedule, db.SetFeeSchedule(ctx, schedule))
+		}
+		require.Equal(t, ErrAccountNotFound, db.SetFeeSchedule(ctx, &FeeSchedule{TransferType: TransferIndividual, Type: FeeFlat, RevenueAccountID: 1000}))
+
+		transfer := func(amount string) *Transfer {
+			transf := &Transfer{AccountOriginID: sender.ID, AccountDestinationID: acc1.ID, Amount: decimal.RequireFromString(amount)}
+			require.NoError(t, db.CreateTransfer(ctx, transf))
+			return transf
+		}
+
+		// the first transfer of the month is free of charge
+		flat := &FeeSchedule{TransferType: TransferIndividual, Type: FeeFlat, Amount: decimal.NewFromInt(1), FreeMonthlyQuota: 1, RevenueAccountID: house.ID}
+		require.NoError(t, db.SetFeeSchedule(ctx, flat))
+		require.True(t, transfer("10").Fee.IsZero())
+		require.True(t, transfer("10").Fee.Equal(decimal.NewFromInt(1)))
+
+		tiered := &FeeSchedule{
+			TransferType: TransferIndividual,
+			Type:         FeeTiered,
+			Tiers: []*FeeTier{
+				{UpTo: decimal.NewFromInt(100), Amount: decimal.RequireFromString("0.5")},
+				{Amount: decimal.NewFromInt(1), Rate: decimal.RequireFromString("0.01")},
+			},
+			RevenueAccountID: house.ID,
+		}
+		require.NoError(t, db.SetFeeSchedule(ctx, tiered))
+		require.True(t, transfer("100").Fee.Equal(decimal.RequireFromString("0.5")))
+		require.True(t, transfer("200").Fee.Equal(decimal.NewFromInt(3)))
+
+		percentage := &FeeSchedule{TransferType: TransferIndividual, Type: FeePercentage, Rate: decimal.RequireFromString("0.015"), RevenueAccountID: house.ID}
+		require.NoError(t, db.SetFeeSchedule(ctx, percentage))
+		require.True(t, transfer("10.5").Fee.Equal(decimal.RequireFromString("0.16")))
+
+		schedules, err := db.FindAllFeeSchedules(ctx)
+		require.NoError(t, err)
+		require.Len(t, schedules, 1)
+		require.Equal(t, FeePercentage, schedules[0].Type)
+
+		// the fee counts towards the funds needed for the transfer
+		found, err := db.FindAccountByID(ctx, sender.ID)
+		require.NoError(t, err)
+		require.True(t, found.Balance.Equal(decimal.RequireFromString("664.84")))
+		all := &Transfer{AccountOriginID: sender.ID, AccountDestinationID: acc1.ID, Amount: found.Balance}
+		require.Equal(t, ErrNotEnoughFunds, db.CreateTransfer(ctx, all))
+
+		// the revenue account does not pay fees to itself
+		require.True(t, transfer("1").Fee.Equal(decimal.RequireFromString("0.02")))
+		free := &Transfer{AccountOriginID: house.ID, AccountDestinationID: sender.ID, Amount: decimal.NewFromInt(1)}
+		require.NoError(t, db.CreateTransfer(ctx, free))
+		require.True(t, free.Fee.IsZero())
+
+		found, err = db.FindAccountByID(ctx, house.ID)
+		require.NoError(t, err)
+		require.True(t, found.Balance.Equal(decimal.RequireFromString("3.68")))
+
+		for _, acc := range []*Account{sender, house} {
+			found, err := db.FindAccountByID(ctx, acc.ID)
+			require.NoError(t, err)
+			balance, err := db.ComputeLedgerBalance(ctx, acc.ID, money.DefaultCurrency)
+			require.NoError(t, err)
+			require.True(t, found.Balance.Equal(balance))
+		}
+
+		// fixed amounts and tier bounds are in reais, converted at the current
+		// exchange rate of 5.1234 for transfers in other currencies
+		dollars := &CashMovement{AccountID: sender.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(100), Currency: money.USD}
+		require.NoError(t, db.CreateCashMovement(ctx, dollars))
+		tiered.Tiers = []*FeeTier{
+			{UpTo: decimal.NewFromInt(100), Amount: decimal.RequireFromString("0.5")},
+			{Amount: decimal.NewFromInt(10), Rate: decimal.RequireFromString("0.01")},
+		}
+		require.NoError(t, db.SetFeeSchedule(ctx, tiered))
+		transferDollars := func(amount int64) *Transfer {
+			transf := &Transfer{AccountOriginID: sender.ID, AccountDestinationID: acc1.ID, Amount: decimal.NewFromInt(amount), Currency: money.USD, DestinationCurrency: money.USD}
+			require.NoError(t, db.CreateTransfer(ctx, transf))
+			return transf
+		}
+		require.True(t, transferDollars(10).Fee.Equal(decimal.RequireFromString("0.1")))
+		require.True(t, transferDollars(20).Fee.Equal(decimal.RequireFromString("2.15")))
 	})
 }
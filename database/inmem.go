@@ -1,17 +1,32 @@
 package database
 
 import (
-	"sync"
+	"context"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/lindebergue/desafio-go-stone/document"
+	"github.com/lindebergue/desafio-go-stone/money"
 )
 
 // NewInMemDB returns a DB instance backed by local in-memory storage. Used only
 // for unittests.
 func NewInMemDB(opts ...InMemOption) DB {
 	db := &inmemDB{
-		accounts:  map[int64]*Account{},
-		transfers: map[int64]*Transfer{},
-		now:       time.Now,
+		sem:           make(chan struct{}, 1),
+		accounts:      map[int64]*Account{},
+		transfers:     map[int64]*Transfer{},
+		wallets:       map[walletID]*Wallet{},
+		rates:         map[exchangeRateID]*ExchangeRate{},
+		fees:          map[TransferType]*FeeSchedule{},
+		accruals:      map[interestAccrualID]*InterestAccrual{},
+		keys:          map[idempotencyKeyID]*IdempotencyKey{},
+		throttles:     map[string]*LoginThrottle{},
+		now:           time.Now,
+		defaultLimits: defaultTransferLimits,
 	}
 	for _, opt := range opts {
 		opt(db)
@@ -29,32 +44,89 @@ func WithNowFunc(now func() time.Time) InMemOption {
 	}
 }
 
+// WithDefaultTransferLimits changes the transfer limits of the accounts that
+// never changed them. Kinds missing from limits keep their default amounts.
+func WithDefaultTransferLimits(limits map[TransferLimitKind]decimal.Decimal) InMemOption {
+	return func(i *inmemDB) {
+		i.defaultLimits = transferLimitDefaults(limits)
+	}
+}
+
 type inmemDB struct {
-	mu        sync.Mutex
-	accounts  map[int64]*Account
-	transfers map[int64]*Transfer
-	now       func() time.Time
+	sem           chan struct{}
+	accounts      map[int64]*Account
+	transfers     map[int64]*Transfer
+	wallets       map[walletID]*Wallet
+	rates         map[exchangeRateID]*ExchangeRate
+	fees          map[TransferType]*FeeSchedule
+	accruals      map[interestAccrualID]*InterestAccrual
+	movements     []*CashMovement
+	limits        []*TransferLimit
+	defaultLimits map[TransferLimitKind]decimal.Decimal
+	schedules     []*ScheduledTransfer
+	executions    []*ScheduledTransferExecution
+	entries       []*LedgerEntry
+	sessions      []*Session
+	throttles     map[string]*LoginThrottle
+	apiKeys       []*APIKey
+	audit         []*AuditEvent
+	keys          map[idempotencyKeyID]*IdempotencyKey
+	now           func() time.Time
+}
+
+// walletID identifies the wallet of an account in a currency.
+type walletID struct {
+	accountID int64
+	currency  money.Currency
 }
 
-func (i *inmemDB) CreateAccount(account *Account) error {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+// exchangeRateID identifies the exchange rate between two currencies.
+type exchangeRateID struct {
+	base  money.Currency
+	quote money.Currency
+}
+
+// interestAccrualID identifies the interest accrual of an account for a day.
+type interestAccrualID struct {
+	accountID int64
+	day       time.Time
+}
+
+// idempotencyKeyID identifies an idempotency key of an account.
+type idempotencyKeyID struct {
+	accountID int64
+	key       string
+}
+
+func (i *inmemDB) CreateAccount(ctx context.Context, account *Account) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
 
+	if err := prepareAccount(account); err != nil {
+		return err
+	}
 	for _, acc := range i.accounts {
-		if acc.CPF == account.CPF {
+		if acc.Document() == account.Document() {
 			return ErrAccountAlreadyExists
 		}
 	}
 
 	account.ID = int64(len(i.accounts) + 1)
+	account.Balance = decimal.Zero
+	account.CreditLimit = decimal.Zero
+	account.OverdraftRate = decimal.Zero
 	account.CreatedAt = i.now()
 	i.accounts[account.ID] = account
 	return nil
 }
 
-func (i *inmemDB) FindAccountByID(id int64) (*Account, error) {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+func (i *inmemDB) FindAccountByID(ctx context.Context, id int64) (*Account, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
 
 	for _, acc := range i.accounts {
 		if acc.ID == id {
@@ -65,12 +137,15 @@ func (i *inmemDB) FindAccountByID(id int64) (*Account, error) {
 	return nil, ErrAccountNotFound
 }
 
-func (i *inmemDB) FindAccountByCPF(cpf string) (*Account, error) {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+func (i *inmemDB) FindAccountByDocument(ctx context.Context, doc string) (*Account, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
 
+	doc = document.Normalize(doc)
 	for _, acc := range i.accounts {
-		if acc.CPF == cpf {
+		if acc.Document() == doc {
 			return acc, nil
 		}
 	}
@@ -78,9 +153,431 @@ func (i *inmemDB) FindAccountByCPF(cpf string) (*Account, error) {
 	return nil, ErrAccountNotFound
 }
 
-func (i *inmemDB) FindAllAccounts() ([]*Account, error) {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+func (i *inmemDB) SetAccountStatus(ctx context.Context, accountID int64, status AccountStatus) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	account, ok := i.accounts[accountID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	if !account.Status.CanTransitionTo(status) {
+		return ErrInvalidStatusTransition
+	}
+
+	account.Status = status
+	return nil
+}
+
+func (i *inmemDB) SetAccountCreditLine(ctx context.Context, accountID int64, limit, rate decimal.Decimal) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := checkCreditLine(limit, rate); err != nil {
+		return err
+	}
+	account, ok := i.accounts[accountID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	if account.Status == AccountClosed {
+		return ErrAccountClosed
+	}
+
+	account.CreditLimit = limit
+	account.OverdraftRate = rate
+	return nil
+}
+
+func (i *inmemDB) AccrueOverdraftInterest(ctx context.Context, now time.Time) ([]*InterestAccrual, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	ids := make([]int64, 0, len(i.accounts))
+	for id := range i.accounts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		return ids[a] < ids[b]
+	})
+
+	day, _ := dayOf(now)
+	var accruals []*InterestAccrual
+	for _, id := range ids {
+		account := i.accounts[id]
+		accrualID := interestAccrualID{accountID: id, day: day}
+		if _, ok := i.accruals[accrualID]; ok {
+			continue
+		}
+		interest := overdraftInterest(account)
+		if interest.IsZero() {
+			continue
+		}
+
+		movement := &CashMovement{
+			ID:        int64(len(i.movements) + 1),
+			AccountID: id,
+			Type:      CashMovementInterest,
+			Amount:    interest,
+			Currency:  money.DefaultCurrency,
+			CreatedAt: i.now(),
+		}
+		accrual := &InterestAccrual{
+			AccountID:      id,
+			Day:            day,
+			Balance:        account.Balance,
+			Rate:           account.OverdraftRate,
+			Amount:         interest,
+			CashMovementID: movement.ID,
+			CreatedAt:      movement.CreatedAt,
+		}
+		i.addBalance(account, money.DefaultCurrency, interest.Neg())
+		i.movements = append(i.movements, movement)
+		i.addLedgerEntry(&LedgerEntry{AccountID: id, CashMovementID: movement.ID, Amount: interest.Neg(), Currency: money.DefaultCurrency})
+		i.accruals[accrualID] = accrual
+		accruals = append(accruals, accrual)
+	}
+
+	return accruals, nil
+}
+
+func (i *inmemDB) CloseAccount(ctx context.Context, accountID, sweepAccountID int64) ([]*Transfer, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	account, ok := i.accounts[accountID]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	if _, ok := i.accounts[sweepAccountID]; sweepAccountID != 0 && !ok {
+		return nil, ErrAccountNotFound
+	}
+	if account.Status == AccountClosed {
+		return nil, ErrAccountClosed
+	}
+
+	var sweeps []*Transfer
+	for _, wallet := range i.walletsOf(account) {
+		if wallet.Balance.IsZero() {
+			continue
+		}
+		// only the first wallet can be overdrawn, so nothing was swept yet
+		if wallet.Balance.IsNegative() || sweepAccountID == 0 || sweepAccountID == accountID {
+			return nil, ErrAccountBalanceNotZero
+		}
+		sweep := &Transfer{
+			AccountOriginID:      accountID,
+			AccountDestinationID: sweepAccountID,
+			Amount:               wallet.Balance,
+			Currency:             wallet.Currency,
+			Reason:               "account closure",
+		}
+		if err := i.applyTransfer(sweep, false); err != nil {
+			return nil, err
+		}
+		sweeps = append(sweeps, sweep)
+	}
+
+	account.Status = AccountClosed
+	now := i.now()
+	for _, s := range i.sessions {
+		if s.AccountID == accountID && s.RevokedAt.IsZero() {
+			s.RevokedAt = now
+		}
+	}
+	for _, k := range i.apiKeys {
+		if k.AccountID == accountID && k.RevokedAt.IsZero() {
+			k.RevokedAt = now
+		}
+	}
+	for _, s := range i.schedules {
+		if s.AccountOriginID == accountID && s.Status == ScheduleActive {
+			s.Status = ScheduleCancelled
+		}
+	}
+	return sweeps, nil
+}
+
+func (i *inmemDB) FindAllWalletsWithAccountID(ctx context.Context, accountID int64) ([]*Wallet, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	account, ok := i.accounts[accountID]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+
+	return i.walletsOf(account), nil
+}
+
+// walletsOf returns the wallets of account, starting with the wallet of
+// money.DefaultCurrency. Must be called with the database locked.
+func (i *inmemDB) walletsOf(account *Account) []*Wallet {
+	var wallets []*Wallet
+	for _, w := range i.wallets {
+		if w.AccountID == account.ID {
+			wallets = append(wallets, w)
+		}
+	}
+	sort.Slice(wallets, func(a, b int) bool {
+		return wallets[a].Currency < wallets[b].Currency
+	})
+
+	defaultWallet := &Wallet{AccountID: account.ID, Currency: money.DefaultCurrency, Balance: account.Balance}
+	return append([]*Wallet{defaultWallet}, wallets...)
+}
+
+// balance returns the balance of the wallet of currency c of account. Must be
+// called with the database locked.
+func (i *inmemDB) balance(account *Account, c money.Currency) decimal.Decimal {
+	if c == money.DefaultCurrency {
+		return account.Balance
+	}
+	if w, ok := i.wallets[walletID{accountID: account.ID, currency: c}]; ok {
+		return w.Balance
+	}
+	return decimal.Zero
+}
+
+// addBalance adds amount to the balance of the wallet of currency c of
+// account, creating the wallet if needed. Must be called with the database
+// locked.
+func (i *inmemDB) addBalance(account *Account, c money.Currency, amount decimal.Decimal) {
+	if c == money.DefaultCurrency {
+		account.Balance = account.Balance.Add(amount)
+		return
+	}
+
+	id := walletID{accountID: account.ID, currency: c}
+	w, ok := i.wallets[id]
+	if !ok {
+		w = &Wallet{AccountID: account.ID, Currency: c, Balance: decimal.Zero}
+		i.wallets[id] = w
+	}
+	w.Balance = w.Balance.Add(amount)
+}
+
+func (i *inmemDB) SetExchangeRate(ctx context.Context, rate *ExchangeRate) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := checkExchangeRate(rate); err != nil {
+		return err
+	}
+
+	rate.UpdatedAt = i.now()
+	i.rates[exchangeRateID{base: rate.Base, quote: rate.Quote}] = rate
+	return nil
+}
+
+func (i *inmemDB) FindAllExchangeRates(ctx context.Context) ([]*ExchangeRate, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	var rates []*ExchangeRate
+	for _, r := range i.rates {
+		rates = append(rates, r)
+	}
+	sort.Slice(rates, func(a, b int) bool {
+		if rates[a].Base != rates[b].Base {
+			return rates[a].Base < rates[b].Base
+		}
+		return rates[a].Quote < rates[b].Quote
+	})
+
+	return rates, nil
+}
+
+// exchangeRate returns the rate for converting from base to quote. Must be
+// called with the database locked.
+func (i *inmemDB) exchangeRate(base, quote money.Currency) (decimal.Decimal, error) {
+	if base == quote {
+		return sameCurrencyRate, nil
+	}
+	rate, ok := i.rates[exchangeRateID{base: base, quote: quote}]
+	if !ok {
+		return decimal.Zero, ErrExchangeRateNotFound
+	}
+	return rate.Rate, nil
+}
+
+func (i *inmemDB) SetFeeSchedule(ctx context.Context, schedule *FeeSchedule) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := checkFeeSchedule(schedule); err != nil {
+		return err
+	}
+	if _, ok := i.accounts[schedule.RevenueAccountID]; !ok {
+		return ErrAccountNotFound
+	}
+
+	schedule.UpdatedAt = i.now()
+	i.fees[schedule.TransferType] = schedule
+	return nil
+}
+
+func (i *inmemDB) FindAllFeeSchedules(ctx context.Context) ([]*FeeSchedule, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	var schedules []*FeeSchedule
+	for _, s := range i.fees {
+		schedules = append(schedules, s)
+	}
+	sort.Slice(schedules, func(a, b int) bool {
+		return schedules[a].TransferType < schedules[b].TransferType
+	})
+
+	return schedules, nil
+}
+
+func (i *inmemDB) ChangeAccountSecret(ctx context.Context, accountID int64, secret string) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	account, ok := i.accounts[accountID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	account.Secret = secret
+	for _, s := range i.sessions {
+		if s.AccountID == accountID && s.RevokedAt.IsZero() {
+			s.RevokedAt = i.now()
+		}
+	}
+	return nil
+}
+
+func (i *inmemDB) RehashAccountSecret(ctx context.Context, accountID int64, oldHash, newHash string) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	account, ok := i.accounts[accountID]
+	if ok && account.Secret == oldHash {
+		account.Secret = newHash
+	}
+	return nil
+}
+
+func (i *inmemDB) EnrollAccountTOTP(ctx context.Context, accountID int64, secret string, recoveryCodeHashes []string) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	account, ok := i.accounts[accountID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	if account.TOTPEnabled {
+		return ErrTOTPAlreadyEnabled
+	}
+
+	account.TOTPSecret = secret
+	account.TOTPLastStep = 0
+	account.TOTPRecoveryCodes = recoveryCodeHashes
+	return nil
+}
+
+func (i *inmemDB) EnableAccountTOTP(ctx context.Context, accountID, step int64) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	account, ok := i.accounts[accountID]
+	if !ok || account.TOTPSecret == "" || account.TOTPEnabled {
+		return ErrTOTPNotEnrolled
+	}
+
+	account.TOTPEnabled = true
+	account.TOTPLastStep = step
+	return nil
+}
+
+func (i *inmemDB) UseAccountTOTPStep(ctx context.Context, accountID, step int64) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	account, ok := i.accounts[accountID]
+	if !ok || !account.TOTPEnabled || account.TOTPLastStep >= step {
+		return ErrTOTPCodeReused
+	}
+
+	account.TOTPLastStep = step
+	return nil
+}
+
+func (i *inmemDB) UseAccountRecoveryCode(ctx context.Context, accountID int64, hash string) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	account, ok := i.accounts[accountID]
+	if !ok || !account.TOTPEnabled {
+		return ErrRecoveryCodeNotFound
+	}
+	for n, h := range account.TOTPRecoveryCodes {
+		if h == hash {
+			codes := append([]string{}, account.TOTPRecoveryCodes[:n]...)
+			account.TOTPRecoveryCodes = append(codes, account.TOTPRecoveryCodes[n+1:]...)
+			return nil
+		}
+	}
+
+	return ErrRecoveryCodeNotFound
+}
+
+func (i *inmemDB) DisableAccountTOTP(ctx context.Context, accountID int64) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	account, ok := i.accounts[accountID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	account.TOTPSecret = ""
+	account.TOTPEnabled = false
+	account.TOTPLastStep = 0
+	account.TOTPRecoveryCodes = nil
+	return nil
+}
+
+func (i *inmemDB) FindAllAccounts(ctx context.Context) ([]*Account, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
 
 	var accounts []*Account
 	for _, acc := range i.accounts {
@@ -90,51 +587,937 @@ func (i *inmemDB) FindAllAccounts() ([]*Account, error) {
 	return accounts, nil
 }
 
-func (i *inmemDB) CreateTransfer(transfer *Transfer) error {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+func (i *inmemDB) FindAccounts(ctx context.Context, filter *AccountFilter) ([]*Account, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	prefix := strings.ToLower(filter.NamePrefix)
 
-	var (
-		srcAccount *Account
-		dstAccount *Account
-	)
+	var accounts []*Account
 	for _, acc := range i.accounts {
-		if acc.ID == transfer.AccountOriginID {
-			srcAccount = acc
+		if !strings.HasPrefix(strings.ToLower(acc.Name), prefix) {
+			continue
+		}
+		if filter.After != nil && !accountBefore(filter, filter.After, acc) {
+			continue
+		}
+		accounts = append(accounts, acc)
+	}
+
+	sort.Slice(accounts, func(a, b int) bool {
+		return accountBefore(filter, accountCursor(accounts[a]), accounts[b])
+	})
+	if filter.Limit > 0 && len(accounts) > filter.Limit {
+		accounts = accounts[:filter.Limit]
+	}
+
+	return accounts, nil
+}
+
+// accountCursor returns the cursor for the position of acc.
+func accountCursor(acc *Account) *AccountCursor {
+	return &AccountCursor{CreatedAt: acc.CreatedAt, Name: acc.Name, ID: acc.ID}
+}
+
+// accountBefore reports whether the position given by cursor comes before acc
+// in a listing ordered as requested by filter.
+func accountBefore(filter *AccountFilter, cursor *AccountCursor, acc *Account) bool {
+	var cmp int
+	switch filter.Sort {
+	case AccountSortName:
+		cmp = strings.Compare(cursor.Name, acc.Name)
+	default:
+		switch {
+		case cursor.CreatedAt.Before(acc.CreatedAt):
+			cmp = -1
+		case cursor.CreatedAt.After(acc.CreatedAt):
+			cmp = 1
+		}
+	}
+	if cmp == 0 {
+		switch {
+		case cursor.ID < acc.ID:
+			cmp = -1
+		case cursor.ID > acc.ID:
+			cmp = 1
+		}
+	}
+
+	if filter.Descending {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (i *inmemDB) CreateTransfer(ctx context.Context, transfer *Transfer) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	return i.applyTransfer(transfer, true)
+}
+
+func (i *inmemDB) CreateReversal(ctx context.Context, reversal *Transfer) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	original, ok := i.transfers[reversal.ReversedTransferID]
+	if !ok {
+		return ErrTransferNotFound
+	}
+	if original.ReversedTransferID != 0 {
+		return ErrTransferNotReversible
+	}
+	for _, t := range i.transfers {
+		if t.ReversedTransferID == original.ID {
+			return ErrTransferAlreadyReversed
+		}
+	}
+
+	if err := prepareReversal(reversal, original); err != nil {
+		return err
+	}
+	return i.applyTransfer(reversal, false)
+}
+
+// applyTransfer moves the transfer amount between the accounts and records the
+// transfer. Direct transfers, the ones made by CreateTransfer, are charged
+// their fee and checked against the transfer limits of the origin. Must be
+// called with the database locked.
+func (i *inmemDB) applyTransfer(transfer *Transfer, direct bool) error {
+	if err := prepareTransfer(transfer); err != nil {
+		return err
+	}
+	// reversals are converted at the rate of the reversed transfer
+	if transfer.ReversedTransferID == 0 {
+		rate, err := i.exchangeRate(transfer.Currency, transfer.DestinationCurrency)
+		if err != nil {
+			return err
 		}
-		if acc.ID == transfer.AccountDestinationID {
-			dstAccount = acc
+		if err := convertTransfer(transfer, rate); err != nil {
+			return err
 		}
 	}
 
-	if srcAccount == nil || dstAccount == nil {
+	srcAccount, ok := i.accounts[transfer.AccountOriginID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	dstAccount, ok := i.accounts[transfer.AccountDestinationID]
+	if !ok {
 		return ErrAccountNotFound
 	}
-	if srcAccount.Balance.LessThan(transfer.Amount) {
+
+	reversal := transfer.ReversedTransferID != 0
+	if err := checkDebit(srcAccount, reversal); err != nil {
+		return err
+	}
+	if err := checkCredit(dstAccount, reversal); err != nil {
+		return err
+	}
+	now := i.now()
+	var revenueAccount *Account
+	if direct {
+		account, err := i.chargeFee(transfer, srcAccount, now)
+		if err != nil {
+			return err
+		}
+		revenueAccount = account
+	}
+	if availableFunds(srcAccount, transfer.Currency, i.balance(srcAccount, transfer.Currency)).LessThan(transfer.Amount.Add(transfer.Fee)) {
 		return ErrNotEnoughFunds
 	}
+	if direct && limitedTransfer(transfer) {
+		if err := i.checkTransferLimits(transfer.AccountOriginID, transfer.Currency, transfer.Amount, now); err != nil {
+			return err
+		}
+	}
 
 	transfer.ID = int64(len(i.transfers) + 1)
-	transfer.CreatedAt = i.now()
-	srcAccount.Balance = srcAccount.Balance.Sub(transfer.Amount)
-	dstAccount.Balance = dstAccount.Balance.Add(transfer.Amount)
-	i.accounts[srcAccount.ID] = srcAccount
-	i.accounts[dstAccount.ID] = dstAccount
+	transfer.CreatedAt = now
+	i.addBalance(srcAccount, transfer.Currency, transfer.Amount.Neg())
+	i.addBalance(dstAccount, transfer.DestinationCurrency, transfer.DestinationAmount)
 	i.transfers[transfer.ID] = transfer
+	i.addLedgerEntry(&LedgerEntry{AccountID: srcAccount.ID, TransferID: transfer.ID, Amount: transfer.Amount.Neg(), Currency: transfer.Currency})
+	i.addLedgerEntry(&LedgerEntry{AccountID: dstAccount.ID, TransferID: transfer.ID, Amount: transfer.DestinationAmount, Currency: transfer.DestinationCurrency})
+	if revenueAccount != nil {
+		i.addBalance(srcAccount, transfer.Currency, transfer.Fee.Neg())
+		i.addBalance(revenueAccount, transfer.Currency, transfer.Fee)
+		i.addLedgerEntry(&LedgerEntry{AccountID: srcAccount.ID, TransferID: transfer.ID, Amount: transfer.Fee.Neg(), Currency: transfer.Currency})
+		i.addLedgerEntry(&LedgerEntry{AccountID: revenueAccount.ID, TransferID: transfer.ID, Amount: transfer.Fee, Currency: transfer.Currency})
+	}
 
 	return nil
 }
 
-func (i *inmemDB) FindAllTransfersWithAccountID(accountID int64) ([]*Transfer, error) {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+// chargeFee fills the fee of transfer, made at now by origin, and returns the
+// revenue account the fee is credited into, or nil if the transfer is free of
+// charge. Must be called with the database locked.
+func (i *inmemDB) chargeFee(transfer *Transfer, origin *Account, now time.Time) (*Account, error) {
+	transferType := transferTypeOf(transfer, origin.Type)
+	schedule, ok := i.fees[transferType]
+	if !ok || schedule.RevenueAccountID == origin.ID {
+		return nil, nil
+	}
+	rate, err := i.exchangeRate(transfer.Currency, money.DefaultCurrency)
+	if err != nil {
+		return nil, err
+	}
 
-	var transfers []*Transfer
+	start, end := monthOf(now)
+	var transfers int
 	for _, t := range i.transfers {
-		if t.AccountOriginID == accountID || t.AccountDestinationID == accountID {
-			transfers = append(transfers, t)
+		if t.AccountOriginID == origin.ID && t.ReversedTransferID == 0 && transferTypeOf(t, origin.Type) == transferType &&
+			!t.CreatedAt.Before(start) && t.CreatedAt.Before(end) {
+			transfers++
 		}
 	}
 
-	return transfers, nil
+	transfer.Fee = schedule.Fee(transfer.Amount, transfer.Currency, rate, transfers)
+	if transfer.Fee.IsZero() {
+		return nil, nil
+	}
+	return i.accounts[schedule.RevenueAccountID], nil
+}
+
+// checkTransferLimits returns ErrLimitExceeded if moving amount in currency c
+// out of accountID at now, by a transfer or a withdrawal, exceeds any of the
+// transfer limits of the account. Must be called with the database locked.
+func (i *inmemDB) checkTransferLimits(accountID int64, c money.Currency, amount decimal.Decimal, now time.Time) error {
+	current, _ := resolveTransferLimits(accountID, i.limitsOf(accountID), i.defaultLimits, now)
+
+	dayStart, dayEnd := dayOf(now)
+	nightStart, nightEnd, night := nightOf(now)
+	daily := map[money.Currency]decimal.Decimal{c: amount}
+	nightly := map[money.Currency]decimal.Decimal{c: amount}
+	add := func(currency money.Currency, value decimal.Decimal, at time.Time) {
+		if !at.Before(dayStart) && at.Before(dayEnd) {
+			daily[currency] = daily[currency].Add(value)
+		}
+		if night && !at.Before(nightStart) && at.Before(nightEnd) {
+			nightly[currency] = nightly[currency].Add(value)
+		}
+	}
+	for _, t := range i.transfers {
+		if t.AccountOriginID == accountID && limitedTransfer(t) {
+			add(t.Currency, t.Amount, t.CreatedAt)
+		}
+	}
+	for _, m := range i.movements {
+		if m.AccountID == accountID && m.Type == CashMovementWithdrawal {
+			add(m.Currency, m.Amount, m.CreatedAt)
+		}
+	}
+
+	rate := func(c money.Currency) (decimal.Decimal, error) {
+		return i.exchangeRate(c, money.DefaultCurrency)
+	}
+	amount, err := limitTotal(map[money.Currency]decimal.Decimal{c: amount}, rate)
+	if err != nil {
+		return err
+	}
+	dailyTotal, err := limitTotal(daily, rate)
+	if err != nil {
+		return err
+	}
+	nightlyTotal, err := limitTotal(nightly, rate)
+	if err != nil {
+		return err
+	}
+	return checkLimitTotals(amount, current, dailyTotal, nightlyTotal, night)
+}
+
+func (i *inmemDB) FindTransferLimits(ctx context.Context, accountID int64) ([]*TransferLimit, []*TransferLimit, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer i.unlock()
+
+	if _, ok := i.accounts[accountID]; !ok {
+		return nil, nil, ErrAccountNotFound
+	}
+
+	current, pending := resolveTransferLimits(accountID, i.limitsOf(accountID), i.defaultLimits, i.now())
+	return current, pending, nil
+}
+
+func (i *inmemDB) RequestTransferLimitChange(ctx context.Context, limit *TransferLimit) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := checkTransferLimit(limit); err != nil {
+		return err
+	}
+	if _, ok := i.accounts[limit.AccountID]; !ok {
+		return ErrAccountNotFound
+	}
+
+	now := i.now()
+	current, _ := resolveTransferLimits(limit.AccountID, i.limitsOf(limit.AccountID), i.defaultLimits, now)
+	limit.ID = int64(len(i.limits) + 1)
+	limit.EffectiveAt = coolingOff(limitsByKind(current)[limit.Kind].Amount, limit.Amount, now)
+	limit.CreatedAt = now
+	i.limits = append(i.limits, limit)
+	return nil
+}
+
+// limitsOf returns the history of transfer limits of accountID. Must be called
+// with the database locked.
+func (i *inmemDB) limitsOf(accountID int64) []*TransferLimit {
+	var limits []*TransferLimit
+	for _, limit := range i.limits {
+		if limit.AccountID == accountID {
+			limits = append(limits, limit)
+		}
+	}
+	return limits
+}
+
+func (i *inmemDB) CreateScheduledTransfer(ctx context.Context, scheduled *ScheduledTransfer) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := checkTransfer(scheduled.AccountOriginID, scheduled.AccountDestinationID, scheduled.Amount, money.DefaultCurrency); err != nil {
+		return err
+	}
+	origin, ok := i.accounts[scheduled.AccountOriginID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	destination, ok := i.accounts[scheduled.AccountDestinationID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	if err := checkDebit(origin, false); err != nil {
+		return err
+	}
+	if err := checkCredit(destination, false); err != nil {
+		return err
+	}
+
+	scheduled.ID = int64(len(i.schedules) + 1)
+	scheduled.NextRunAt = scheduled.StartAt
+	scheduled.Runs = 0
+	scheduled.Status = ScheduleActive
+	scheduled.CreatedAt = i.now()
+	i.schedules = append(i.schedules, scheduled)
+	return nil
+}
+
+func (i *inmemDB) FindAllScheduledTransfersWithAccountID(ctx context.Context, accountID int64) ([]*ScheduledTransfer, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	var schedules []*ScheduledTransfer
+	for n := len(i.schedules) - 1; n >= 0; n-- {
+		if i.schedules[n].AccountOriginID == accountID {
+			schedules = append(schedules, i.schedules[n])
+		}
+	}
+
+	return schedules, nil
+}
+
+func (i *inmemDB) CancelScheduledTransfer(ctx context.Context, accountID, id int64) (*ScheduledTransfer, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	for _, s := range i.schedules {
+		if s.ID != id || s.AccountOriginID != accountID {
+			continue
+		}
+		if s.Status != ScheduleActive {
+			return nil, ErrScheduledTransferNotActive
+		}
+		s.Status = ScheduleCancelled
+		return s, nil
+	}
+
+	return nil, ErrScheduledTransferNotFound
+}
+
+func (i *inmemDB) ClaimDueScheduledTransfer(ctx context.Context, now time.Time) (*ScheduledTransfer, *ScheduledTransferExecution, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer i.unlock()
+
+	var due *ScheduledTransfer
+	for _, s := range i.schedules {
+		if s.Status != ScheduleActive || s.NextRunAt.After(now) {
+			continue
+		}
+		if due == nil || s.NextRunAt.Before(due.NextRunAt) {
+			due = s
+		}
+	}
+	if due == nil {
+		return nil, nil, ErrScheduledTransferNotFound
+	}
+
+	execution := &ScheduledTransferExecution{
+		ID:                  int64(len(i.executions) + 1),
+		ScheduledTransferID: due.ID,
+		ScheduledFor:        due.NextRunAt,
+		Status:              ExecutionPending,
+		CreatedAt:           i.now(),
+	}
+	due.advance()
+	i.executions = append(i.executions, execution)
+
+	claimed := *due
+	return &claimed, execution, nil
+}
+
+func (i *inmemDB) FinishScheduledTransferExecution(ctx context.Context, execution *ScheduledTransferExecution) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	for n, e := range i.executions {
+		if e.ID == execution.ID {
+			i.executions[n] = execution
+			return nil
+		}
+	}
+
+	return ErrScheduledTransferNotFound
+}
+
+func (i *inmemDB) FindAllScheduledTransferExecutions(ctx context.Context, scheduledTransferID int64) ([]*ScheduledTransferExecution, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	var executions []*ScheduledTransferExecution
+	for n := len(i.executions) - 1; n >= 0; n-- {
+		if i.executions[n].ScheduledTransferID == scheduledTransferID {
+			executions = append(executions, i.executions[n])
+		}
+	}
+
+	return executions, nil
+}
+
+func (i *inmemDB) FindAllTransfersWithAccountID(ctx context.Context, accountID int64) ([]*Transfer, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	var transfers []*Transfer
+	for _, t := range i.transfers {
+		if t.AccountOriginID == accountID || t.AccountDestinationID == accountID {
+			transfers = append(transfers, t)
+		}
+	}
+
+	return transfers, nil
+}
+
+func (i *inmemDB) FindTransfers(ctx context.Context, filter *TransferFilter) ([]*Transfer, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	var transfers []*Transfer
+	for _, t := range i.transfers {
+		if matchTransfer(t, filter) {
+			transfers = append(transfers, t)
+		}
+	}
+
+	sort.Slice(transfers, func(a, b int) bool {
+		return transferBefore(transfers[a], transfers[b].CreatedAt, transfers[b].ID)
+	})
+	if filter.Limit > 0 && len(transfers) > filter.Limit {
+		transfers = transfers[:filter.Limit]
+	}
+
+	return transfers, nil
+}
+
+// matchTransfer reports whether t matches filter.
+func matchTransfer(t *Transfer, filter *TransferFilter) bool {
+	switch filter.Direction {
+	case TransferDirectionSent:
+		if t.AccountOriginID != filter.AccountID {
+			return false
+		}
+	case TransferDirectionReceived:
+		if t.AccountDestinationID != filter.AccountID {
+			return false
+		}
+	default:
+		if t.AccountOriginID != filter.AccountID && t.AccountDestinationID != filter.AccountID {
+			return false
+		}
+	}
+
+	switch {
+	case !filter.From.IsZero() && t.CreatedAt.Before(filter.From):
+		return false
+	case !filter.To.IsZero() && !t.CreatedAt.Before(filter.To):
+		return false
+	case filter.MinAmount.Valid && t.Amount.LessThan(filter.MinAmount.Decimal):
+		return false
+	case filter.MaxAmount.Valid && t.Amount.GreaterThan(filter.MaxAmount.Decimal):
+		return false
+	case filter.After != nil && (t.ID == filter.After.ID || transferBefore(t, filter.After.CreatedAt, filter.After.ID)):
+		return false
+	}
+	return true
+}
+
+// transferBefore reports whether t comes before the position given by
+// createdAt and id in a listing ordered from the newest to the oldest transfer.
+func transferBefore(t *Transfer, createdAt time.Time, id int64) bool {
+	if t.CreatedAt.Equal(createdAt) {
+		return t.ID > id
+	}
+	return t.CreatedAt.After(createdAt)
+}
+
+func (i *inmemDB) CreateCashMovement(ctx context.Context, movement *CashMovement) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if err := prepareCashMovement(movement); err != nil {
+		return err
+	}
+	account, ok := i.accounts[movement.AccountID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	amount := movement.Amount
+	if movement.Type == CashMovementWithdrawal {
+		if err := checkDebit(account, false); err != nil {
+			return err
+		}
+		if availableFunds(account, movement.Currency, i.balance(account, movement.Currency)).LessThan(movement.Amount) {
+			return ErrNotEnoughFunds
+		}
+		if err := i.checkTransferLimits(account.ID, movement.Currency, movement.Amount, i.now()); err != nil {
+			return err
+		}
+		amount = amount.Neg()
+	} else if err := checkCredit(account, false); err != nil {
+		return err
+	}
+
+	movement.ID = int64(len(i.movements) + 1)
+	movement.CreatedAt = i.now()
+	i.addBalance(account, movement.Currency, amount)
+	i.movements = append(i.movements, movement)
+	i.addLedgerEntry(&LedgerEntry{AccountID: account.ID, CashMovementID: movement.ID, Amount: amount, Currency: movement.Currency})
+
+	return nil
+}
+
+func (i *inmemDB) FindAllCashMovementsWithAccountID(ctx context.Context, accountID int64) ([]*CashMovement, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	var movements []*CashMovement
+	for n := len(i.movements) - 1; n >= 0; n-- {
+		if i.movements[n].AccountID == accountID {
+			movements = append(movements, i.movements[n])
+		}
+	}
+
+	return movements, nil
+}
+
+func (i *inmemDB) FindAllLedgerEntriesWithAccountID(ctx context.Context, accountID int64) ([]*LedgerEntry, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	var entries []*LedgerEntry
+	for _, e := range i.entries {
+		if e.AccountID == accountID {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, nil
+}
+
+func (i *inmemDB) ComputeLedgerBalance(ctx context.Context, accountID int64, c money.Currency) (decimal.Decimal, error) {
+	if err := i.lock(ctx); err != nil {
+		return decimal.Zero, err
+	}
+	defer i.unlock()
+
+	if _, ok := i.accounts[accountID]; !ok {
+		return decimal.Zero, ErrAccountNotFound
+	}
+
+	balance := decimal.Zero
+	for _, e := range i.entries {
+		if e.AccountID == accountID && e.Currency == c {
+			balance = balance.Add(e.Amount)
+		}
+	}
+
+	return balance, nil
+}
+
+// lock acquires exclusive access to the database, giving up if ctx is done
+// before the access is acquired.
+func (i *inmemDB) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case i.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// unlock releases the access acquired by lock.
+func (i *inmemDB) unlock() {
+	<-i.sem
+}
+
+// addLedgerEntry appends an entry into the ledger. Must be called with the
+// database locked.
+func (i *inmemDB) addLedgerEntry(entry *LedgerEntry) {
+	entry.ID = int64(len(i.entries) + 1)
+	entry.CreatedAt = i.now()
+	i.entries = append(i.entries, entry)
+}
+
+func (i *inmemDB) CreateSession(ctx context.Context, session *Session) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	session.ID = int64(len(i.sessions) + 1)
+	session.CreatedAt = i.now()
+	i.sessions = append(i.sessions, session)
+	return nil
+}
+
+func (i *inmemDB) FindSessionByTokenID(ctx context.Context, tokenID string) (*Session, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	for _, s := range i.sessions {
+		if s.TokenID == tokenID && s.RevokedAt.IsZero() {
+			return s, nil
+		}
+	}
+
+	return nil, ErrSessionNotFound
+}
+
+func (i *inmemDB) RefreshSession(ctx context.Context, refreshTokenHash string, refreshed *Session) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	for _, s := range i.sessions {
+		if !s.RevokedAt.IsZero() {
+			continue
+		}
+
+		switch {
+		case refreshTokenHash == s.RefreshTokenHash:
+			if !s.ExpiresAt.After(i.now()) {
+				return ErrSessionNotFound
+			}
+			s.PreviousRefreshTokenHash = s.RefreshTokenHash
+			s.TokenID = refreshed.TokenID
+			s.RefreshTokenHash = refreshed.RefreshTokenHash
+			s.ExpiresAt = refreshed.ExpiresAt
+			*refreshed = *s
+			return nil
+		case refreshTokenHash == s.PreviousRefreshTokenHash && s.PreviousRefreshTokenHash != "":
+			s.RevokedAt = i.now()
+			return ErrRefreshTokenReused
+		}
+	}
+
+	return ErrSessionNotFound
+}
+
+func (i *inmemDB) RevokeSession(ctx context.Context, id int64) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	for _, s := range i.sessions {
+		if s.ID == id {
+			if s.RevokedAt.IsZero() {
+				s.RevokedAt = i.now()
+			}
+			return nil
+		}
+	}
+
+	return ErrSessionNotFound
+}
+
+func (i *inmemDB) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if _, ok := i.accounts[key.AccountID]; !ok {
+		return ErrAccountNotFound
+	}
+
+	key.ID = int64(len(i.apiKeys) + 1)
+	key.CreatedAt = i.now()
+	i.apiKeys = append(i.apiKeys, key)
+	return nil
+}
+
+func (i *inmemDB) FindAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	for _, k := range i.apiKeys {
+		if k.Hash == hash && k.RevokedAt.IsZero() {
+			return k, nil
+		}
+	}
+
+	return nil, ErrAPIKeyNotFound
+}
+
+func (i *inmemDB) FindAllAPIKeysWithAccountID(ctx context.Context, accountID int64) ([]*APIKey, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	var keys []*APIKey
+	for n := len(i.apiKeys) - 1; n >= 0; n-- {
+		if i.apiKeys[n].AccountID == accountID && i.apiKeys[n].RevokedAt.IsZero() {
+			keys = append(keys, i.apiKeys[n])
+		}
+	}
+
+	return keys, nil
+}
+
+func (i *inmemDB) RevokeAPIKey(ctx context.Context, accountID, id int64) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	for _, k := range i.apiKeys {
+		if k.ID == id && k.AccountID == accountID && k.RevokedAt.IsZero() {
+			k.RevokedAt = i.now()
+			return nil
+		}
+	}
+
+	return ErrAPIKeyNotFound
+}
+
+func (i *inmemDB) CreateAuditEvent(ctx context.Context, event *AuditEvent) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	if _, ok := i.accounts[event.AccountID]; !ok {
+		return ErrAccountNotFound
+	}
+
+	event.ID = int64(len(i.audit) + 1)
+	event.CreatedAt = i.now()
+	i.audit = append(i.audit, event)
+	return nil
+}
+
+func (i *inmemDB) FindAllAuditEventsWithAccountID(ctx context.Context, accountID int64) ([]*AuditEvent, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	var events []*AuditEvent
+	for n := len(i.audit) - 1; n >= 0; n-- {
+		if i.audit[n].AccountID == accountID {
+			events = append(events, i.audit[n])
+		}
+	}
+
+	return events, nil
+}
+
+func (i *inmemDB) FindLoginThrottle(ctx context.Context, key string) (*LoginThrottle, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	throttle, ok := i.throttles[key]
+	if !ok {
+		return nil, ErrLoginThrottleNotFound
+	}
+
+	return throttle, nil
+}
+
+func (i *inmemDB) ReserveLoginAttempt(ctx context.Context, key string, at time.Time, window time.Duration, lockout func(failures int) time.Duration) (*LoginThrottle, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	previous := &LoginThrottle{Key: key}
+	if throttle, ok := i.throttles[key]; ok && !throttle.LastFailureAt.Before(at.Add(-window)) {
+		previous = &LoginThrottle{Key: key, Failures: throttle.Failures, LastFailureAt: throttle.LastFailureAt}
+	}
+	if previous.LastFailureAt.Add(lockout(previous.Failures)).After(at) {
+		return previous, ErrLoginLocked
+	}
+	i.throttles[key] = &LoginThrottle{Key: key, Failures: previous.Failures + 1, LastFailureAt: at}
+
+	return previous, nil
+}
+
+func (i *inmemDB) ReleaseLoginAttempt(ctx context.Context, key string, at time.Time, previous *LoginThrottle) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	throttle, ok := i.throttles[key]
+	if !ok {
+		return nil
+	}
+	if throttle.Failures <= 1 {
+		delete(i.throttles, key)
+		return nil
+	}
+	released := &LoginThrottle{Key: key, Failures: throttle.Failures - 1, LastFailureAt: throttle.LastFailureAt}
+	if released.LastFailureAt.Equal(at) {
+		released.LastFailureAt = previous.LastFailureAt
+	}
+	i.throttles[key] = released
+
+	return nil
+}
+
+func (i *inmemDB) DeleteLoginThrottle(ctx context.Context, key string) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	delete(i.throttles, key)
+	return nil
+}
+
+func (i *inmemDB) CreateIdempotencyKey(ctx context.Context, key *IdempotencyKey) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	now := i.now()
+	id := idempotencyKeyID{accountID: key.AccountID, key: key.Key}
+	if k, ok := i.keys[id]; ok && !k.expired(now) {
+		return ErrIdempotencyKeyAlreadyExists
+	}
+
+	key.CreatedAt = now
+	i.keys[id] = key
+	return nil
+}
+
+func (i *inmemDB) FindIdempotencyKey(ctx context.Context, accountID int64, key string) (*IdempotencyKey, error) {
+	if err := i.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer i.unlock()
+
+	k, ok := i.keys[idempotencyKeyID{accountID: accountID, key: key}]
+	if !ok {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+
+	return k, nil
+}
+
+func (i *inmemDB) UpdateIdempotencyKey(ctx context.Context, key *IdempotencyKey) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	id := idempotencyKeyID{accountID: key.AccountID, key: key.Key}
+	if _, ok := i.keys[id]; !ok {
+		return ErrIdempotencyKeyNotFound
+	}
+
+	i.keys[id] = key
+	return nil
+}
+
+func (i *inmemDB) DeleteIdempotencyKey(ctx context.Context, accountID int64, key string) error {
+	if err := i.lock(ctx); err != nil {
+		return err
+	}
+	defer i.unlock()
+
+	delete(i.keys, idempotencyKeyID{accountID: accountID, key: key})
+	return nil
+}
+
+func (i *inmemDB) DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error) {
+	if err := i.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer i.unlock()
+
+	now := i.now()
+	var deleted int
+	for id, k := range i.keys {
+		if k.expired(now) {
+			delete(i.keys, id)
+			deleted++
+		}
+	}
+	return deleted, nil
 }
@@ -1,7 +1,146 @@
 package database
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
 
 func TestInMemDB(t *testing.T) {
 	runDBTests(t, NewInMemDB())
 }
+
+func TestInMemDBCancellation(t *testing.T) {
+	db := NewInMemDB().(*inmemDB)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := db.FindAllAccounts(ctx)
+	require.Equal(t, context.Canceled, err)
+
+	// a query waiting for the lock gives up when its context is done
+	require.NoError(t, db.lock(context.Background()))
+	defer db.unlock()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = db.FindAllAccounts(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestInMemDBTransferLimits(t *testing.T) {
+	ctx := context.Background()
+	// 19h in Brasília, an hour before the nighttime limit starts
+	now := time.Date(2021, 1, 4, 22, 0, 0, 0, time.UTC)
+	db := NewInMemDB(WithNowFunc(func() time.Time { return now }))
+
+	sender := &Account{Name: "first account", CPF: "111.111.111-11", Secret: "secret"}
+	require.NoError(t, db.CreateAccount(ctx, sender))
+	receiver := &Account{Name: "second account", CPF: "222.222.222-22", Secret: "secret"}
+	require.NoError(t, db.CreateAccount(ctx, receiver))
+	deposit := &CashMovement{AccountID: sender.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(20_000)}
+	require.NoError(t, db.CreateCashMovement(ctx, deposit))
+
+	transfer := func(amount int64) error {
+		return db.CreateTransfer(ctx, &Transfer{AccountOriginID: sender.ID, AccountDestinationID: receiver.ID, Amount: decimal.NewFromInt(amount)})
+	}
+
+	require.Equal(t, ErrLimitExceeded, transfer(5_001))
+	require.NoError(t, transfer(5_000))
+	require.NoError(t, transfer(800))
+
+	// transfers made before the night do not count towards the nighttime limit
+	now = now.Add(time.Hour)
+	require.NoError(t, transfer(1_000))
+	require.Equal(t, ErrLimitExceeded, transfer(1))
+
+	// the night continues into the next day
+	now = now.Add(4 * time.Hour)
+	require.Equal(t, ErrLimitExceeded, transfer(1))
+
+	// while the daily limit starts over
+	now = now.Add(6 * time.Hour)
+	require.NoError(t, transfer(5_000))
+
+	// a newer request replaces the pending increase
+	first := &TransferLimit{AccountID: sender.ID, Kind: LimitDaily, Amount: decimal.NewFromInt(20_000)}
+	require.NoError(t, db.RequestTransferLimitChange(ctx, first))
+	now = now.Add(time.Hour)
+	second := &TransferLimit{AccountID: sender.ID, Kind: LimitDaily, Amount: decimal.NewFromInt(15_000)}
+	require.NoError(t, db.RequestTransferLimitChange(ctx, second))
+
+	now = now.Add(TransferLimitCoolingOff - time.Hour)
+	limits, pending, err := db.FindTransferLimits(ctx, sender.ID)
+	require.NoError(t, err)
+	require.True(t, limits[1].Amount.Equal(decimal.NewFromInt(10_000)))
+	require.Equal(t, []*TransferLimit{second}, pending)
+
+	now = now.Add(time.Hour)
+	limits, pending, err = db.FindTransferLimits(ctx, sender.ID)
+	require.NoError(t, err)
+	require.Equal(t, second, limits[1])
+	require.Empty(t, pending)
+}
+
+func TestInMemDBDefaultTransferLimits(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemDB(WithDefaultTransferLimits(map[TransferLimitKind]decimal.Decimal{
+		LimitPerTransaction: decimal.NewFromInt(100),
+	}))
+
+	sender := &Account{Name: "first account", CPF: "111.111.111-11", Secret: "secret"}
+	require.NoError(t, db.CreateAccount(ctx, sender))
+	receiver := &Account{Name: "second account", CPF: "222.222.222-22", Secret: "secret"}
+	require.NoError(t, db.CreateAccount(ctx, receiver))
+	deposit := &CashMovement{AccountID: sender.ID, Type: CashMovementDeposit, Amount: decimal.NewFromInt(1_000)}
+	require.NoError(t, db.CreateCashMovement(ctx, deposit))
+
+	// the other limits keep their defaults
+	limits, _, err := db.FindTransferLimits(ctx, sender.ID)
+	require.NoError(t, err)
+	require.True(t, limits[0].Amount.Equal(decimal.NewFromInt(100)))
+	require.True(t, limits[1].Amount.Equal(decimal.NewFromInt(10_000)))
+
+	transfer := &Transfer{AccountOriginID: sender.ID, AccountDestinationID: receiver.ID, Amount: decimal.NewFromInt(101)}
+	require.Equal(t, ErrLimitExceeded, db.CreateTransfer(ctx, transfer))
+}
+
+func TestInMemDBIdempotencyKeyExpiry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 1, 4, 12, 0, 0, 0, time.UTC)
+	db := NewInMemDB(WithNowFunc(func() time.Time { return now }))
+
+	account := &Account{Name: "account", CPF: "111.111.111-11", Secret: "secret"}
+	require.NoError(t, db.CreateAccount(ctx, account))
+
+	abandoned := &IdempotencyKey{AccountID: account.ID, Key: "abandoned", Fingerprint: "fingerprint"}
+	require.NoError(t, db.CreateIdempotencyKey(ctx, abandoned))
+	finished := &IdempotencyKey{AccountID: account.ID, Key: "finished", Fingerprint: "fingerprint"}
+	require.NoError(t, db.CreateIdempotencyKey(ctx, finished))
+	finished.StatusCode = 201
+	require.NoError(t, db.UpdateIdempotencyKey(ctx, finished))
+
+	// keys in progress are taken over after the lock timeout
+	now = now.Add(IdempotencyKeyLockTimeout - time.Second)
+	require.Equal(t, ErrIdempotencyKeyAlreadyExists, db.CreateIdempotencyKey(ctx, &IdempotencyKey{AccountID: account.ID, Key: "abandoned", Fingerprint: "other"}))
+	now = now.Add(time.Second)
+	require.NoError(t, db.CreateIdempotencyKey(ctx, &IdempotencyKey{AccountID: account.ID, Key: "abandoned", Fingerprint: "other"}))
+	require.Equal(t, ErrIdempotencyKeyAlreadyExists, db.CreateIdempotencyKey(ctx, &IdempotencyKey{AccountID: account.ID, Key: "finished", Fingerprint: "other"}))
+
+	// finished keys are deleted after the retention
+	deleted, err := db.DeleteExpiredIdempotencyKeys(ctx)
+	require.NoError(t, err)
+	require.Zero(t, deleted)
+
+	now = now.Add(IdempotencyKeyRetention)
+	deleted, err = db.DeleteExpiredIdempotencyKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+	_, err = db.FindIdempotencyKey(ctx, account.ID, "finished")
+	require.Equal(t, ErrIdempotencyKeyNotFound, err)
+}
@@ -0,0 +1,26 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				ALTER TABLE accounts
+					ADD COLUMN type text NOT NULL DEFAULT 'individual',
+					ADD COLUMN cnpj text,
+					ALTER COLUMN cpf DROP NOT NULL,
+					ADD CONSTRAINT accounts_cnpj_check CHECK (cnpj ~ '^\d{2}\.\d{3}\.\d{3}/\d{4}-\d{2}$'),
+					ADD CONSTRAINT accounts_type_check CHECK (
+						(type = 'individual' AND cpf IS NOT NULL AND cnpj IS NULL) OR
+						(type = 'business' AND cnpj IS NOT NULL AND cpf IS NULL)
+					);
+
+				-- CPFs and CNPJs have different masks, so they never collide
+				CREATE UNIQUE INDEX idx_accounts_document ON accounts((coalesce(cpf, cnpj)));
+				DROP INDEX idx_accounts_cpf;
+			`,
+		)
+		return err
+	})
+}
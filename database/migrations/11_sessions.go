@@ -0,0 +1,28 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				CREATE TABLE IF NOT EXISTS sessions (
+					id bigserial PRIMARY KEY,
+					account_id bigint NOT NULL REFERENCES accounts,
+					token_id text NOT NULL,
+					refresh_token_hash text NOT NULL,
+					previous_refresh_token_hash text,
+					expires_at timestamptz NOT NULL,
+					revoked_at timestamptz,
+					created_at timestamptz NOT NULL DEFAULT now()
+				);
+
+				CREATE UNIQUE INDEX idx_sessions_token_id ON sessions(token_id);
+				CREATE UNIQUE INDEX idx_sessions_refresh_token_hash ON sessions(refresh_token_hash);
+				CREATE INDEX idx_sessions_previous_refresh_token_hash ON sessions(previous_refresh_token_hash);
+				CREATE INDEX idx_sessions_account_id ON sessions(account_id);
+			`,
+		)
+		return err
+	})
+}
@@ -0,0 +1,18 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				CREATE TABLE IF NOT EXISTS login_throttles (
+					key text PRIMARY KEY,
+					failures integer NOT NULL,
+					last_failure_at timestamptz NOT NULL
+				);
+			`,
+		)
+		return err
+	})
+}
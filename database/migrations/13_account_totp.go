@@ -0,0 +1,18 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				ALTER TABLE accounts
+					ADD COLUMN totp_secret text,
+					ADD COLUMN totp_enabled boolean NOT NULL DEFAULT false,
+					ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0,
+					ADD COLUMN totp_recovery_codes text[];
+			`,
+		)
+		return err
+	})
+}
@@ -0,0 +1,26 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				CREATE TABLE IF NOT EXISTS api_keys (
+					id bigserial PRIMARY KEY,
+					account_id bigint NOT NULL REFERENCES accounts,
+					name text NOT NULL,
+					prefix text NOT NULL,
+					hash text NOT NULL,
+					scopes text[] NOT NULL,
+					revoked_at timestamptz,
+					created_at timestamptz NOT NULL DEFAULT now()
+				);
+
+				CREATE UNIQUE INDEX idx_api_keys_hash ON api_keys(hash);
+				CREATE INDEX idx_api_keys_account_id ON api_keys(account_id);
+			`,
+		)
+		return err
+	})
+}
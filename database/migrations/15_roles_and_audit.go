@@ -0,0 +1,29 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				ALTER TABLE accounts
+					DROP CONSTRAINT accounts_role_check,
+					ADD CONSTRAINT accounts_role_check CHECK (role IN ('customer', 'operator', 'support', 'admin')),
+					ADD COLUMN status text NOT NULL DEFAULT 'active',
+					ADD CONSTRAINT accounts_status_check CHECK (status IN ('active', 'frozen'));
+
+				CREATE TABLE IF NOT EXISTS audit_events (
+					id bigserial PRIMARY KEY,
+					account_id bigint NOT NULL REFERENCES accounts,
+					actor_id bigint NOT NULL REFERENCES accounts,
+					action text NOT NULL,
+					details text,
+					created_at timestamptz NOT NULL DEFAULT now()
+				);
+
+				CREATE INDEX idx_audit_events_account_id ON audit_events(account_id);
+			`,
+		)
+		return err
+	})
+}
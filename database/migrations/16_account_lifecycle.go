@@ -0,0 +1,16 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				ALTER TABLE accounts
+					DROP CONSTRAINT accounts_status_check,
+					ADD CONSTRAINT accounts_status_check CHECK (status IN ('active', 'frozen', 'blocked', 'closed'));
+			`,
+		)
+		return err
+	})
+}
@@ -0,0 +1,29 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		// the constraints are NOT VALID, so they only apply to new rows and
+		// older rows breaking them do not prevent the migration. The 2 decimal
+		// places hold for every currency later added by the multi-currency
+		// migration as well, see the places of the money package; adding a
+		// currency with other places requires a migration replacing these
+		// constraints with ones derived from the currency column.
+		_, err := db.Exec(
+			`
+				ALTER TABLE transfers
+					ADD CONSTRAINT transfers_amount_check CHECK (amount > 0 AND amount = round(amount, 2)) NOT VALID,
+					ADD CONSTRAINT transfers_accounts_check CHECK (account_origin_id <> account_destination_id) NOT VALID;
+
+				ALTER TABLE scheduled_transfers
+					ADD CONSTRAINT scheduled_transfers_amount_precision_check CHECK (amount = round(amount, 2)) NOT VALID,
+					ADD CONSTRAINT scheduled_transfers_accounts_check CHECK (account_origin_id <> account_destination_id) NOT VALID;
+
+				ALTER TABLE cash_movements
+					ADD CONSTRAINT cash_movements_amount_precision_check CHECK (amount = round(amount, 2)) NOT VALID;
+			`,
+		)
+		return err
+	})
+}
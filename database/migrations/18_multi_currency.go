@@ -0,0 +1,44 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		// balances in the default currency stay in the accounts table, and
+		// existing transfers, movements and entries are all in that currency
+		_, err := db.Exec(
+			`
+				CREATE TABLE IF NOT EXISTS wallets (
+					account_id bigint NOT NULL REFERENCES accounts,
+					currency text NOT NULL,
+					balance numeric NOT NULL DEFAULT 0,
+					PRIMARY KEY (account_id, currency)
+				);
+
+				CREATE TABLE IF NOT EXISTS exchange_rates (
+					base text NOT NULL,
+					quote text NOT NULL,
+					rate numeric NOT NULL CHECK (rate > 0),
+					updated_at timestamptz NOT NULL DEFAULT now(),
+					PRIMARY KEY (base, quote),
+					CHECK (base <> quote)
+				);
+
+				ALTER TABLE transfers
+					ADD COLUMN currency text NOT NULL DEFAULT 'BRL',
+					ADD COLUMN destination_amount numeric,
+					ADD COLUMN destination_currency text NOT NULL DEFAULT 'BRL',
+					ADD COLUMN exchange_rate numeric NOT NULL DEFAULT 1;
+
+				UPDATE transfers SET destination_amount = amount;
+
+				ALTER TABLE transfers ALTER COLUMN destination_amount SET NOT NULL;
+
+				ALTER TABLE cash_movements ADD COLUMN currency text NOT NULL DEFAULT 'BRL';
+
+				ALTER TABLE ledger_entries ADD COLUMN currency text NOT NULL DEFAULT 'BRL';
+			`,
+		)
+		return err
+	})
+}
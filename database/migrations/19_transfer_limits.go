@@ -0,0 +1,25 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		// accounts without rows in transfer_limits use the default limits, so
+		// there is nothing to backfill
+		_, err := db.Exec(
+			`
+				CREATE TABLE IF NOT EXISTS transfer_limits (
+					id bigserial PRIMARY KEY,
+					account_id bigint NOT NULL REFERENCES accounts,
+					kind text NOT NULL,
+					amount numeric NOT NULL CHECK (amount > 0 AND amount = round(amount, 2)),
+					effective_at timestamptz NOT NULL,
+					created_at timestamptz NOT NULL DEFAULT now()
+				);
+
+				CREATE INDEX idx_transfer_limits_account_id ON transfer_limits(account_id, id);
+			`,
+		)
+		return err
+	})
+}
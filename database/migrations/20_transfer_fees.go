@@ -0,0 +1,26 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		// transfers made before fee schedules existed were free of charge
+		_, err := db.Exec(
+			`
+				CREATE TABLE IF NOT EXISTS fee_schedules (
+					transfer_type text PRIMARY KEY,
+					type text NOT NULL,
+					amount numeric NOT NULL DEFAULT 0 CHECK (amount >= 0),
+					rate numeric NOT NULL DEFAULT 0 CHECK (rate >= 0 AND rate <= 1),
+					tiers jsonb,
+					free_monthly_quota integer NOT NULL DEFAULT 0 CHECK (free_monthly_quota >= 0),
+					revenue_account_id bigint NOT NULL REFERENCES accounts,
+					updated_at timestamptz NOT NULL DEFAULT now()
+				);
+
+				ALTER TABLE transfers ADD COLUMN fee numeric NOT NULL DEFAULT 0 CHECK (fee >= 0);
+			`,
+		)
+		return err
+	})
+}
@@ -0,0 +1,33 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		// existing accounts have no credit line, so their balances stay
+		// non-negative until one is granted
+		_, err := db.Exec(
+			`
+				ALTER TABLE accounts
+					ADD COLUMN credit_limit numeric NOT NULL DEFAULT 0 CHECK (credit_limit >= 0),
+					ADD COLUMN overdraft_rate numeric NOT NULL DEFAULT 0 CHECK (overdraft_rate >= 0);
+
+				ALTER TABLE cash_movements
+					DROP CONSTRAINT cash_movements_type_check,
+					ADD CONSTRAINT cash_movements_type_check CHECK (type IN ('deposit', 'withdrawal', 'interest'));
+
+				CREATE TABLE IF NOT EXISTS interest_accruals (
+					account_id bigint NOT NULL REFERENCES accounts,
+					day timestamptz NOT NULL,
+					balance numeric NOT NULL CHECK (balance < 0),
+					rate numeric NOT NULL,
+					amount numeric NOT NULL CHECK (amount > 0),
+					cash_movement_id bigint NOT NULL REFERENCES cash_movements,
+					created_at timestamptz NOT NULL DEFAULT now(),
+					PRIMARY KEY (account_id, day)
+				);
+			`,
+		)
+		return err
+	})
+}
@@ -0,0 +1,23 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				CREATE TABLE IF NOT EXISTS idempotency_keys (
+					account_id bigint NOT NULL REFERENCES accounts,
+					key text NOT NULL,
+					fingerprint text NOT NULL,
+					status_code integer NOT NULL DEFAULT 0,
+					response bytea,
+					created_at timestamptz NOT NULL DEFAULT now(),
+					PRIMARY KEY (account_id, key),
+					CHECK (length(key) > 0)
+				);
+			`,
+		)
+		return err
+	})
+}
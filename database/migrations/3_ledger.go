@@ -0,0 +1,50 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				CREATE TABLE IF NOT EXISTS ledger_entries (
+					id bigserial PRIMARY KEY,
+					account_id bigint NOT NULL REFERENCES accounts,
+					transfer_id bigint REFERENCES transfers,
+					amount numeric NOT NULL,
+					created_at timestamptz NOT NULL DEFAULT now()
+				);
+
+				CREATE INDEX idx_ledger_entries_account_id ON ledger_entries(account_id);
+				CREATE INDEX idx_ledger_entries_transfer_id ON ledger_entries(transfer_id);
+
+				-- the ledger is append-only: entries are never changed or removed
+				CREATE FUNCTION reject_ledger_entry_changes() RETURNS trigger AS $$
+				BEGIN
+					RAISE EXCEPTION 'ledger entries are immutable';
+				END;
+				$$ LANGUAGE plpgsql;
+
+				CREATE TRIGGER trg_ledger_entries_immutable
+					BEFORE UPDATE OR DELETE ON ledger_entries
+					FOR EACH ROW EXECUTE FUNCTION reject_ledger_entry_changes();
+
+				-- backfill the entries of existing transfers
+				INSERT INTO ledger_entries (account_id, transfer_id, amount, created_at)
+				SELECT account_origin_id, id, -amount, created_at FROM transfers
+				UNION ALL
+				SELECT account_destination_id, id, amount, created_at FROM transfers
+				ORDER BY 2, 3;
+
+				-- record the difference between the current balances and the
+				-- transfers as the opening balance of existing accounts
+				INSERT INTO ledger_entries (account_id, amount, created_at)
+				SELECT account.id, account.balance - coalesce(sum(entry.amount), 0), account.created_at
+				FROM accounts AS account
+				LEFT JOIN ledger_entries AS entry ON entry.account_id = account.id
+				GROUP BY account.id
+				HAVING account.balance - coalesce(sum(entry.amount), 0) <> 0;
+			`,
+		)
+		return err
+	})
+}
@@ -0,0 +1,18 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				CREATE INDEX idx_transfers_origin_created_at
+					ON transfers(account_origin_id, created_at DESC, id DESC);
+
+				CREATE INDEX idx_transfers_destination_created_at
+					ON transfers(account_destination_id, created_at DESC, id DESC);
+			`,
+		)
+		return err
+	})
+}
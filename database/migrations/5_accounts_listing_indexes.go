@@ -0,0 +1,16 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				CREATE INDEX idx_accounts_created_at ON accounts(created_at, id);
+				CREATE INDEX idx_accounts_name ON accounts(name, id);
+				CREATE INDEX idx_accounts_name_prefix ON accounts(lower(name) text_pattern_ops);
+			`,
+		)
+		return err
+	})
+}
@@ -0,0 +1,32 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				ALTER TABLE accounts
+					ADD COLUMN role text NOT NULL DEFAULT 'customer',
+					ADD CONSTRAINT accounts_role_check CHECK (role IN ('customer', 'operator'));
+
+				CREATE TABLE IF NOT EXISTS cash_movements (
+					id bigserial PRIMARY KEY,
+					account_id bigint NOT NULL REFERENCES accounts,
+					type text NOT NULL,
+					amount numeric NOT NULL,
+					operator_id bigint REFERENCES accounts,
+					created_at timestamptz NOT NULL DEFAULT now(),
+					CHECK (type IN ('deposit', 'withdrawal')),
+					CHECK (amount > 0)
+				);
+
+				CREATE INDEX idx_cash_movements_account_id ON cash_movements(account_id);
+
+				ALTER TABLE ledger_entries
+					ADD COLUMN cash_movement_id bigint REFERENCES cash_movements;
+			`,
+		)
+		return err
+	})
+}
@@ -0,0 +1,18 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				ALTER TABLE transfers
+					ADD COLUMN reversed_transfer_id bigint REFERENCES transfers,
+					ADD COLUMN reason text;
+
+				CREATE UNIQUE INDEX idx_transfers_reversed_transfer_id ON transfers(reversed_transfer_id);
+			`,
+		)
+		return err
+	})
+}
@@ -0,0 +1,45 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		_, err := db.Exec(
+			`
+				CREATE TABLE IF NOT EXISTS scheduled_transfers (
+					id bigserial PRIMARY KEY,
+					account_origin_id bigint NOT NULL REFERENCES accounts,
+					account_destination_id bigint NOT NULL REFERENCES accounts,
+					amount numeric NOT NULL,
+					"interval" text NOT NULL,
+					start_at timestamptz NOT NULL,
+					next_run_at timestamptz NOT NULL,
+					runs integer NOT NULL DEFAULT 0,
+					status text NOT NULL DEFAULT 'active',
+					created_at timestamptz NOT NULL DEFAULT now(),
+					CHECK ("interval" IN ('once', 'monthly')),
+					CHECK (status IN ('active', 'cancelled', 'completed')),
+					CHECK (amount > 0)
+				);
+
+				CREATE INDEX idx_scheduled_transfers_account_origin_id ON scheduled_transfers(account_origin_id);
+				CREATE INDEX idx_scheduled_transfers_due ON scheduled_transfers(next_run_at) WHERE status = 'active';
+
+				CREATE TABLE IF NOT EXISTS scheduled_transfer_executions (
+					id bigserial PRIMARY KEY,
+					scheduled_transfer_id bigint NOT NULL REFERENCES scheduled_transfers,
+					scheduled_for timestamptz NOT NULL,
+					status text NOT NULL,
+					transfer_id bigint REFERENCES transfers,
+					failure text,
+					created_at timestamptz NOT NULL DEFAULT now(),
+					CHECK (status IN ('pending', 'succeeded', 'failed'))
+				);
+
+				CREATE INDEX idx_scheduled_transfer_executions_scheduled_transfer_id
+					ON scheduled_transfer_executions(scheduled_transfer_id);
+			`,
+		)
+		return err
+	})
+}
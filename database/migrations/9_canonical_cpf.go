@@ -0,0 +1,44 @@
+package migrations
+
+import "github.com/go-pg/migrations/v8"
+
+func init() {
+	migrations.Register(func(db migrations.DB) error {
+		// accounts whose CPF cannot be normalized, because it has no masked
+		// CPF or normalizes to the CPF of another account, fail the migration
+		// instead of being left behind a constraint that every later update of
+		// theirs would break. Which of the colliding accounts keeps the CPF is
+		// not for the migration to decide, so they must be fixed by hand.
+		_, err := db.Exec(
+			`
+				-- older versions accepted anything around a masked CPF
+				UPDATE accounts a
+					SET cpf = substring(a.cpf from '\d{3}\.\d{3}\.\d{3}-\d{2}')
+					WHERE a.cpf !~ '^\d{3}\.\d{3}\.\d{3}-\d{2}$'
+						AND a.cpf ~ '\d{3}\.\d{3}\.\d{3}-\d{2}'
+						AND NOT EXISTS (
+							SELECT 1 FROM accounts b
+								WHERE b.id <> a.id
+									AND substring(b.cpf from '\d{3}\.\d{3}\.\d{3}-\d{2}') = substring(a.cpf from '\d{3}\.\d{3}\.\d{3}-\d{2}')
+						);
+
+				DO $$
+				DECLARE
+					ids text;
+				BEGIN
+					SELECT string_agg(id::text, ', ' ORDER BY id) INTO ids
+						FROM accounts
+						WHERE cpf !~ '^\d{3}\.\d{3}\.\d{3}-\d{2}$';
+					IF ids IS NOT NULL THEN
+						RAISE EXCEPTION 'the CPFs of accounts % cannot be normalized, since they have no masked CPF or collide with the CPF of another account; fix them by hand and run the migration again', ids;
+					END IF;
+				END
+				$$;
+
+				ALTER TABLE accounts
+					ADD CONSTRAINT accounts_cpf_check CHECK (cpf ~ '^\d{3}\.\d{3}\.\d{3}-\d{2}$');
+			`,
+		)
+		return err
+	})
+}
@@ -4,13 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/go-pg/migrations/v8"
 	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/shopspring/decimal"
 
 	_ "github.com/lindebergue/desafio-go-stone/database/migrations" // load migrations
+	"github.com/lindebergue/desafio-go-stone/document"
+	"github.com/lindebergue/desafio-go-stone/money"
 )
 
 // NewPostgresDB returns a DB instance backed by a Postgres database specified
@@ -21,13 +26,13 @@ import (
 // We use an exponential backoff for testing the connection in order to avoid
 // scenarios where the server is ready to accept connections but the
 // database still not up (like docker-compose environments).
-func NewPostgresDB(url string) (DB, error) {
-	opts, err := pg.ParseURL(url)
+func NewPostgresDB(url string, opts ...PostgresOption) (DB, error) {
+	pgOpts, err := pg.ParseURL(url)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing url: %w", err)
 	}
 
-	db := pg.Connect(opts)
+	db := pg.Connect(pgOpts)
 
 	b := backoff.NewExponentialBackOff()
 	b.InitialInterval = 100 * time.Millisecond
@@ -51,16 +56,37 @@ func NewPostgresDB(url string) (DB, error) {
 		return nil, fmt.Errorf("error migrating database: %w", err)
 	}
 
-	return &postgresDB{db: db}, nil
+	p := &postgresDB{db: db, defaultLimits: defaultTransferLimits}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p, nil
+}
+
+// PostgresOption represents an option passed to a Postgres database.
+type PostgresOption func(p *postgresDB)
+
+// WithPostgresDefaultTransferLimits changes the transfer limits of the
+// accounts that never changed them. Kinds missing from limits keep their
+// default amounts.
+func WithPostgresDefaultTransferLimits(limits map[TransferLimitKind]decimal.Decimal) PostgresOption {
+	return func(p *postgresDB) {
+		p.defaultLimits = transferLimitDefaults(limits)
+	}
 }
 
 type postgresDB struct {
-	db *pg.DB
+	db            *pg.DB
+	defaultLimits map[TransferLimitKind]decimal.Decimal
 }
 
-func (p *postgresDB) CreateAccount(account *Account) error {
-	_, err := p.db.Model(account).
-		Column("name", "cpf", "secret", "balance").
+func (p *postgresDB) CreateAccount(ctx context.Context, account *Account) error {
+	if err := prepareAccount(account); err != nil {
+		return err
+	}
+
+	_, err := p.db.ModelContext(ctx, account).
+		Column("name", "type", "cpf", "cnpj", "secret", "role").
 		Returning("*").
 		Insert()
 
@@ -70,78 +96,1551 @@ func (p *postgresDB) CreateAccount(account *Account) error {
 	return wrapPostgresError(err)
 }
 
-func (p *postgresDB) FindAccountByID(id int64) (*Account, error) {
+func (p *postgresDB) FindAccountByID(ctx context.Context, id int64) (*Account, error) {
 	account := &Account{}
-	err := p.db.Model(account).
+	err := p.db.ModelContext(ctx, account).
 		Where("account.id = ?", id).
 		Select()
 
 	return account, wrapPostgresError(err)
 }
 
-func (p *postgresDB) FindAccountByCPF(cpf string) (*Account, error) {
+func (p *postgresDB) FindAccountByDocument(ctx context.Context, doc string) (*Account, error) {
 	account := &Account{}
-	err := p.db.Model(account).
-		Where("account.cpf = ?", cpf).
+	err := p.db.ModelContext(ctx, account).
+		Where("coalesce(account.cpf, account.cnpj) = ?", document.Normalize(doc)).
 		Select()
 
 	return account, wrapPostgresError(err)
 }
 
-func (p *postgresDB) FindAllAccounts() ([]*Account, error) {
+func (p *postgresDB) SetAccountStatus(ctx context.Context, accountID int64, status AccountStatus) error {
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		accounts, err := lockAccounts(ctx, t, accountID)
+		if err != nil {
+			return err
+		}
+		account := accounts[accountID]
+		if !account.Status.CanTransitionTo(status) {
+			return ErrInvalidStatusTransition
+		}
+
+		account.Status = status
+		_, err = t.ModelContext(ctx, account).Column("status").WherePK().Update()
+		return err
+	})
+
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) SetAccountCreditLine(ctx context.Context, accountID int64, limit, rate decimal.Decimal) error {
+	if err := checkCreditLine(limit, rate); err != nil {
+		return err
+	}
+
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		accounts, err := lockAccounts(ctx, t, accountID)
+		if err != nil {
+			return err
+		}
+		account := accounts[accountID]
+		if account.Status == AccountClosed {
+			return ErrAccountClosed
+		}
+
+		account.CreditLimit = limit
+		account.OverdraftRate = rate
+		_, err = t.ModelContext(ctx, account).Column("credit_limit", "overdraft_rate").WherePK().Update()
+		return err
+	})
+
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) AccrueOverdraftInterest(ctx context.Context, now time.Time) ([]*InterestAccrual, error) {
+	day, _ := dayOf(now)
+
+	var accruals []*InterestAccrual
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		var ids []int64
+		err := t.ModelContext(ctx, (*Account)(nil)).
+			Column("account.id").
+			Where("account.balance < 0").
+			Where("account.overdraft_rate > 0").
+			Where("NOT EXISTS (SELECT 1 FROM interest_accruals WHERE account_id = account.id AND day = ?)", day).
+			Order("account.id ASC").
+			Select(&ids)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		accounts, err := lockAccounts(ctx, t, ids...)
+		if err != nil {
+			return err
+		}
+
+		// accruals made by concurrent callers are only visible after the
+		// accounts are locked
+		var charged []int64
+		err = t.ModelContext(ctx, (*InterestAccrual)(nil)).
+			Column("account_id").
+			Where("account_id IN (?)", pg.In(ids)).
+			Where("day = ?", day).
+			Select(&charged)
+		if err != nil {
+			return err
+		}
+		for _, id := range charged {
+			delete(accounts, id)
+		}
+
+		for _, id := range ids {
+			account, ok := accounts[id]
+			if !ok {
+				continue
+			}
+			interest := overdraftInterest(account)
+			if interest.IsZero() {
+				continue
+			}
+
+			accrual := &InterestAccrual{
+				AccountID: id,
+				Day:       day,
+				Balance:   account.Balance,
+				Rate:      account.OverdraftRate,
+				Amount:    interest,
+			}
+			if err := addToBalance(ctx, t, account, money.DefaultCurrency, interest.Neg()); err != nil {
+				return err
+			}
+			movement := &CashMovement{AccountID: id, Type: CashMovementInterest, Amount: interest, Currency: money.DefaultCurrency}
+			_, err = t.ModelContext(ctx, movement).
+				Column("account_id", "type", "amount", "currency").
+				Returning("*").
+				Insert()
+			if err != nil {
+				return err
+			}
+			err = insertLedgerEntries(ctx, t, &LedgerEntry{
+				AccountID:      id,
+				CashMovementID: movement.ID,
+				Amount:         interest.Neg(),
+				Currency:       money.DefaultCurrency,
+			})
+			if err != nil {
+				return err
+			}
+
+			accrual.CashMovementID = movement.ID
+			_, err = t.ModelContext(ctx, accrual).
+				Column("account_id", "day", "balance", "rate", "amount", "cash_movement_id").
+				Returning("*").
+				Insert()
+			if err != nil {
+				return err
+			}
+			accruals = append(accruals, accrual)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrapPostgresError(err)
+	}
+
+	return accruals, nil
+}
+
+func (p *postgresDB) CloseAccount(ctx context.Context, accountID, sweepAccountID int64) ([]*Transfer, error) {
+	var sweeps []*Transfer
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		ids := []int64{accountID}
+		if sweepAccountID != 0 && sweepAccountID != accountID {
+			ids = append(ids, sweepAccountID)
+		}
+		accounts, err := lockAccounts(ctx, t, ids...)
+		if err != nil {
+			return err
+		}
+		account := accounts[accountID]
+		if account.Status == AccountClosed {
+			return ErrAccountClosed
+		}
+
+		wallets, err := findWallets(ctx, t, account)
+		if err != nil {
+			return err
+		}
+		for _, wallet := range wallets {
+			if wallet.Balance.IsZero() {
+				continue
+			}
+			if wallet.Balance.IsNegative() || sweepAccountID == 0 || sweepAccountID == accountID {
+				return ErrAccountBalanceNotZero
+			}
+			sweep := &Transfer{
+				AccountOriginID:      accountID,
+				AccountDestinationID: sweepAccountID,
+				Amount:               wallet.Balance,
+				Currency:             wallet.Currency,
+				Reason:               "account closure",
+			}
+			if err := applyTransfer(ctx, t, sweep, false); err != nil {
+				return err
+			}
+			sweeps = append(sweeps, sweep)
+		}
+
+		account.Status = AccountClosed
+		if _, err := t.ModelContext(ctx, account).Column("status").WherePK().Update(); err != nil {
+			return err
+		}
+
+		_, err = t.ModelContext(ctx, (*Session)(nil)).
+			Set("revoked_at = now()").
+			Where("account_id = ?", accountID).
+			Where("revoked_at IS NULL").
+			Update()
+		if err != nil {
+			return err
+		}
+		_, err = t.ModelContext(ctx, (*APIKey)(nil)).
+			Set("revoked_at = now()").
+			Where("account_id = ?", accountID).
+			Where("revoked_at IS NULL").
+			Update()
+		if err != nil {
+			return err
+		}
+		_, err = t.ModelContext(ctx, (*ScheduledTransfer)(nil)).
+			Set("status = ?", ScheduleCancelled).
+			Where("account_origin_id = ?", accountID).
+			Where("status = ?", ScheduleActive).
+			Update()
+		return err
+	})
+	if err != nil {
+		return nil, wrapPostgresError(err)
+	}
+
+	return sweeps, nil
+}
+
+func (p *postgresDB) FindAllWalletsWithAccountID(ctx context.Context, accountID int64) ([]*Wallet, error) {
+	account, err := p.FindAccountByID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	wallets, err := findWallets(ctx, p.db, account)
+	return wallets, wrapPostgresError(err)
+}
+
+func (p *postgresDB) SetExchangeRate(ctx context.Context, rate *ExchangeRate) error {
+	if err := checkExchangeRate(rate); err != nil {
+		return err
+	}
+
+	_, err := p.db.ModelContext(ctx, rate).
+		Column("base", "quote", "rate").
+		OnConflict("(base, quote) DO UPDATE").
+		Set("rate = EXCLUDED.rate").
+		Set("updated_at = now()").
+		Returning("*").
+		Insert()
+
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) FindAllExchangeRates(ctx context.Context) ([]*ExchangeRate, error) {
+	var rates []*ExchangeRate
+	err := p.db.ModelContext(ctx, &rates).
+		Order("exchange_rate.base ASC", "exchange_rate.quote ASC").
+		Select()
+
+	return rates, wrapPostgresError(err)
+}
+
+func (p *postgresDB) SetFeeSchedule(ctx context.Context, schedule *FeeSchedule) error {
+	if err := checkFeeSchedule(schedule); err != nil {
+		return err
+	}
+	if _, err := p.FindAccountByID(ctx, schedule.RevenueAccountID); err != nil {
+		return err
+	}
+
+	_, err := p.db.ModelContext(ctx, schedule).
+		Column("transfer_type", "type", "amount", "rate", "tiers", "free_monthly_quota", "revenue_account_id").
+		OnConflict("(transfer_type) DO UPDATE").
+		Set("type = EXCLUDED.type").
+		Set("amount = EXCLUDED.amount").
+		Set("rate = EXCLUDED.rate").
+		Set("tiers = EXCLUDED.tiers").
+		Set("free_monthly_quota = EXCLUDED.free_monthly_quota").
+		Set("revenue_account_id = EXCLUDED.revenue_account_id").
+		Set("updated_at = now()").
+		Returning("*").
+		Insert()
+
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) FindAllFeeSchedules(ctx context.Context) ([]*FeeSchedule, error) {
+	var schedules []*FeeSchedule
+	err := p.db.ModelContext(ctx, &schedules).
+		Order("fee_schedule.transfer_type ASC").
+		Select()
+
+	return schedules, wrapPostgresError(err)
+}
+
+func (p *postgresDB) ChangeAccountSecret(ctx context.Context, accountID int64, secret string) error {
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		res, err := t.ModelContext(ctx, (*Account)(nil)).
+			Set("secret = ?", secret).
+			Where("id = ?", accountID).
+			Update()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return ErrAccountNotFound
+		}
+
+		_, err = t.ModelContext(ctx, (*Session)(nil)).
+			Set("revoked_at = now()").
+			Where("account_id = ?", accountID).
+			Where("revoked_at IS NULL").
+			Update()
+		return err
+	})
+
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) RehashAccountSecret(ctx context.Context, accountID int64, oldHash, newHash string) error {
+	_, err := p.db.ModelContext(ctx, (*Account)(nil)).
+		Set("secret = ?", newHash).
+		Where("id = ?", accountID).
+		Where("secret = ?", oldHash).
+		Update()
+
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) EnrollAccountTOTP(ctx context.Context, accountID int64, secret string, recoveryCodeHashes []string) error {
+	res, err := p.db.ModelContext(ctx, (*Account)(nil)).
+		Set("totp_secret = ?", secret).
+		Set("totp_last_step = 0").
+		Set("totp_recovery_codes = ?", pg.Array(recoveryCodeHashes)).
+		Where("id = ?", accountID).
+		Where("NOT totp_enabled").
+		Update()
+	if err != nil {
+		return wrapPostgresError(err)
+	}
+
+	if res.RowsAffected() == 0 {
+		// the account either does not exist or has TOTP enabled
+		if _, err := p.FindAccountByID(ctx, accountID); err != nil {
+			return err
+		}
+		return ErrTOTPAlreadyEnabled
+	}
+	return nil
+}
+
+func (p *postgresDB) EnableAccountTOTP(ctx context.Context, accountID, step int64) error {
+	res, err := p.db.ModelContext(ctx, (*Account)(nil)).
+		Set("totp_enabled = true").
+		Set("totp_last_step = ?", step).
+		Where("id = ?", accountID).
+		Where("totp_secret IS NOT NULL").
+		Where("NOT totp_enabled").
+		Update()
+	if err != nil {
+		return wrapPostgresError(err)
+	}
+
+	if res.RowsAffected() == 0 {
+		return ErrTOTPNotEnrolled
+	}
+	return nil
+}
+
+func (p *postgresDB) UseAccountTOTPStep(ctx context.Context, accountID, step int64) error {
+	// the comparison happens in the update itself, so concurrent requests
+	// cannot use the same code
+	res, err := p.db.ModelContext(ctx, (*Account)(nil)).
+		Set("totp_last_step = ?", step).
+		Where("id = ?", accountID).
+		Where("totp_enabled").
+		Where("totp_last_step < ?", step).
+		Update()
+	if err != nil {
+		return wrapPostgresError(err)
+	}
+
+	if res.RowsAffected() == 0 {
+		return ErrTOTPCodeReused
+	}
+	return nil
+}
+
+func (p *postgresDB) UseAccountRecoveryCode(ctx context.Context, accountID int64, hash string) error {
+	res, err := p.db.ModelContext(ctx, (*Account)(nil)).
+		Set("totp_recovery_codes = array_remove(totp_recovery_codes, ?)", hash).
+		Where("id = ?", accountID).
+		Where("totp_enabled").
+		Where("? = ANY(totp_recovery_codes)", hash).
+		Update()
+	if err != nil {
+		return wrapPostgresError(err)
+	}
+
+	if res.RowsAffected() == 0 {
+		return ErrRecoveryCodeNotFound
+	}
+	return nil
+}
+
+func (p *postgresDB) DisableAccountTOTP(ctx context.Context, accountID int64) error {
+	res, err := p.db.ModelContext(ctx, (*Account)(nil)).
+		Set("totp_secret = NULL").
+		Set("totp_enabled = false").
+		Set("totp_last_step = 0").
+		Set("totp_recovery_codes = NULL").
+		Where("id = ?", accountID).
+		Update()
+	if err != nil {
+		return wrapPostgresError(err)
+	}
+
+	if res.RowsAffected() == 0 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
+
+func (p *postgresDB) FindAllAccounts(ctx context.Context) ([]*Account, error) {
 	var accounts []*Account
-	err := p.db.Model(&accounts).
+	err := p.db.ModelContext(ctx, &accounts).
 		Order("account.created_at ASC").
 		Select()
 
 	return accounts, wrapPostgresError(err)
 }
 
-func (p *postgresDB) CreateTransfer(transfer *Transfer) error {
-	err := p.db.RunInTransaction(context.Background(), func(t *pg.Tx) error {
-		srcAccount := &Account{}
-		if err := t.Model(srcAccount).Where("account.id = ?", transfer.AccountOriginID).Select(); err != nil {
+func (p *postgresDB) FindAccounts(ctx context.Context, filter *AccountFilter) ([]*Account, error) {
+	var accounts []*Account
+	q := p.db.ModelContext(ctx, &accounts)
+
+	if filter.NamePrefix != "" {
+		q.Where("lower(account.name) LIKE ?", strings.ToLower(escapeLike(filter.NamePrefix))+"%")
+	}
+
+	column := "account.created_at"
+	if filter.Sort == AccountSortName {
+		column = "account.name"
+	}
+	direction, op := "ASC", ">"
+	if filter.Descending {
+		direction, op = "DESC", "<"
+	}
+
+	if filter.After != nil {
+		var value interface{} = filter.After.CreatedAt
+		if filter.Sort == AccountSortName {
+			value = filter.After.Name
+		}
+		q.Where(fmt.Sprintf("(%s, account.id) %s (?, ?)", column, op), value, filter.After.ID)
+	}
+	if filter.Limit > 0 {
+		q.Limit(filter.Limit)
+	}
+
+	err := q.Order(column+" "+direction, "account.id "+direction).Select()
+	return accounts, wrapPostgresError(err)
+}
+
+func (p *postgresDB) CreateTransfer(ctx context.Context, transfer *Transfer) error {
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		if err := applyTransfer(ctx, t, transfer, true); err != nil {
+			return err
+		}
+		if !limitedTransfer(transfer) {
+			return nil
+		}
+		return checkTransferLimits(ctx, t, transfer.AccountOriginID, transfer.Currency, transfer.Amount, transfer.CreatedAt, p.defaultLimits)
+	})
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) CreateReversal(ctx context.Context, reversal *Transfer) error {
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		// lock the original transfer so concurrent reversals of the same
+		// transfer are serialized
+		original := &Transfer{}
+		err := t.ModelContext(ctx, original).
+			Where("transfer.id = ?", reversal.ReversedTransferID).
+			For("UPDATE").
+			Select()
+		if errors.Is(err, pg.ErrNoRows) {
+			return ErrTransferNotFound
+		}
+		if err != nil {
 			return err
 		}
+		if original.ReversedTransferID != 0 {
+			return ErrTransferNotReversible
+		}
 
-		dstAccount := &Account{}
-		if err := t.Model(dstAccount).Where("account.id = ?", transfer.AccountDestinationID).Select(); err != nil {
+		reversed, err := t.ModelContext(ctx, (*Transfer)(nil)).
+			Where("transfer.reversed_transfer_id = ?", original.ID).
+			Exists()
+		if err != nil {
 			return err
 		}
+		if reversed {
+			return ErrTransferAlreadyReversed
+		}
 
-		if srcAccount.Balance.LessThan(transfer.Amount) {
-			return ErrNotEnoughFunds
+		if err := prepareReversal(reversal, original); err != nil {
+			return err
 		}
+		return applyTransfer(ctx, t, reversal, false)
+	})
+
+	if pgErr, ok := err.(pg.Error); ok && pgErr.Field('C') == "23505" {
+		return ErrTransferAlreadyReversed
+	}
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) FindTransferLimits(ctx context.Context, accountID int64) ([]*TransferLimit, []*TransferLimit, error) {
+	if _, err := p.FindAccountByID(ctx, accountID); err != nil {
+		return nil, nil, err
+	}
+
+	now, err := currentTime(ctx, p.db)
+	if err != nil {
+		return nil, nil, wrapPostgresError(err)
+	}
+	history, err := findTransferLimits(ctx, p.db, accountID)
+	if err != nil {
+		return nil, nil, wrapPostgresError(err)
+	}
+
+	current, pending := resolveTransferLimits(accountID, history, p.defaultLimits, now)
+	return current, pending, nil
+}
 
-		srcAccount.Balance = srcAccount.Balance.Sub(transfer.Amount)
-		dstAccount.Balance = dstAccount.Balance.Add(transfer.Amount)
+func (p *postgresDB) RequestTransferLimitChange(ctx context.Context, limit *TransferLimit) error {
+	if err := checkTransferLimit(limit); err != nil {
+		return err
+	}
 
-		if _, err := t.Model(srcAccount).WherePK().Update(); err != nil {
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		// lock the account so concurrent requests are applied in order
+		if _, err := lockAccounts(ctx, t, limit.AccountID); err != nil {
+			return err
+		}
+		now, err := currentTime(ctx, t)
+		if err != nil {
 			return err
 		}
-		if _, err := t.Model(dstAccount).WherePK().Update(); err != nil {
+		history, err := findTransferLimits(ctx, t, limit.AccountID)
+		if err != nil {
 			return err
 		}
 
-		_, err := t.Model(transfer).
-			Column("account_origin_id", "account_destination_id", "amount").
+		current, _ := resolveTransferLimits(limit.AccountID, history, p.defaultLimits, now)
+		limit.EffectiveAt = coolingOff(limitsByKind(current)[limit.Kind].Amount, limit.Amount, now)
+		limit.CreatedAt = now
+		_, err = t.ModelContext(ctx, limit).
+			Column("account_id", "kind", "amount", "effective_at", "created_at").
 			Returning("*").
 			Insert()
+		return err
+	})
+
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) CreateScheduledTransfer(ctx context.Context, scheduled *ScheduledTransfer) error {
+	if err := checkTransfer(scheduled.AccountOriginID, scheduled.AccountDestinationID, scheduled.Amount, money.DefaultCurrency); err != nil {
+		return err
+	}
+
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		// the accounts are locked so their status cannot change before the
+		// schedule is created
+		accounts, err := lockAccounts(ctx, t, scheduled.AccountOriginID, scheduled.AccountDestinationID)
+		if err != nil {
+			return err
+		}
+		if err := checkDebit(accounts[scheduled.AccountOriginID], false); err != nil {
+			return err
+		}
+		if err := checkCredit(accounts[scheduled.AccountDestinationID], false); err != nil {
+			return err
+		}
 
+		scheduled.NextRunAt = scheduled.StartAt
+		_, err = t.ModelContext(ctx, scheduled).
+			Column("account_origin_id", "account_destination_id", "amount", "interval", "start_at", "next_run_at").
+			Returning("*").
+			Insert()
 		return err
 	})
+
 	return wrapPostgresError(err)
 }
 
-func (p *postgresDB) FindAllTransfersWithAccountID(accountID int64) ([]*Transfer, error) {
-	var transfers []*Transfer
-	err := p.db.Model(&transfers).
-		Where("transfer.account_origin_id = ?", accountID).
-		WhereOr("transfer.account_destination_id = ?", accountID).
-		Order("transfer.created_at DESC").
+func (p *postgresDB) FindAllScheduledTransfersWithAccountID(ctx context.Context, accountID int64) ([]*ScheduledTransfer, error) {
+	var schedules []*ScheduledTransfer
+	err := p.db.ModelContext(ctx, &schedules).
+		Where("scheduled_transfer.account_origin_id = ?", accountID).
+		Order("scheduled_transfer.id DESC").
 		Select()
 
-	return transfers, wrapPostgresError(err)
+	return schedules, wrapPostgresError(err)
+}
+
+func (p *postgresDB) CancelScheduledTransfer(ctx context.Context, accountID, id int64) (*ScheduledTransfer, error) {
+	scheduled := &ScheduledTransfer{}
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		err := t.ModelContext(ctx, scheduled).
+			Where("scheduled_transfer.id = ?", id).
+			Where("scheduled_transfer.account_origin_id = ?", accountID).
+			For("UPDATE").
+			Select()
+		if errors.Is(err, pg.ErrNoRows) {
+			return ErrScheduledTransferNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if scheduled.Status != ScheduleActive {
+			return ErrScheduledTransferNotActive
+		}
+
+		scheduled.Status = ScheduleCancelled
+		_, err = t.ModelContext(ctx, scheduled).Column("status").WherePK().Update()
+		return err
+	})
+	if err != nil {
+		return nil, wrapPostgresError(err)
+	}
+
+	return scheduled, nil
+}
+
+func (p *postgresDB) ClaimDueScheduledTransfer(ctx context.Context, now time.Time) (*ScheduledTransfer, *ScheduledTransferExecution, error) {
+	due := &ScheduledTransfer{}
+	execution := &ScheduledTransferExecution{}
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		// skip the scheduled transfers being claimed by other servers
+		err := t.ModelContext(ctx, due).
+			Where("scheduled_transfer.status = ?", ScheduleActive).
+			Where("scheduled_transfer.next_run_at <= ?", now).
+			Order("scheduled_transfer.next_run_at ASC").
+			Limit(1).
+			For("UPDATE SKIP LOCKED").
+			Select()
+		if errors.Is(err, pg.ErrNoRows) {
+			return ErrScheduledTransferNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		execution.ScheduledTransferID = due.ID
+		execution.ScheduledFor = due.NextRunAt
+		execution.Status = ExecutionPending
+
+		due.advance()
+		if _, err := t.ModelContext(ctx, due).Column("next_run_at", "runs", "status").WherePK().Update(); err != nil {
+			return err
+		}
+
+		_, err = t.ModelContext(ctx, execution).
+			Column("scheduled_transfer_id", "scheduled_for", "status").
+			Returning("*").
+			Insert()
+		return err
+	})
+	if err != nil {
+		return nil, nil, wrapPostgresError(err)
+	}
+
+	return due, execution, nil
+}
+
+func (p *postgresDB) FinishScheduledTransferExecution(ctx context.Context, execution *ScheduledTransferExecution) error {
+	res, err := p.db.ModelContext(ctx, execution).
+		Column("status", "transfer_id", "failure").
+		WherePK().
+		Update()
+	if err != nil {
+		return wrapPostgresError(err)
+	}
+
+	if res.RowsAffected() == 0 {
+		return ErrScheduledTransferNotFound
+	}
+	return nil
+}
+
+func (p *postgresDB) FindAllScheduledTransferExecutions(ctx context.Context, scheduledTransferID int64) ([]*ScheduledTransferExecution, error) {
+	var executions []*ScheduledTransferExecution
+	err := p.db.ModelContext(ctx, &executions).
+		Where("scheduled_transfer_execution.scheduled_transfer_id = ?", scheduledTransferID).
+		Order("scheduled_transfer_execution.id DESC").
+		Select()
+
+	return executions, wrapPostgresError(err)
+}
+
+func (p *postgresDB) FindAllTransfersWithAccountID(ctx context.Context, accountID int64) ([]*Transfer, error) {
+	var transfers []*Transfer
+	err := p.db.ModelContext(ctx, &transfers).
+		Where("transfer.account_origin_id = ?", accountID).
+		WhereOr("transfer.account_destination_id = ?", accountID).
+		Order("transfer.created_at DESC").
+		Select()
+
+	return transfers, wrapPostgresError(err)
+}
+
+func (p *postgresDB) FindTransfers(ctx context.Context, filter *TransferFilter) ([]*Transfer, error) {
+	var transfers []*Transfer
+	q := p.db.ModelContext(ctx, &transfers)
+
+	switch filter.Direction {
+	case TransferDirectionSent:
+		q.Where("transfer.account_origin_id = ?", filter.AccountID)
+	case TransferDirectionReceived:
+		q.Where("transfer.account_destination_id = ?", filter.AccountID)
+	default:
+		q.WhereGroup(func(q *orm.Query) (*orm.Query, error) {
+			q.Where("transfer.account_origin_id = ?", filter.AccountID).
+				WhereOr("transfer.account_destination_id = ?", filter.AccountID)
+			return q, nil
+		})
+	}
+
+	if !filter.From.IsZero() {
+		q.Where("transfer.created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		q.Where("transfer.created_at < ?", filter.To)
+	}
+	if filter.MinAmount.Valid {
+		q.Where("transfer.amount >= ?", filter.MinAmount.Decimal)
+	}
+	if filter.MaxAmount.Valid {
+		q.Where("transfer.amount <= ?", filter.MaxAmount.Decimal)
+	}
+	if filter.After != nil {
+		q.Where("(transfer.created_at, transfer.id) < (?, ?)", filter.After.CreatedAt, filter.After.ID)
+	}
+	if filter.Limit > 0 {
+		q.Limit(filter.Limit)
+	}
+
+	err := q.Order("transfer.created_at DESC", "transfer.id DESC").Select()
+	return transfers, wrapPostgresError(err)
+}
+
+func (p *postgresDB) CreateCashMovement(ctx context.Context, movement *CashMovement) error {
+	if err := prepareCashMovement(movement); err != nil {
+		return err
+	}
+
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		accounts, err := lockAccounts(ctx, t, movement.AccountID)
+		if err != nil {
+			return err
+		}
+		account := accounts[movement.AccountID]
+
+		amount := movement.Amount
+		if movement.Type == CashMovementWithdrawal {
+			if err := checkDebit(account, false); err != nil {
+				return err
+			}
+			balance, err := walletBalance(ctx, t, account, movement.Currency)
+			if err != nil {
+				return err
+			}
+			if availableFunds(account, movement.Currency, balance).LessThan(movement.Amount) {
+				return ErrNotEnoughFunds
+			}
+			amount = amount.Neg()
+		} else if err := checkCredit(account, false); err != nil {
+			return err
+		}
+
+		if err := addToBalance(ctx, t, account, movement.Currency, amount); err != nil {
+			return err
+		}
+
+		_, err = t.ModelContext(ctx, movement).
+			Column("account_id", "type", "amount", "currency", "operator_id").
+			Returning("*").
+			Insert()
+		if err != nil {
+			return err
+		}
+		if movement.Type == CashMovementWithdrawal {
+			err := checkTransferLimits(ctx, t, account.ID, movement.Currency, movement.Amount, movement.CreatedAt, p.defaultLimits)
+			if err != nil {
+				return err
+			}
+		}
+
+		return insertLedgerEntries(ctx, t, &LedgerEntry{
+			AccountID:      account.ID,
+			CashMovementID: movement.ID,
+			Amount:         amount,
+			Currency:       movement.Currency,
+		})
+	})
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) FindAllCashMovementsWithAccountID(ctx context.Context, accountID int64) ([]*CashMovement, error) {
+	var movements []*CashMovement
+	err := p.db.ModelContext(ctx, &movements).
+		Where("cash_movement.account_id = ?", accountID).
+		Order("cash_movement.created_at DESC", "cash_movement.id DESC").
+		Select()
+
+	return movements, wrapPostgresError(err)
+}
+
+func (p *postgresDB) FindAllLedgerEntriesWithAccountID(ctx context.Context, accountID int64) ([]*LedgerEntry, error) {
+	var entries []*LedgerEntry
+	err := p.db.ModelContext(ctx, &entries).
+		Where("ledger_entry.account_id = ?", accountID).
+		Order("ledger_entry.id ASC").
+		Select()
+
+	return entries, wrapPostgresError(err)
+}
+
+func (p *postgresDB) ComputeLedgerBalance(ctx context.Context, accountID int64, c money.Currency) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	_, err := p.db.QueryOneContext(
+		ctx,
+		pg.Scan(&balance),
+		`
+			SELECT coalesce(sum(ledger_entry.amount), 0)
+			FROM accounts AS account
+			LEFT JOIN ledger_entries AS ledger_entry
+				ON ledger_entry.account_id = account.id AND ledger_entry.currency = ?
+			WHERE account.id = ?
+			GROUP BY account.id
+		`,
+		c, accountID,
+	)
+
+	return balance, wrapPostgresError(err)
+}
+
+func (p *postgresDB) CreateSession(ctx context.Context, session *Session) error {
+	_, err := p.db.ModelContext(ctx, session).
+		Column("account_id", "token_id", "refresh_token_hash", "expires_at").
+		Returning("*").
+		Insert()
+
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) FindSessionByTokenID(ctx context.Context, tokenID string) (*Session, error) {
+	session := &Session{}
+	err := p.db.ModelContext(ctx, session).
+		Where("session.token_id = ?", tokenID).
+		Where("session.revoked_at IS NULL").
+		Select()
+
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	return session, wrapPostgresError(err)
+}
+
+func (p *postgresDB) RefreshSession(ctx context.Context, refreshTokenHash string, refreshed *Session) error {
+	reused := false
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		session := &Session{}
+		err := t.ModelContext(ctx, session).
+			Where("session.refresh_token_hash = ? OR session.previous_refresh_token_hash = ?", refreshTokenHash, refreshTokenHash).
+			Where("session.revoked_at IS NULL").
+			For("UPDATE").
+			Select()
+		if errors.Is(err, pg.ErrNoRows) {
+			return ErrSessionNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		// the revocation is committed before reporting the reuse
+		if session.RefreshTokenHash != refreshTokenHash {
+			reused = true
+			_, err := t.ModelContext(ctx, session).Set("revoked_at = now()").WherePK().Update()
+			return err
+		}
+
+		session.PreviousRefreshTokenHash = session.RefreshTokenHash
+		session.TokenID = refreshed.TokenID
+		session.RefreshTokenHash = refreshed.RefreshTokenHash
+		session.ExpiresAt = refreshed.ExpiresAt
+
+		res, err := t.ModelContext(ctx, session).
+			Column("token_id", "refresh_token_hash", "previous_refresh_token_hash", "expires_at").
+			WherePK().
+			Where("expires_at > now()").
+			Update()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return ErrSessionNotFound
+		}
+
+		*refreshed = *session
+		return nil
+	})
+	if err != nil {
+		return wrapPostgresError(err)
+	}
+
+	if reused {
+		return ErrRefreshTokenReused
+	}
+	return nil
+}
+
+func (p *postgresDB) RevokeSession(ctx context.Context, id int64) error {
+	res, err := p.db.ModelContext(ctx, (*Session)(nil)).
+		Set("revoked_at = coalesce(revoked_at, now())").
+		Where("id = ?", id).
+		Update()
+	if err != nil {
+		return wrapPostgresError(err)
+	}
+
+	if res.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (p *postgresDB) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	_, err := p.db.ModelContext(ctx, key).
+		Column("account_id", "name", "prefix", "hash", "scopes").
+		Returning("*").
+		Insert()
+
+	if pgErr, ok := err.(pg.Error); ok && pgErr.Field('C') == "23503" {
+		return ErrAccountNotFound
+	}
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) FindAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	key := &APIKey{}
+	err := p.db.ModelContext(ctx, key).
+		Where("api_key.hash = ?", hash).
+		Where("api_key.revoked_at IS NULL").
+		Select()
+
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, wrapPostgresError(err)
+}
+
+func (p *postgresDB) FindAllAPIKeysWithAccountID(ctx context.Context, accountID int64) ([]*APIKey, error) {
+	var keys []*APIKey
+	err := p.db.ModelContext(ctx, &keys).
+		Where("api_key.account_id = ?", accountID).
+		Where("api_key.revoked_at IS NULL").
+		Order("api_key.id DESC").
+		Select()
+
+	return keys, wrapPostgresError(err)
+}
+
+func (p *postgresDB) RevokeAPIKey(ctx context.Context, accountID, id int64) error {
+	res, err := p.db.ModelContext(ctx, (*APIKey)(nil)).
+		Set("revoked_at = now()").
+		Where("id = ?", id).
+		Where("account_id = ?", accountID).
+		Where("revoked_at IS NULL").
+		Update()
+	if err != nil {
+		return wrapPostgresError(err)
+	}
+
+	if res.RowsAffected() == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (p *postgresDB) CreateAuditEvent(ctx context.Context, event *AuditEvent) error {
+	_, err := p.db.ModelContext(ctx, event).
+		Column("account_id", "actor_id", "action", "details").
+		Returning("*").
+		Insert()
+
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) FindAllAuditEventsWithAccountID(ctx context.Context, accountID int64) ([]*AuditEvent, error) {
+	var events []*AuditEvent
+	err := p.db.ModelContext(ctx, &events).
+		Where("audit_event.account_id = ?", accountID).
+		Order("audit_event.id DESC").
+		Select()
+
+	return events, wrapPostgresError(err)
+}
+
+func (p *postgresDB) FindLoginThrottle(ctx context.Context, key string) (*LoginThrottle, error) {
+	throttle := &LoginThrottle{}
+	err := p.db.ModelContext(ctx, throttle).
+		Where("login_throttle.key = ?", key).
+		Select()
+
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil, ErrLoginThrottleNotFound
+	}
+	return throttle, wrapPostgresError(err)
+}
+
+func (p *postgresDB) ReserveLoginAttempt(ctx context.Context, key string, at time.Time, window time.Duration, lockout func(failures int) time.Duration) (*LoginThrottle, error) {
+	previous := &LoginThrottle{Key: key}
+	err := p.db.RunInTransaction(ctx, func(t *pg.Tx) error {
+		// the throttle is created without failures if missing, so the first
+		// attempts for key are serialized by its lock like the others
+		_, err := t.ExecContext(
+			ctx,
+			`
+				INSERT INTO login_throttles (key, failures, last_failure_at)
+				VALUES (?, 0, ?)
+				ON CONFLICT (key) DO NOTHING
+			`,
+			key, at,
+		)
+		if err != nil {
+			return err
+		}
+
+		throttle := &LoginThrottle{}
+		err = t.ModelContext(ctx, throttle).
+			Where("login_throttle.key = ?", key).
+			For("UPDATE").
+			Select()
+		if err != nil {
+			return err
+		}
+		if throttle.Failures > 0 && !throttle.LastFailureAt.Before(at.Add(-window)) {
+			previous = throttle
+		}
+		if previous.LastFailureAt.Add(lockout(previous.Failures)).After(at) {
+			return ErrLoginLocked
+		}
+
+		reserved := &LoginThrottle{Key: key, Failures: previous.Failures + 1, LastFailureAt: at}
+		_, err = t.ModelContext(ctx, reserved).Column("failures", "last_failure_at").WherePK().Update()
+		return err
+	})
+
+	return previous, wrapPostgresError(err)
+}
+
+func (p *postgresDB) ReleaseLoginAttempt(ctx context.Context, key string, at time.Time, previous *LoginThrottle) error {
+	// the attempt is the only failure left if there is one, otherwise the
+	// failures are decremented
+	_, err := p.db.ModelContext(ctx, (*LoginThrottle)(nil)).
+		Where("key = ? AND failures <= 1", key).
+		Delete()
+	if err != nil {
+		return wrapPostgresError(err)
+	}
+
+	_, err = p.db.ExecContext(
+		ctx,
+		`
+			UPDATE login_throttles SET
+				failures = failures - 1,
+				last_failure_at = CASE
+					WHEN last_failure_at = ? THEN ?
+					ELSE last_failure_at
+				END
+			WHERE key = ? AND failures > 1
+		`,
+		at, previous.LastFailureAt, key,
+	)
+
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) DeleteLoginThrottle(ctx context.Context, key string) error {
+	_, err := p.db.ModelContext(ctx, (*LoginThrottle)(nil)).
+		Where("key = ?", key).
+		Delete()
+
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) CreateIdempotencyKey(ctx context.Context, key *IdempotencyKey) error {
+	// an expired key is taken over by the new request, while a key that did
+	// not expire makes the insert return no rows
+	_, err := p.db.QueryOneContext(
+		ctx,
+		key,
+		`
+			INSERT INTO idempotency_keys AS idempotency_key (account_id, key, fingerprint)
+			VALUES (?, ?, ?)
+			ON CONFLICT (account_id, key) DO UPDATE SET
+				fingerprint = EXCLUDED.fingerprint,
+				status_code = 0,
+				response = NULL,
+				created_at = now()
+			WHERE `+expiredIdempotencyKey+`
+			RETURNING *
+		`,
+		key.AccountID, key.Key, key.Fingerprint,
+		IdempotencyKeyLockTimeout.Seconds(), IdempotencyKeyRetention.Seconds(),
+	)
+
+	if errors.Is(err, pg.ErrNoRows) {
+		return ErrIdempotencyKeyAlreadyExists
+	}
+	return wrapPostgresError(err)
+}
+
+// expiredIdempotencyKey is the condition matching the expired idempotency
+// keys, given the lock timeout and the retention in seconds.
+const expiredIdempotencyKey = `(
+	(idempotency_key.status_code = 0 AND idempotency_key.created_at <= now() - make_interval(secs => ?)) OR
+	idempotency_key.created_at <= now() - make_interval(secs => ?)
+)`
+
+func (p *postgresDB) FindIdempotencyKey(ctx context.Context, accountID int64, key string) (*IdempotencyKey, error) {
+	k := &IdempotencyKey{}
+	err := p.db.ModelContext(ctx, k).
+		Where("idempotency_key.account_id = ?", accountID).
+		Where("idempotency_key.key = ?", key).
+		Select()
+
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+	return k, wrapPostgresError(err)
+}
+
+func (p *postgresDB) UpdateIdempotencyKey(ctx context.Context, key *IdempotencyKey) error {
+	res, err := p.db.ModelContext(ctx, key).
+		Column("status_code", "response").
+		WherePK().
+		Update()
+	if err != nil {
+		return wrapPostgresError(err)
+	}
+
+	if res.RowsAffected() == 0 {
+		return ErrIdempotencyKeyNotFound
+	}
+	return nil
+}
+
+func (p *postgresDB) DeleteIdempotencyKey(ctx context.Context, accountID int64, key string) error {
+	_, err := p.db.ModelContext(ctx, (*IdempotencyKey)(nil)).
+		Where("account_id = ?", accountID).
+		Where("key = ?", key).
+		Delete()
+
+	return wrapPostgresError(err)
+}
+
+func (p *postgresDB) DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error) {
+	res, err := p.db.ModelContext(ctx, (*IdempotencyKey)(nil)).
+		Where(expiredIdempotencyKey, IdempotencyKeyLockTimeout.Seconds(), IdempotencyKeyRetention.Seconds()).
+		Delete()
+	if err != nil {
+		return 0, wrapPostgresError(err)
+	}
+	return res.RowsAffected(), nil
+}
+
+// applyTransfer moves the transfer amount between the accounts and records the
+// transfer as part of transaction t. Direct transfers, the ones made by
+// CreateTransfer, are charged their fee.
+func applyTransfer(ctx context.Context, t *pg.Tx, transfer *Transfer, direct bool) error {
+	if err := prepareTransfer(transfer); err != nil {
+		return err
+	}
+	// reversals are converted at the rate of the reversed transfer
+	if transfer.ReversedTransferID == 0 {
+		rate, err := findExchangeRate(ctx, t, transfer.Currency, transfer.DestinationCurrency)
+		if err != nil {
+			return err
+		}
+		if err := convertTransfer(transfer, rate); err != nil {
+			return err
+		}
+	}
+
+	// the revenue account is locked along with the accounts of the transfer,
+	// so all of them are locked in ascending ID order
+	ids := []int64{transfer.AccountOriginID, transfer.AccountDestinationID}
+	var schedule *FeeSchedule
+	if direct {
+		var err error
+		if schedule, err = findFeeSchedule(ctx, t, transfer); err != nil {
+			return err
+		}
+		if schedule != nil {
+			ids = append(ids, schedule.RevenueAccountID)
+		}
+	}
+	accounts, err := lockAccounts(ctx, t, ids...)
+	if err != nil {
+		return err
+	}
+	srcAccount := accounts[transfer.AccountOriginID]
+	dstAccount := accounts[transfer.AccountDestinationID]
+
+	reversal := transfer.ReversedTransferID != 0
+	if err := checkDebit(srcAccount, reversal); err != nil {
+		return err
+	}
+	if err := checkCredit(dstAccount, reversal); err != nil {
+		return err
+	}
+	var revenueAccount *Account
+	if schedule != nil && schedule.RevenueAccountID != srcAccount.ID {
+		if err := chargeFee(ctx, t, transfer, srcAccount, schedule); err != nil {
+			return err
+		}
+		if transfer.Fee.IsPositive() {
+			revenueAccount = accounts[schedule.RevenueAccountID]
+		}
+	}
+	balance, err := walletBalance(ctx, t, srcAccount, transfer.Currency)
+	if err != nil {
+		return err
+	}
+	if availableFunds(srcAccount, transfer.Currency, balance).LessThan(transfer.Amount.Add(transfer.Fee)) {
+		return ErrNotEnoughFunds
+	}
+
+	if err := addToBalance(ctx, t, srcAccount, transfer.Currency, transfer.Amount.Add(transfer.Fee).Neg()); err != nil {
+		return err
+	}
+	if err := addToBalance(ctx, t, dstAccount, transfer.DestinationCurrency, transfer.DestinationAmount); err != nil {
+		return err
+	}
+	if revenueAccount != nil {
+		if err := addToBalance(ctx, t, revenueAccount, transfer.Currency, transfer.Fee); err != nil {
+			return err
+		}
+	}
+
+	_, err = t.ModelContext(ctx, transfer).
+		Column(
+			"account_origin_id", "account_destination_id", "amount", "currency",
+			"destination_amount", "destination_currency", "exchange_rate", "fee", "reversed_transfer_id", "reason",
+		).
+		Returning("*").
+		Insert()
+	if err != nil {
+		return err
+	}
+
+	entries := []*LedgerEntry{
+		{AccountID: srcAccount.ID, TransferID: transfer.ID, Amount: transfer.Amount.Neg(), Currency: transfer.Currency},
+		{AccountID: dstAccount.ID, TransferID: transfer.ID, Amount: transfer.DestinationAmount, Currency: transfer.DestinationCurrency},
+	}
+	if revenueAccount != nil {
+		entries = append(entries,
+			&LedgerEntry{AccountID: srcAccount.ID, TransferID: transfer.ID, Amount: transfer.Fee.Neg(), Currency: transfer.Currency},
+			&LedgerEntry{AccountID: revenueAccount.ID, TransferID: transfer.ID, Amount: transfer.Fee, Currency: transfer.Currency},
+		)
+	}
+	return insertLedgerEntries(ctx, t, entries...)
+}
+
+// findFeeSchedule returns the fee schedule of the type of transfer as part of
+// transaction t, or nil if there is none. The type of an account never
+// changes, so the origin does not need to be locked yet; if it does not exist,
+// locking it reports the error.
+func findFeeSchedule(ctx context.Context, t *pg.Tx, transfer *Transfer) (*FeeSchedule, error) {
+	origin := &Account{}
+	err := t.ModelContext(ctx, origin).
+		Column("type").
+		Where("account.id = ?", transfer.AccountOriginID).
+		Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := &FeeSchedule{}
+	err = t.ModelContext(ctx, schedule).
+		Where("fee_schedule.transfer_type = ?", transferTypeOf(transfer, origin.Type)).
+		Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil, nil
+	}
+	return schedule, err
+}
+
+// chargeFee fills the fee of transfer, made by origin, as given by schedule
+// and the transfers of the same type made by origin in the month, as part of
+// transaction t.
+func chargeFee(ctx context.Context, t *pg.Tx, transfer *Transfer, origin *Account, schedule *FeeSchedule) error {
+	rate, err := findExchangeRate(ctx, t, transfer.Currency, money.DefaultCurrency)
+	if err != nil {
+		return err
+	}
+	now, err := currentTime(ctx, t)
+	if err != nil {
+		return err
+	}
+	start, end := monthOf(now)
+
+	// the type of the transfers of an account only depends on whether they
+	// are exchanges, as the type of the account never changes
+	var transfers int
+	_, err = t.QueryOneContext(
+		ctx,
+		pg.Scan(&transfers),
+		`
+			SELECT count(*)
+			FROM transfers
+			WHERE account_origin_id = ? AND reversed_transfer_id IS NULL
+				AND (currency <> destination_currency) = ?
+				AND created_at >= ? AND created_at < ?
+		`,
+		origin.ID, schedule.TransferType == TransferExchange, start, end,
+	)
+	if err != nil {
+		return err
+	}
+
+	transfer.Fee = schedule.Fee(transfer.Amount, transfer.Currency, rate, transfers)
+	return nil
+}
+
+// checkTransferLimits returns ErrLimitExceeded if moving amount in currency c
+// out of accountID at now, by a transfer or a withdrawal already recorded as
+// part of transaction t, exceeds any of the transfer limits of the account,
+// given the defaults of accounts that never changed them. The account is
+// locked by the caller, so the cash-outs of an account are checked one at a
+// time.
+func checkTransferLimits(ctx context.Context, t *pg.Tx, accountID int64, c money.Currency, amount decimal.Decimal, now time.Time, defaults map[TransferLimitKind]decimal.Decimal) error {
+	history, err := findTransferLimits(ctx, t, accountID)
+	if err != nil {
+		return err
+	}
+	current, _ := resolveTransferLimits(accountID, history, defaults, now)
+
+	dayStart, dayEnd := dayOf(now)
+	nightStart, nightEnd, night := nightOf(now)
+	var totals []struct {
+		Currency money.Currency
+		Daily    decimal.Decimal
+		Nightly  decimal.Decimal
+	}
+	_, err = t.QueryContext(
+		ctx,
+		&totals,
+		`
+			SELECT
+				currency,
+				coalesce(sum(amount) FILTER (WHERE created_at >= ? AND created_at < ?), 0) AS daily,
+				coalesce(sum(amount) FILTER (WHERE created_at >= ? AND created_at < ?), 0) AS nightly
+			FROM (
+				SELECT currency, amount, created_at
+				FROM transfers
+				WHERE account_origin_id = ? AND reversed_transfer_id IS NULL
+				UNION ALL
+				SELECT currency, amount, created_at
+				FROM cash_movements
+				WHERE account_id = ? AND type = ?
+			) AS cash_outs
+			GROUP BY currency
+		`,
+		dayStart, dayEnd, nightStart, nightEnd, accountID, accountID, CashMovementWithdrawal,
+	)
+	if err != nil {
+		return err
+	}
+
+	daily := make(map[money.Currency]decimal.Decimal, len(totals))
+	nightly := make(map[money.Currency]decimal.Decimal, len(totals))
+	for _, total := range totals {
+		daily[total.Currency] = total.Daily
+		nightly[total.Currency] = total.Nightly
+	}
+	rate := func(c money.Currency) (decimal.Decimal, error) {
+		return findExchangeRate(ctx, t, c, money.DefaultCurrency)
+	}
+	amount, err = limitTotal(map[money.Currency]decimal.Decimal{c: amount}, rate)
+	if err != nil {
+		return err
+	}
+	dailyTotal, err := limitTotal(daily, rate)
+	if err != nil {
+		return err
+	}
+	nightlyTotal, err := limitTotal(nightly, rate)
+	if err != nil {
+		return err
+	}
+	return checkLimitTotals(amount, current, dailyTotal, nightlyTotal, night)
+}
+
+// findTransferLimits returns the history of transfer limits of accountID in
+// the order they were requested.
+func findTransferLimits(ctx context.Context, db orm.DB, accountID int64) ([]*TransferLimit, error) {
+	var limits []*TransferLimit
+	err := db.ModelContext(ctx, &limits).
+		Where("transfer_limit.account_id = ?", accountID).
+		Order("transfer_limit.id ASC").
+		Select()
+	return limits, err
+}
+
+// currentTime returns the current time of the database, which is the start of
+// the current transaction, if any.
+func currentTime(ctx context.Context, db orm.DB) (time.Time, error) {
+	var now time.Time
+	_, err := db.QueryOneContext(ctx, pg.Scan(&now), "SELECT now()")
+	return now, err
+}
+
+// findExchangeRate returns the rate for converting from base to quote as part
+// of transaction t. Returns ErrExchangeRateNotFound if there is no such rate.
+func findExchangeRate(ctx context.Context, t *pg.Tx, base, quote money.Currency) (decimal.Decimal, error) {
+	if base == quote {
+		return sameCurrencyRate, nil
+	}
+
+	rate := &ExchangeRate{}
+	err := t.ModelContext(ctx, rate).
+		Where("exchange_rate.base = ?", base).
+		Where("exchange_rate.quote = ?", quote).
+		Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		return decimal.Zero, ErrExchangeRateNotFound
+	}
+	return rate.Rate, err
+}
+
+// findWallets returns the wallets of account, starting with the wallet of
+// money.DefaultCurrency, which is not stored in the wallets table.
+func findWallets(ctx context.Context, db orm.DB, account *Account) ([]*Wallet, error) {
+	var wallets []*Wallet
+	err := db.ModelContext(ctx, &wallets).
+		Where("wallet.account_id = ?", account.ID).
+		Order("wallet.currency ASC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+
+	defaultWallet := &Wallet{AccountID: account.ID, Currency: money.DefaultCurrency, Balance: account.Balance}
+	return append([]*Wallet{defaultWallet}, wallets...), nil
+}
+
+// walletBalance returns the balance of the wallet of currency c of account as
+// part of transaction t. The wallets are only changed while their account is
+// locked by lockAccounts, so the balance cannot change until t finishes.
+func walletBalance(ctx context.Context, t *pg.Tx, account *Account, c money.Currency) (decimal.Decimal, error) {
+	if c == money.DefaultCurrency {
+		return account.Balance, nil
+	}
+
+	wallet := &Wallet{}
+	err := t.ModelContext(ctx, wallet).
+		Where("wallet.account_id = ?", account.ID).
+		Where("wallet.currency = ?", c).
+		Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		return decimal.Zero, nil
+	}
+	return wallet.Balance, err
+}
+
+// addToBalance adds amount to the balance of the wallet of currency c of
+// account as part of transaction t, creating the wallet if needed.
+func addToBalance(ctx context.Context, t *pg.Tx, account *Account, c money.Currency, amount decimal.Decimal) error {
+	if c == money.DefaultCurrency {
+		account.Balance = account.Balance.Add(amount)
+		_, err := t.ModelContext(ctx, account).Column("balance").WherePK().Update()
+		return err
+	}
+
+	wallet := &Wallet{AccountID: account.ID, Currency: c, Balance: amount}
+	_, err := t.ModelContext(ctx, wallet).
+		OnConflict("(account_id, currency) DO UPDATE").
+		Set("balance = wallet.balance + EXCLUDED.balance").
+		Insert()
+	return err
+}
+
+// lockAccounts selects the accounts with given ids for update as part of
+// transaction t, so their balances cannot change until t finishes. Rows are
+// always locked in ascending ID order, which prevents deadlocks between
+// concurrent transactions locking the same accounts. Returns
+// ErrAccountNotFound if any of the accounts cannot be found.
+func lockAccounts(ctx context.Context, t *pg.Tx, ids ...int64) (map[int64]*Account, error) {
+	var accounts []*Account
+	err := t.ModelContext(ctx, &accounts).
+		Where("account.id IN (?)", pg.In(ids)).
+		Order("account.id ASC").
+		For("UPDATE").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[int64]*Account, len(accounts))
+	for _, acc := range accounts {
+		found[acc.ID] = acc
+	}
+	for _, id := range ids {
+		if _, ok := found[id]; !ok {
+			return nil, ErrAccountNotFound
+		}
+	}
+
+	return found, nil
+}
+
+// insertLedgerEntries writes entries into the ledger as part of transaction t.
+func insertLedgerEntries(ctx context.Context, t *pg.Tx, entries ...*LedgerEntry) error {
+	_, err := t.ModelContext(ctx, &entries).
+		Column("account_id", "transfer_id", "cash_movement_id", "amount", "currency").
+		Returning("*").
+		Insert()
+
+	return err
+}
+
+// escapeLike escapes the wildcard characters of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
 }
 
 func wrapPostgresError(err error) error {
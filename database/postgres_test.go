@@ -6,7 +6,7 @@ import (
 )
 
 const truncateQuery = `
-	TRUNCATE TABLE accounts, transfers RESTART IDENTITY;
+	TRUNCATE TABLE accounts, transfers, cash_movements, ledger_entries, idempotency_keys, scheduled_transfers, scheduled_transfer_executions, sessions, login_throttles, api_keys, audit_events, wallets, exchange_rates, transfer_limits, fee_schedules, interest_accruals RESTART IDENTITY;
 `
 
 func TestPostgresDB(t *testing.T) {
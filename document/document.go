@@ -0,0 +1,128 @@
+// Package document implements the validation and normalization of Brazilian
+// identification documents.
+package document
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// cpfPattern matches a CPF, masked as 000.000.000-00 or unmasked.
+	cpfPattern = regexp.MustCompile(`^(\d{3})\.?(\d{3})\.?(\d{3})-?(\d{2})$`)
+
+	// cnpjPattern matches a CNPJ, masked as 00.000.000/0000-00 or unmasked.
+	cnpjPattern = regexp.MustCompile(`^(\d{2})\.?(\d{3})\.?(\d{3})/?(\d{4})-?(\d{2})$`)
+)
+
+// Normalize returns the canonical form of a CPF or CNPJ, masked or unmasked.
+// Any other string is returned with surrounding spaces trimmed.
+func Normalize(doc string) string {
+	if cpfPattern.MatchString(strings.TrimSpace(doc)) {
+		return NormalizeCPF(doc)
+	}
+	return NormalizeCNPJ(doc)
+}
+
+// NormalizeCPF returns the canonical form of a CPF, masked as 000.000.000-00.
+// Masked and unmasked CPFs are accepted; any other string is returned with
+// surrounding spaces trimmed.
+func NormalizeCPF(cpf string) string {
+	cpf = strings.TrimSpace(cpf)
+	m := cpfPattern.FindStringSubmatch(cpf)
+	if m == nil {
+		return cpf
+	}
+	return m[1] + "." + m[2] + "." + m[3] + "-" + m[4]
+}
+
+// NormalizeCNPJ returns the canonical form of a CNPJ, masked as
+// 00.000.000/0000-00. Masked and unmasked CNPJs are accepted; any other string
+// is returned with surrounding spaces trimmed.
+func NormalizeCNPJ(cnpj string) string {
+	cnpj = strings.TrimSpace(cnpj)
+	m := cnpjPattern.FindStringSubmatch(cnpj)
+	if m == nil {
+		return cnpj
+	}
+	return m[1] + "." + m[2] + "." + m[3] + "/" + m[4] + "-" + m[5]
+}
+
+// MaskCPF returns cpf with all but its middle six digits hidden, as
+// ***.982.247-**, the format used to display a CPF to third parties. Strings
+// that are not a CPF are hidden entirely.
+func MaskCPF(cpf string) string {
+	m := cpfPattern.FindStringSubmatch(strings.TrimSpace(cpf))
+	if m == nil {
+		return strings.Repeat("*", len(cpf))
+	}
+	return "***." + m[2] + "." + m[3] + "-**"
+}
+
+// ValidCPF reports whether cpf is a masked or unmasked CPF with valid check
+// digits. CPFs made of a single repeated digit, such as 111.111.111-11, are
+// not valid even though their check digits match.
+func ValidCPF(cpf string) bool {
+	m := cpfPattern.FindStringSubmatch(strings.TrimSpace(cpf))
+	if m == nil {
+		return false
+	}
+	return validCheckDigits(digitsOf(strings.Join(m[1:], "")), 11)
+}
+
+// ValidCNPJ reports whether cnpj is a masked or unmasked CNPJ with valid check
+// digits. CNPJs made of a single repeated digit are not valid.
+func ValidCNPJ(cnpj string) bool {
+	m := cnpjPattern.FindStringSubmatch(strings.TrimSpace(cnpj))
+	if m == nil {
+		return false
+	}
+	return validCheckDigits(digitsOf(strings.Join(m[1:], "")), 9)
+}
+
+// validCheckDigits reports whether the last two digits are the check digits of
+// the leading ones and the digits are not all the same.
+func validCheckDigits(digits []int, maxWeight int) bool {
+	if repeated(digits) {
+		return false
+	}
+	n := len(digits) - 2
+	return checkDigit(digits[:n], maxWeight) == digits[n] &&
+		checkDigit(digits[:n+1], maxWeight) == digits[n+1]
+}
+
+// checkDigit returns the modulo 11 check digit of digits. The digits are
+// weighted from the rightmost one, starting at 2 and going back to 2 after
+// maxWeight.
+func checkDigit(digits []int, maxWeight int) int {
+	sum, weight := 0, 2
+	for n := len(digits) - 1; n >= 0; n-- {
+		sum += digits[n] * weight
+		if weight++; weight > maxWeight {
+			weight = 2
+		}
+	}
+	if d := 11 - sum%11; d < 10 {
+		return d
+	}
+	return 0
+}
+
+// digitsOf returns the numeric values of a string of decimal digits.
+func digitsOf(s string) []int {
+	digits := make([]int, len(s))
+	for n, c := range s {
+		digits[n] = int(c - '0')
+	}
+	return digits
+}
+
+// repeated reports whether all digits are the same.
+func repeated(digits []int) bool {
+	for _, d := range digits[1:] {
+		if d != digits[0] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package document
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidCPF(t *testing.T) {
+	for _, cpf := range []string{"529.982.247-25", "52998224725", "111.444.777-35", " 123.456.789-09 "} {
+		require.True(t, ValidCPF(cpf), cpf)
+	}
+
+	for _, cpf := range []string{
+		"",
+		"529.982.247-24",
+		"529.982.247-52",
+		"111.111.111-11",
+		"00000000000",
+		"x529.982.247-25",
+		"529.982.247-25x",
+		"5299822472",
+		"529-982-247.25",
+	} {
+		require.False(t, ValidCPF(cpf), cpf)
+	}
+}
+
+func TestNormalizeCPF(t *testing.T) {
+	require.Equal(t, "529.982.247-25", NormalizeCPF("52998224725"))
+	require.Equal(t, "529.982.247-25", NormalizeCPF("529.982.247-25"))
+	require.Equal(t, "529.982.247-25", NormalizeCPF(" 529982247-25 "))
+	require.Equal(t, "not a cpf", NormalizeCPF("not a cpf"))
+}
+
+func TestMaskCPF(t *testing.T) {
+	require.Equal(t, "***.982.247-**", MaskCPF("529.982.247-25"))
+	require.Equal(t, "***.982.247-**", MaskCPF("52998224725"))
+	require.Equal(t, "*********", MaskCPF("not a cpf"))
+}
+
+func TestValidCNPJ(t *testing.T) {
+	for _, cnpj := range []string{"11.222.333/0001-81", "11222333000181", "11.444.777/0001-61"} {
+		require.True(t, ValidCNPJ(cnpj), cnpj)
+	}
+
+	for _, cnpj := range []string{
+		"",
+		"11.222.333/0001-82",
+		"11.222.333/0001-18",
+		"11.111.111/1111-11",
+		"00000000000000",
+		"529.982.247-25",
+		"x11.222.333/0001-81",
+		"11.222.333-0001/81",
+	} {
+		require.False(t, ValidCNPJ(cnpj), cnpj)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	require.Equal(t, "11.222.333/0001-81", NormalizeCNPJ("11222333000181"))
+	require.Equal(t, "11.222.333/0001-81", NormalizeCNPJ("11.222.333/0001-81"))
+	require.Equal(t, "not a cnpj", NormalizeCNPJ(" not a cnpj"))
+
+	require.Equal(t, "529.982.247-25", Normalize("52998224725"))
+	require.Equal(t, "11.222.333/0001-81", Normalize("11222333000181"))
+	require.Equal(t, "529.982.247-2", Normalize("529.982.247-2"))
+}
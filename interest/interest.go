@@ -0,0 +1,80 @@
+// Package interest implements the background job that charges interest on the
+// negative balances of overdrawn accounts.
+package interest
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/lindebergue/desafio-go-stone/database"
+)
+
+// Options contains the options for creating an accruer.
+type Options struct {
+	DB database.DB
+
+	// Interval is how often the accruer looks for overdrawn accounts not yet
+	// charged for the current day. Defaults to one hour.
+	Interval time.Duration
+
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Accruer charges the daily interest of overdrawn accounts. Each account is
+// charged once a day by the database, so the accruer may run more often than
+// daily and many accruers can run at the same time.
+type Accruer struct {
+	db       database.DB
+	interval time.Duration
+	now      func() time.Time
+}
+
+// New returns a new accruer with given opts.
+func New(opts Options) *Accruer {
+	a := &Accruer{
+		db:       opts.DB,
+		interval: opts.Interval,
+		now:      opts.Now,
+	}
+	if a.interval <= 0 {
+		a.interval = time.Hour
+	}
+	if a.now == nil {
+		a.now = time.Now
+	}
+	return a
+}
+
+// Run charges the interest of the current day every interval until ctx is
+// done.
+func (a *Accruer) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.Accrue(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("error accruing overdraft interest: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Accrue charges the interest of the current day on the accounts that are
+// overdrawn and were not charged yet.
+func (a *Accruer) Accrue(ctx context.Context) error {
+	accruals, err := a.db.AccrueOverdraftInterest(ctx, a.now())
+	if err != nil {
+		return err
+	}
+	if len(accruals) > 0 {
+		log.Printf("charged overdraft interest on %d accounts", len(accruals))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package interest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lindebergue/desafio-go-stone/database"
+)
+
+func TestAccrue(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewInMemDB()
+
+	overdrawn := &database.Account{Name: "overdrawn", CPF: "111.111.111-11", Secret: "secret"}
+	solvent := &database.Account{Name: "solvent", CPF: "222.222.222-22", Secret: "secret"}
+	require.NoError(t, db.CreateAccount(ctx, overdrawn))
+	require.NoError(t, db.CreateAccount(ctx, solvent))
+	require.NoError(t, db.SetAccountCreditLine(ctx, overdrawn.ID, decimal.NewFromInt(500), decimal.RequireFromString("0.001")))
+	require.NoError(t, db.SetAccountCreditLine(ctx, solvent.ID, decimal.NewFromInt(500), decimal.RequireFromString("0.001")))
+
+	withdrawal := &database.CashMovement{
+		AccountID: overdrawn.ID,
+		Type:      database.CashMovementWithdrawal,
+		Amount:    decimal.NewFromInt(100),
+	}
+	require.NoError(t, db.CreateCashMovement(ctx, withdrawal))
+
+	now := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	a := New(Options{DB: db, Now: func() time.Time { return now }})
+
+	// the interest is charged once a day
+	require.NoError(t, a.Accrue(ctx))
+	require.NoError(t, a.Accrue(ctx))
+
+	found, err := db.FindAccountByID(ctx, overdrawn.ID)
+	require.NoError(t, err)
+	require.Equal(t, "-100.1", found.Balance.String())
+
+	movements, err := db.FindAllCashMovementsWithAccountID(ctx, overdrawn.ID)
+	require.NoError(t, err)
+	require.Len(t, movements, 2)
+	require.Equal(t, database.CashMovementInterest, movements[0].Type)
+	require.Equal(t, "0.1", movements[0].Amount.String())
+
+	// accounts that are not overdrawn are not charged
+	movements, err = db.FindAllCashMovementsWithAccountID(ctx, solvent.ID)
+	require.NoError(t, err)
+	require.Empty(t, movements)
+
+	// the next day charges the interest on the new balance
+	now = now.AddDate(0, 0, 1)
+	require.NoError(t, a.Accrue(ctx))
+
+	found, err = db.FindAccountByID(ctx, overdrawn.ID)
+	require.NoError(t, err)
+	require.Equal(t, "-100.2", found.Balance.String())
+}
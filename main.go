@@ -3,31 +3,135 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
+	"github.com/shopspring/decimal"
+
+	"github.com/lindebergue/desafio-go-stone/auth"
 	"github.com/lindebergue/desafio-go-stone/database"
+	"github.com/lindebergue/desafio-go-stone/interest"
 	"github.com/lindebergue/desafio-go-stone/router"
+	"github.com/lindebergue/desafio-go-stone/scheduler"
 )
 
 func main() {
 	jwtSecret := os.Getenv("APP_JWT_SECRET")
+	jwtKeysDir := os.Getenv("APP_JWT_KEYS_DIR")
+	jwtSigningKeyID := os.Getenv("APP_JWT_SIGNING_KEY_ID")
 	databaseURL := os.Getenv("APP_DATABASE_URL")
+	passwordHasher := os.Getenv("APP_PASSWORD_HASHER")
+	totpKeyBase64 := os.Getenv("APP_TOTP_KEY")
+	totpTransferThreshold := os.Getenv("APP_TOTP_TRANSFER_THRESHOLD")
+	exchangeRatesFile := os.Getenv("APP_EXCHANGE_RATES_FILE")
+	feeSchedulesFile := os.Getenv("APP_FEE_SCHEDULES_FILE")
+	trustedProxies := os.Getenv("APP_TRUSTED_PROXIES")
+	transferLimits := map[database.TransferLimitKind]string{
+		database.LimitPerTransaction: os.Getenv("APP_TRANSFER_LIMIT_PER_TRANSACTION"),
+		database.LimitDaily:          os.Getenv("APP_TRANSFER_LIMIT_DAILY"),
+		database.LimitNighttime:      os.Getenv("APP_TRANSFER_LIMIT_NIGHTTIME"),
+	}
+
+	// asymmetric keys take precedence over the shared secret
+	jwtKeys := auth.NewHMACKeySet([]byte(jwtSecret))
+	if jwtKeysDir != "" {
+		keys, err := auth.LoadKeySet(jwtKeysDir, jwtSigningKeyID)
+		if err != nil {
+			log.Fatalf("error loading json web token keys: %v", err)
+		}
+		jwtKeys = keys
+	}
+
+	var hasher auth.PasswordHasher
+	switch passwordHasher {
+	case "", "bcrypt":
+		hasher = auth.DefaultPasswordHasher
+	case "argon2id":
+		hasher = auth.NewArgon2idHasher()
+	default:
+		log.Fatalf("unknown password hasher %q", passwordHasher)
+	}
+
+	// the totp secrets are encrypted with AES-256; without a key accounts
+	// cannot enroll totp
+	var totpKey []byte
+	if totpKeyBase64 != "" {
+		key, err := base64.StdEncoding.DecodeString(totpKeyBase64)
+		if err != nil || len(key) != 32 {
+			log.Fatal("APP_TOTP_KEY must be a base64 encoded 32 bytes key")
+		}
+		totpKey = key
+	}
+
+	if totpTransferThreshold == "" {
+		totpTransferThreshold = "1000"
+	}
+	threshold, err := decimal.NewFromString(totpTransferThreshold)
+	if err != nil {
+		log.Fatalf("error parsing totp transfer threshold: %v", err)
+	}
+
+	proxies, err := parseNetworks(trustedProxies)
+	if err != nil {
+		log.Fatalf("error parsing trusted proxies: %v", err)
+	}
 
-	db, err := database.NewPostgresDB(databaseURL)
+	// unset limits keep their defaults
+	defaultLimits := map[database.TransferLimitKind]decimal.Decimal{}
+	for kind, value := range transferLimits {
+		if value == "" {
+			continue
+		}
+		amount, err := decimal.NewFromString(value)
+		if err != nil || !amount.IsPositive() {
+			log.Fatalf("the %s transfer limit must be a positive amount", kind)
+		}
+		defaultLimits[kind] = amount
+	}
+
+	db, err := database.NewPostgresDB(databaseURL, database.WithPostgresDefaultTransferLimits(defaultLimits))
 	if err != nil {
 		log.Fatalf("error connecting to database: %v", err)
 	}
 
+	if exchangeRatesFile != "" {
+		if err := loadExchangeRates(db, exchangeRatesFile); err != nil {
+			log.Fatalf("error loading exchange rates: %v", err)
+		}
+	}
+	if feeSchedulesFile != "" {
+		if err := loadFeeSchedules(db, feeSchedulesFile); err != nil {
+			log.Fatalf("error loading fee schedules: %v", err)
+		}
+	}
+
+	// requests derive their contexts from baseCtx, so cancelling it aborts the
+	// database queries of all requests in flight
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
 	srv := &http.Server{
 		Addr: ":9999",
 		Handler: router.New(router.Options{
-			DB:        db,
-			JWTSecret: []byte(jwtSecret),
+			DB:                    db,
+			JWTKeys:               jwtKeys,
+			PasswordHasher:        hasher,
+			TOTPKey:               totpKey,
+			TOTPTransferThreshold: threshold,
+			TrustedProxies:        proxies,
+			RequestTimeout:        10 * time.Second,
 		}),
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 	}
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -37,15 +141,130 @@ func main() {
 
 	log.Printf("server listening for connections on %s", srv.Addr)
 
+	// the background jobs stop as soon as the server starts shutting down;
+	// work claimed by other instances is not affected
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		scheduler.New(scheduler.Options{DB: db, Interval: time.Minute}).Run(schedulerCtx)
+	}()
+	interestDone := make(chan struct{})
+	go func() {
+		defer close(interestDone)
+		interest.New(interest.Options{DB: db, Interval: time.Hour}).Run(schedulerCtx)
+	}()
+	purgeDone := make(chan struct{})
+	go func() {
+		defer close(purgeDone)
+		purgeIdempotencyKeys(schedulerCtx, db, time.Hour)
+	}()
+
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	<-ch
 
 	log.Println("interrupt signal received; shutting down the server...")
+	stopScheduler()
+	<-schedulerDone
+	<-interestDone
+	<-purgeDone
+
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 
+	// abort the requests that are still running after the grace period
+	go func() {
+		<-ctx.Done()
+		cancelRequests()
+	}()
+
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatalf("error shutting down the server gracefully: %v", err)
 	}
 }
+
+// parseNetworks parses a comma separated list of networks in CIDR notation or
+// single IP addresses.
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if ip := net.ParseIP(field); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// purgeIdempotencyKeys deletes the expired idempotency keys every interval
+// until ctx is done.
+func purgeIdempotencyKeys(ctx context.Context, db database.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := db.DeleteExpiredIdempotencyKeys(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("error deleting expired idempotency keys: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadExchangeRates sets the exchange rates listed in the JSON file at path,
+// replacing the current rates between the same currencies.
+func loadExchangeRates(db database.DB, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var rates []*database.ExchangeRate
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return err
+	}
+	for _, rate := range rates {
+		if err := db.SetExchangeRate(context.Background(), rate); err != nil {
+			return fmt.Errorf("%s to %s: %w", rate.Base, rate.Quote, err)
+		}
+	}
+	return nil
+}
+
+// loadFeeSchedules sets the fee schedules listed in the JSON file at path,
+// replacing the current schedules of the same transfer types.
+func loadFeeSchedules(db database.DB, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var schedules []*database.FeeSchedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return err
+	}
+	for _, schedule := range schedules {
+		if err := db.SetFeeSchedule(context.Background(), schedule); err != nil {
+			return fmt.Errorf("%s transfers: %w", schedule.TransferType, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Package money implements the rules for monetary amounts.
+package money
+
+import (
+	"errors"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	// ErrAmountNotPositive indicates that an amount is zero or negative.
+	ErrAmountNotPositive = errors.New("money: amount not positive")
+
+	// ErrAmountPrecision indicates that an amount has more decimal places
+	// than its currency allows.
+	ErrAmountPrecision = errors.New("money: amount precision exceeded")
+)
+
+// Currency represents an ISO 4217 currency code.
+type Currency string
+
+// The supported currencies.
+const (
+	BRL Currency = "BRL"
+	USD Currency = "USD"
+)
+
+// DefaultCurrency is the currency of the amounts that do not specify one.
+const DefaultCurrency = BRL
+
+// places are the number of decimal places of the supported currencies. The
+// CHECK constraints of the amounts in the database assume 2 decimal places for
+// every currency, so a currency with other places needs a migration replacing
+// them.
+var places = map[Currency]int32{
+	BRL: 2,
+	USD: 2,
+}
+
+// Valid reports whether c is a supported currency.
+func (c Currency) Valid() bool {
+	_, ok := places[c]
+	return ok
+}
+
+// Places returns the number of decimal places of amounts in c.
+func (c Currency) Places() int32 {
+	return places[c]
+}
+
+// Convert returns amount multiplied by rate, rounded half away from zero to
+// the decimal places of the currency it is converted to.
+func Convert(amount, rate decimal.Decimal, to Currency) decimal.Decimal {
+	return amount.Mul(rate).Round(to.Places())
+}
+
+// ValidateAmount returns an error if amount cannot be moved in currency c:
+// amounts must be positive and have at most the decimal places of c.
+func ValidateAmount(amount decimal.Decimal, c Currency) error {
+	if !amount.IsPositive() {
+		return ErrAmountNotPositive
+	}
+	if !amount.Equal(amount.Truncate(c.Places())) {
+		return ErrAmountPrecision
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package money
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAmount(t *testing.T) {
+	for _, amount := range []string{"0.01", "1", "10.5", "10.50", "10.500", "1000000"} {
+		require.NoError(t, ValidateAmount(decimal.RequireFromString(amount), BRL), amount)
+	}
+
+	require.Equal(t, ErrAmountNotPositive, ValidateAmount(decimal.Zero, BRL))
+	require.Equal(t, ErrAmountNotPositive, ValidateAmount(decimal.RequireFromString("-10"), BRL))
+	require.Equal(t, ErrAmountPrecision, ValidateAmount(decimal.RequireFromString("0.001"), BRL))
+	require.Equal(t, ErrAmountPrecision, ValidateAmount(decimal.RequireFromString("0.0000001"), BRL))
+}
+
+func TestConvert(t *testing.T) {
+	rate := decimal.RequireFromString("5.1234")
+	require.Equal(t, "51.23", Convert(decimal.NewFromInt(10), rate, BRL).String())
+	require.Equal(t, "0.05", Convert(decimal.RequireFromString("0.01"), rate, BRL).String())
+
+	rate = decimal.RequireFromString("0.1952")
+	require.Equal(t, "1.95", Convert(decimal.NewFromInt(10), rate, USD).String())
+	require.True(t, Convert(decimal.RequireFromString("0.01"), rate, USD).IsZero())
+}
+
+func TestCurrencyValid(t *testing.T) {
+	require.True(t, BRL.Valid())
+	require.True(t, USD.Valid())
+	require.False(t, Currency("EUR").Valid())
+	require.False(t, Currency("").Valid())
+}
+
+func TestCurrencyPlaces(t *testing.T) {
+	// the CHECK constraints of the amounts in the database assume 2 decimal
+	// places, so a currency with other places needs a migration replacing them
+	for c := range places {
+		require.Equal(t, int32(2), c.Places(), c)
+	}
+}
@@ -1,15 +1,23 @@
 package router
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"regexp"
+	"net/http"
+	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/shopspring/decimal"
 
 	"github.com/lindebergue/desafio-go-stone/database"
+	"github.com/lindebergue/desafio-go-stone/document"
+	"github.com/lindebergue/desafio-go-stone/money"
 )
 
 // contextKey is the type of context keys.
@@ -18,6 +26,8 @@ type contextKey string
 // The context keys for data that transits between HTTP handlers.
 var (
 	accountContextKey contextKey = "github.com/lindebergue/desafio-go-stone/account"
+	sessionContextKey contextKey = "github.com/lindebergue/desafio-go-stone/session"
+	apiKeyContextKey  contextKey = "github.com/lindebergue/desafio-go-stone/api_key"
 )
 
 // errorResponse represents a server error response.
@@ -37,36 +47,411 @@ func ctxWithAccount(ctx context.Context, account *database.Account) context.Cont
 	return context.WithValue(ctx, accountContextKey, account)
 }
 
+// sessionFromCtx returns the session stored into a context value.
+func sessionFromCtx(ctx context.Context) (*database.Session, bool) {
+	session, ok := ctx.Value(sessionContextKey).(*database.Session)
+	return session, ok
+}
+
+// ctxWithSession returns a copy of ctx with session stored in.
+func ctxWithSession(ctx context.Context, session *database.Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey, session)
+}
+
+// apiKeyFromCtx returns the API key stored into a context value.
+func apiKeyFromCtx(ctx context.Context) (*database.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey).(*database.APIKey)
+	return key, ok
+}
+
+// ctxWithAPIKey returns a copy of ctx with key stored in.
+func ctxWithAPIKey(ctx context.Context, key *database.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey, key)
+}
+
 // errorCode represents the code of an error response.
 type errorCode string
 
 // The error codes.
 const (
-	codeMissingBearerToken      errorCode = "MISSING_BEARER_TOKEN"
-	codeInvalidBearerToken      errorCode = "INVALID_BEARER_TOKEN"
-	codeValidationError         errorCode = "VALIDATION_ERROR"
-	codeAccountAlreadyExists    errorCode = "ACCOUNT_ALREADY_EXISTS"
-	codeAccountNotFound         errorCode = "ACCOUNT_NOT_FOUND"
-	codeAccountSecretInvalid    errorCode = "ACCOUNT_SECRET_INVALID"
-	codeAccountFundsInsuficient errorCode = "ACCOUNT_FUNDS_INSUFICIENT"
+	codeMissingBearerToken         errorCode = "MISSING_BEARER_TOKEN"
+	codeInvalidBearerToken         errorCode = "INVALID_BEARER_TOKEN"
+	codeInvalidRefreshToken        errorCode = "INVALID_REFRESH_TOKEN"
+	codeValidationError            errorCode = "VALIDATION_ERROR"
+	codeAccountAlreadyExists       errorCode = "ACCOUNT_ALREADY_EXISTS"
+	codeAccountNotFound            errorCode = "ACCOUNT_NOT_FOUND"
+	codeInvalidCredentials         errorCode = "INVALID_CREDENTIALS"
+	codeLoginTemporarilyLocked     errorCode = "LOGIN_TEMPORARILY_LOCKED"
+	codeSessionRequired            errorCode = "SESSION_REQUIRED"
+	codeInsufficientScope          errorCode = "INSUFFICIENT_SCOPE"
+	codeAPIKeyNotFound             errorCode = "API_KEY_NOT_FOUND"
+	codeTOTPCodeRequired           errorCode = "TOTP_CODE_REQUIRED"
+	codeInvalidTOTPCode            errorCode = "INVALID_TOTP_CODE"
+	codeTOTPAlreadyEnabled         errorCode = "TOTP_ALREADY_ENABLED"
+	codeTOTPNotEnrolled            errorCode = "TOTP_NOT_ENROLLED"
+	codeTOTPNotConfigured          errorCode = "TOTP_NOT_CONFIGURED"
+	codeAccountFundsInsuficient    errorCode = "ACCOUNT_FUNDS_INSUFICIENT"
+	codeLimitExceeded              errorCode = "LIMIT_EXCEEDED"
+	codeSelfTransfer               errorCode = "SELF_TRANSFER"
+	codeExchangeRateNotFound       errorCode = "EXCHANGE_RATE_NOT_FOUND"
+	codeAccountFrozen              errorCode = "ACCOUNT_FROZEN"
+	codeAccountBlocked             errorCode = "ACCOUNT_BLOCKED"
+	codeAccountClosed              errorCode = "ACCOUNT_CLOSED"
+	codeAccountBalanceNotZero      errorCode = "ACCOUNT_BALANCE_NOT_ZERO"
+	codeInvalidStatusTransition    errorCode = "INVALID_STATUS_TRANSITION"
+	codeIdempotencyKeyMismatch     errorCode = "IDEMPOTENCY_KEY_MISMATCH"
+	codeIdempotencyKeyInProgress   errorCode = "IDEMPOTENCY_KEY_IN_PROGRESS"
+	codeAccessDenied               errorCode = "ACCESS_DENIED"
+	codeTransferNotFound           errorCode = "TRANSFER_NOT_FOUND"
+	codeTransferAlreadyReversed    errorCode = "TRANSFER_ALREADY_REVERSED"
+	codeTransferNotReversible      errorCode = "TRANSFER_NOT_REVERSIBLE"
+	codeReversalAmountExceeded     errorCode = "REVERSAL_AMOUNT_EXCEEDED"
+	codeScheduledTransferNotFound  errorCode = "SCHEDULED_TRANSFER_NOT_FOUND"
+	codeScheduledTransferNotActive errorCode = "SCHEDULED_TRANSFER_NOT_ACTIVE"
 )
 
-// balanceResponse represents the response of an account balance.
+// balanceResponse represents the response of an account balance. Balance is
+// the balance in money.DefaultCurrency, which is also the first of Wallets,
+// and is kept for compatibility. LedgerBalance is the sum of the ledger
+// entries in money.DefaultCurrency, and AvailableBalance adds the credit line
+// of the account to its balance.
 type balanceResponse struct {
-	Balance decimal.Decimal `json:"balance"`
+	Balance          decimal.Decimal    `json:"balance"`
+	LedgerBalance    decimal.Decimal    `json:"ledger_balance"`
+	AvailableBalance decimal.Decimal    `json:"available_balance"`
+	CreditLimit      decimal.Decimal    `json:"credit_limit"`
+	Wallets          []*database.Wallet `json:"wallets"`
+}
+
+// transferLimitChange represents a requested change of a transfer limit and
+// when it comes into effect.
+type transferLimitChange struct {
+	*database.TransferLimit
+	EffectiveAt time.Time `json:"effective_at"`
+}
+
+// transferLimitsResponse represents the transfer limits of an account. Limits
+// are the limits in effect, and Pending the increases waiting for their
+// cooling-off period.
+type transferLimitsResponse struct {
+	Limits  []*database.TransferLimit `json:"limits"`
+	Pending []*transferLimitChange    `json:"pending"`
+}
+
+// directoryEntry represents an account in the public directory, exposing only
+// what is needed to identify the destination of a transfer.
+type directoryEntry struct {
+	ID   int64                `json:"id"`
+	Name string               `json:"name"`
+	Type database.AccountType `json:"type"`
+	CPF  string               `json:"cpf,omitempty"`
+	CNPJ string               `json:"cnpj,omitempty"`
+}
+
+// newDirectoryEntry returns the directory entry of account. CPFs are masked,
+// while CNPJs are public records and are shown in full.
+func newDirectoryEntry(account *database.Account) *directoryEntry {
+	entry := &directoryEntry{
+		ID:   account.ID,
+		Name: account.Name,
+		Type: account.Type,
+		CNPJ: account.CNPJ,
+	}
+	if account.CPF != "" {
+		entry.CPF = document.MaskCPF(account.CPF)
+	}
+	return entry
+}
+
+// accountsResponse represents a page of the account directory.
+type accountsResponse struct {
+	Accounts   []*directoryEntry `json:"accounts"`
+	NextCursor string            `json:"next_cursor,omitempty"`
 }
 
-// authResponse represents the response of a successful login.
+// transfersResponse represents a page of the transfers of an account.
+type transfersResponse struct {
+	Transfers  []*database.Transfer `json:"transfers"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+}
+
+// authResponse represents the response of a successful login or session
+// refresh. ExpiresIn is the number of seconds the access token is valid for.
 type authResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// apiKeyResponse represents the response of an API key creation. The key is
+// only shown once.
+type apiKeyResponse struct {
+	*database.APIKey
+	Key string `json:"key"`
+}
+
+// totpEnrollmentResponse represents the response of a TOTP enrollment. The
+// secret and the recovery codes are only shown once.
+type totpEnrollmentResponse struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// The limits for the number of items in a page of a listing.
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// parseAccountFilter parses the account filter from the query string of a HTTP
+// request.
+func parseAccountFilter(r *http.Request) (*database.AccountFilter, *errorResponse) {
+	query := r.URL.Query()
+	filter := &database.AccountFilter{
+		NamePrefix: query.Get("name"),
+		Sort:       database.AccountSortCreatedAt,
+	}
+
+	var msgs []string
+	limit, ok := parsePageLimit(query.Get("limit"))
+	if !ok {
+		msgs = append(msgs, fmt.Sprintf("limit must be between 1 and %d", maxPageLimit))
+	}
+	filter.Limit = limit
+
+	sort := query.Get("sort")
+	if strings.HasPrefix(sort, "-") {
+		filter.Descending = true
+		sort = sort[1:]
+	}
+	switch v := database.AccountSort(sort); v {
+	case "":
+	case database.AccountSortCreatedAt, database.AccountSortName:
+		filter.Sort = v
+	default:
+		msgs = append(msgs, "sort is not valid")
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := decodeAccountCursor(filter.Sort, v)
+		if err != nil {
+			msgs = append(msgs, "cursor is not valid")
+		}
+		filter.After = cursor
+	}
+
+	if len(msgs) > 0 {
+		return nil, &errorResponse{
+			Code:    codeValidationError,
+			Details: strings.Join(msgs, ";"),
+		}
+	}
+	return filter, nil
+}
+
+// parseTransferFilter parses the transfer filter from the query string of a
+// HTTP request.
+func parseTransferFilter(r *http.Request) (*database.TransferFilter, *errorResponse) {
+	query := r.URL.Query()
+	filter := &database.TransferFilter{}
+
+	var msgs []string
+	limit, ok := parsePageLimit(query.Get("limit"))
+	if !ok {
+		msgs = append(msgs, fmt.Sprintf("limit must be between 1 and %d", maxPageLimit))
+	}
+	filter.Limit = limit
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := decodeTransferCursor(v)
+		if err != nil {
+			msgs = append(msgs, "cursor is not valid")
+		}
+		filter.After = cursor
+	}
+	switch v := database.TransferDirection(query.Get("direction")); v {
+	case "", database.TransferDirectionSent, database.TransferDirectionReceived:
+		filter.Direction = v
+	default:
+		msgs = append(msgs, "direction is not valid")
+	}
+	for _, p := range []struct {
+		name string
+		dest *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if v := query.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf("%s is not valid", p.name))
+			}
+			*p.dest = t
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dest *decimal.NullDecimal
+	}{{"min_amount", &filter.MinAmount}, {"max_amount", &filter.MaxAmount}} {
+		if v := query.Get(p.name); v != "" {
+			d, err := decimal.NewFromString(v)
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf("%s is not valid", p.name))
+			}
+			*p.dest = decimal.NullDecimal{Decimal: d, Valid: true}
+		}
+	}
+
+	if len(msgs) > 0 {
+		return nil, &errorResponse{
+			Code:    codeValidationError,
+			Details: strings.Join(msgs, ";"),
+		}
+	}
+	return filter, nil
+}
+
+// parsePageLimit parses the number of items in a page of a listing. Returns
+// the default limit if s is empty.
+func parsePageLimit(s string) (int, bool) {
+	if s == "" {
+		return defaultPageLimit, true
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return 0, false
+	}
+	return limit, true
+}
+
+// encodeCursor encodes the position of an item in a listing into an opaque
+// string. The position is given by the value of the item in the field the
+// listing is ordered by, and its ID for breaking ties.
+func encodeCursor(value string, id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value + "," + strconv.FormatInt(id, 10)))
+}
+
+// decodeCursor decodes a cursor encoded by encodeCursor.
+func decodeCursor(s string) (value string, id int64, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return "", 0, err
+	}
+
+	n := bytes.LastIndexByte(data, ',')
+	if n < 0 {
+		return "", 0, errors.New("malformed cursor")
+	}
+
+	id, err = strconv.ParseInt(string(data[n+1:]), 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(data[:n]), id, nil
+}
+
+// encodeTransferCursor encodes a transfer cursor into an opaque string.
+func encodeTransferCursor(cursor *database.TransferCursor) string {
+	return encodeCursor(cursor.CreatedAt.Format(time.RFC3339Nano), cursor.ID)
+}
+
+// decodeTransferCursor decodes a transfer cursor encoded by
+// encodeTransferCursor.
+func decodeTransferCursor(s string) (*database.TransferCursor, error) {
+	value, id, err := decodeCursor(s)
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &database.TransferCursor{CreatedAt: createdAt, ID: id}, nil
+}
+
+// encodeAccountCursor encodes the position of an account in a listing with
+// given order into an opaque string.
+func encodeAccountCursor(sort database.AccountSort, account *database.Account) string {
+	if sort == database.AccountSortName {
+		return encodeCursor(account.Name, account.ID)
+	}
+	return encodeCursor(account.CreatedAt.Format(time.RFC3339Nano), account.ID)
+}
+
+// decodeAccountCursor decodes an account cursor encoded by
+// encodeAccountCursor.
+func decodeAccountCursor(sort database.AccountSort, s string) (*database.AccountCursor, error) {
+	value, id, err := decodeCursor(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if sort == database.AccountSortName {
+		return &database.AccountCursor{Name: value, ID: id}, nil
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil, err
+	}
+	return &database.AccountCursor{CreatedAt: createdAt, ID: id}, nil
 }
 
 var validate = validator.New()
 
 func init() {
 	validate.RegisterValidation("cpf", func(fl validator.FieldLevel) bool {
-		return regexp.MustCompile(`\d{3}\.\d{3}\.\d{3}\-\d{2}`).MatchString(fl.Field().String())
+		return document.ValidCPF(fl.Field().String())
 	})
+	validate.RegisterValidation("cnpj", func(fl validator.FieldLevel) bool {
+		return document.ValidCNPJ(fl.Field().String())
+	})
+	validate.RegisterValidation("currency", func(fl validator.FieldLevel) bool {
+		return money.Currency(fl.Field().String()).Valid()
+	})
+	// decimals are validated by their string representation, otherwise the
+	// validator would look into the fields of the decimal struct
+	validate.RegisterCustomTypeFunc(func(v reflect.Value) interface{} {
+		return v.Interface().(decimal.Decimal).String()
+	}, decimal.Decimal{})
+	validate.RegisterValidation("positive", func(fl validator.FieldLevel) bool {
+		d, err := decimal.NewFromString(fl.Field().String())
+		return err == nil && d.IsPositive()
+	})
+	validate.RegisterValidation("precision", func(fl validator.FieldLevel) bool {
+		d, err := decimal.NewFromString(fl.Field().String())
+		return err == nil && !errors.Is(money.ValidateAmount(d, money.DefaultCurrency), money.ErrAmountPrecision)
+	})
+}
+
+// accountTypeOf returns the type of the account identified by the documents of
+// a request body, which must have either a CPF or a CNPJ.
+func accountTypeOf(cpf, cnpj string) (database.AccountType, *errorResponse) {
+	if (cpf == "") == (cnpj == "") {
+		return "", &errorResponse{
+			Code:    codeValidationError,
+			Details: "either cpf or cnpj is required",
+		}
+	}
+	if cnpj != "" {
+		return database.AccountBusiness, nil
+	}
+	return database.AccountIndividual, nil
+}
+
+// accountStatusErrorCode returns the error code of the errors returned by the
+// database when the status of an account prevents an operation, or an empty
+// code for any other error.
+func accountStatusErrorCode(err error) errorCode {
+	switch {
+	case errors.Is(err, database.ErrAccountFrozen):
+		return codeAccountFrozen
+	case errors.Is(err, database.ErrAccountBlocked):
+		return codeAccountBlocked
+	case errors.Is(err, database.ErrAccountClosed):
+		return codeAccountClosed
+	}
+	return ""
 }
 
 // validateBody validates the body of a HTTP request.
@@ -83,6 +468,12 @@ func validateBody(data interface{}) *errorResponse {
 			msgs = append(msgs, fmt.Sprintf("%s is required", strings.ToLower(ve.Field())))
 		case "min":
 			msgs = append(msgs, fmt.Sprintf("%s must have at least %s characters", strings.ToLower(ve.Field()), ve.Param()))
+		case "positive":
+			msgs = append(msgs, fmt.Sprintf("%s must be positive", strings.ToLower(ve.Field())))
+		case "precision":
+			msgs = append(msgs, fmt.Sprintf("%s must have at most %d decimal places", strings.ToLower(ve.Field()), money.DefaultCurrency.Places()))
+		case "currency":
+			msgs = append(msgs, fmt.Sprintf("%s is not supported", strings.ToLower(ve.Field())))
 		default:
 			msgs = append(msgs, fmt.Sprintf("%s is not valid", strings.ToLower(ve.Field())))
 		}
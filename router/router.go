@@ -2,13 +2,20 @@
 package router
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -16,43 +23,160 @@ import (
 
 	"github.com/lindebergue/desafio-go-stone/auth"
 	"github.com/lindebergue/desafio-go-stone/database"
+	"github.com/lindebergue/desafio-go-stone/document"
+	"github.com/lindebergue/desafio-go-stone/money"
 )
 
 // Options contains the options for creating a router.
 type Options struct {
-	DB        database.DB
-	JWTSecret []byte
+	DB database.DB
+
+	// JWTKeys holds the keys for signing and verifying the access tokens.
+	JWTKeys *auth.KeySet
+
+	// RequestTimeout is the maximum duration of the database queries of a
+	// request. Zero means no timeout.
+	RequestTimeout time.Duration
+
+	// PasswordHasher hashes the secrets of the accounts. Secrets hashed with
+	// other algorithms or weaker parameters are rehashed on login. Defaults to
+	// auth.DefaultPasswordHasher.
+	PasswordHasher auth.PasswordHasher
+
+	// TOTPKey is the AES key for encrypting the TOTP secrets of the accounts
+	// and hashing their recovery codes. Without it, accounts cannot enroll
+	// TOTP.
+	TOTPKey []byte
+
+	// TOTPTransferThreshold is the amount in money.DefaultCurrency above which
+	// transfers and withdrawals of accounts with TOTP enabled require a TOTP code.
+	TOTPTransferThreshold decimal.Decimal
+
+	// TrustedProxies are the networks of the proxies whose X-Forwarded-For
+	// and X-Real-IP headers are trusted to identify the client of a request.
+	// Requests from other addresses are identified by their peer address.
+	TrustedProxies []*net.IPNet
+
+	// Now returns the current time used for throttling logins, validating
+	// TOTP codes and checking the start of scheduled transfers. Defaults to
+	// time.Now.
+	Now func() time.Time
 }
 
 // New returns a new router with given opts.
 func New(opts Options) http.Handler {
 	h := &handler{
-		db:        opts.DB,
-		jwtSecret: opts.JWTSecret,
+		db:                    opts.DB,
+		jwtKeys:               opts.JWTKeys,
+		passwordHasher:        opts.PasswordHasher,
+		totpKey:               opts.TOTPKey,
+		totpTransferThreshold: opts.TOTPTransferThreshold,
+		trustedProxies:        opts.TrustedProxies,
+		now:                   opts.Now,
+	}
+	if h.passwordHasher == nil {
+		h.passwordHasher = auth.DefaultPasswordHasher
 	}
+	if h.now == nil {
+		h.now = time.Now
+	}
+
+	// logins into accounts that do not exist compare the secret with a hash
+	// of the configured hasher, so they take as long as the other logins
+	dummySecretHash, err := h.passwordHasher.Hash("dummy secret")
+	if err != nil {
+		panic(err)
+	}
+	h.dummySecretHash = dummySecretHash
 
 	r := chi.NewRouter()
-	r.Use(middleware.Recoverer, middleware.RealIP, middleware.Logger)
+	r.Use(middleware.Recoverer, middleware.Logger)
+	if opts.RequestTimeout > 0 {
+		r.Use(withTimeout(opts.RequestTimeout))
+	}
 
 	r.Get("/accounts", h.getAccounts)
-	r.Get("/accounts/{account_id}/balance", h.getAccountBalance)
 	r.Post("/accounts", h.createAccount)
 	r.Post("/login", h.login)
+	r.Post("/token/refresh", h.refreshToken)
+	r.Get("/.well-known/jwks.json", h.getJWKS)
+	r.Get("/exchange-rates", h.getExchangeRates)
+	r.Get("/fee-schedules", h.getFeeSchedules)
 
 	r.Group(func(r chi.Router) {
 		r.Use(h.requireLogin)
 
-		r.Get("/transfers", h.getTransfers)
-		r.Post("/transfers", h.createTransfer)
+		// routes also available to API keys with the required scope
+		r.With(requireScope(database.ScopeReadBalance)).Get("/me", h.getMe)
+		r.With(requireScope(database.ScopeReadBalance)).Get("/accounts/{account_id}/balance", h.getAccountBalance)
+		r.With(requireScope(database.ScopeReadTransfers)).Get("/transfers", h.getTransfers)
+		r.With(requireScope(database.ScopeWriteTransfers), h.idempotent).Post("/transfers", h.createTransfer)
+		r.With(requireScope(database.ScopeReadBalance)).Get("/ledger", h.getLedgerEntries)
+		r.With(requireScope(database.ScopeReadBalance)).Get("/cash-movements", h.getCashMovements)
+		r.With(requireScope(database.ScopeReadBalance)).Get("/limits", h.getTransferLimits)
+		r.With(requireScope(database.ScopeReadTransfers)).Get("/scheduled-transfers", h.getScheduledTransfers)
+		r.With(requireScope(database.ScopeWriteTransfers)).Post("/scheduled-transfers", h.createScheduledTransfer)
+		r.With(requireScope(database.ScopeWriteTransfers)).Delete("/scheduled-transfers/{scheduled_transfer_id}", h.cancelScheduledTransfer)
+		r.With(requireScope(database.ScopeReadTransfers)).Get("/scheduled-transfers/{scheduled_transfer_id}/executions", h.getScheduledTransferExecutions)
+
+		r.Group(func(r chi.Router) {
+			r.Use(requireSession)
+
+			r.Post("/logout", h.logout)
+			r.Put("/secret", h.changeSecret)
+			r.Post("/totp", h.enrollTOTP)
+			r.Post("/totp/confirm", h.confirmTOTP)
+			r.Delete("/totp", h.disableTOTP)
+			r.Get("/api-keys", h.getAPIKeys)
+			r.Post("/api-keys", h.createAPIKey)
+			r.Delete("/api-keys/{api_key_id}", h.revokeAPIKey)
+			r.Put("/limits", h.changeTransferLimit)
+			r.Post("/withdrawals", h.createWithdrawal)
+			r.Post("/me/close", h.closeAccount)
+
+			r.With(requireRole(database.RoleOperator)).Post("/deposits", h.createDeposit)
+			r.With(requireRole(database.RoleOperator), h.idempotent).Post("/transfers/{transfer_id}/reversal", h.createReversal)
+			r.With(requireRole(database.RoleAdmin)).Put("/admin/exchange-rates", h.adminSetExchangeRate)
+			r.With(requireRole(database.RoleAdmin)).Put("/admin/fee-schedules", h.adminSetFeeSchedule)
+
+			r.Route("/admin/accounts/{account_id}", func(r chi.Router) {
+				r.Use(requireRole(database.RoleSupport, database.RoleAdmin))
+
+				r.Get("/", h.adminGetAccount)
+				r.Get("/transfers", h.adminGetTransfers)
+				r.Get("/audit-events", h.adminGetAuditEvents)
+				r.With(requireRole(database.RoleAdmin)).Put("/status", h.adminSetAccountStatus)
+				r.With(requireRole(database.RoleAdmin)).Post("/close", h.adminCloseAccount)
+				r.With(requireRole(database.RoleAdmin)).Put("/credit-line", h.adminSetCreditLine)
+			})
+		})
 	})
 
 	return r
 }
 
+// withTimeout returns a middleware that cancels the context of requests running
+// for longer than timeout, aborting their database queries.
+func withTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 // handler implements the HTTP handlers for the server routes.
 type handler struct {
-	db        database.DB
-	jwtSecret []byte
+	db                    database.DB
+	jwtKeys               *auth.KeySet
+	passwordHasher        auth.PasswordHasher
+	dummySecretHash       string
+	totpKey               []byte
+	totpTransferThreshold decimal.Decimal
+	trustedProxies        []*net.IPNet
+	now                   func() time.Time
 }
 
 func (h *handler) requireLogin(next http.Handler) http.Handler {
@@ -68,13 +192,50 @@ func (h *handler) requireLogin(next http.Handler) http.Handler {
 			return
 		}
 
-		accountID, err := auth.DecodeToken(h.jwtSecret, token)
-		if err != nil {
-			renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeInvalidBearerToken})
-			return
+		// the bearer token is either an API key or the access token of a
+		// session
+		var (
+			accountID int64
+			apiKey    *database.APIKey
+			session   *database.Session
+			claims    *auth.Claims
+		)
+		if strings.HasPrefix(token, auth.APIKeyPrefix) {
+			key, err := h.db.FindAPIKeyByHash(r.Context(), auth.HashAPIKey(token))
+			if err != nil {
+				if errors.Is(err, database.ErrAPIKeyNotFound) {
+					renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeInvalidBearerToken})
+					return
+				}
+				renderServerError(w, "error finding api key from bearer token: %v", err)
+				return
+			}
+			accountID, apiKey = key.AccountID, key
+		} else {
+			c, err := auth.DecodeToken(h.jwtKeys, token)
+			if err != nil {
+				renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeInvalidBearerToken})
+				return
+			}
+
+			// tokens of sessions that were refreshed or revoked are rejected
+			s, err := h.db.FindSessionByTokenID(r.Context(), c.TokenID)
+			if err != nil {
+				if errors.Is(err, database.ErrSessionNotFound) {
+					renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeInvalidBearerToken})
+					return
+				}
+				renderServerError(w, "error finding session from bearer token: %v", err)
+				return
+			}
+			if s.AccountID != c.AccountID {
+				renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeInvalidBearerToken})
+				return
+			}
+			accountID, session, claims = c.AccountID, s, c
 		}
 
-		account, err := h.db.FindAccountByID(accountID)
+		account, err := h.db.FindAccountByID(r.Context(), accountID)
 		if err != nil {
 			if errors.Is(err, database.ErrAccountNotFound) {
 				renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeInvalidBearerToken})
@@ -84,28 +245,242 @@ func (h *handler) requireLogin(next http.Handler) http.Handler {
 			return
 		}
 
+		// tokens issued before a role change are rejected, so the role claim
+		// is always the current role of the account
+		if claims != nil && claims.Role != string(account.Role) {
+			renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeInvalidBearerToken})
+			return
+		}
+		if code := loginStatusErrorCode(account); code != "" {
+			renderJSON(w, http.StatusForbidden, &errorResponse{Code: code})
+			return
+		}
+
 		ctx := ctxWithAccount(r.Context(), account)
+		if apiKey != nil {
+			ctx = ctxWithAPIKey(ctx, apiKey)
+		} else {
+			ctx = ctxWithSession(ctx, session)
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// requireSession only allows requests authenticated by the access token of a
+// session, rejecting API keys. Must be used after requireLogin.
+func requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := sessionFromCtx(r.Context()); !ok {
+			renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeSessionRequired})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireScope returns a middleware that only allows requests authenticated
+// by sessions or by API keys with scope. Must be used after requireLogin.
+func requireScope(scope database.APIKeyScope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key, ok := apiKeyFromCtx(r.Context()); ok && !key.HasScope(scope) {
+				renderJSON(w, http.StatusForbidden, &errorResponse{
+					Code:    codeInsufficientScope,
+					Details: fmt.Sprintf("api key requires the %s scope", scope),
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireRole returns a middleware that only allows requests from accounts
+// with one of roles. Must be used after requireLogin.
+func requireRole(roles ...database.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			account, ok := accountFromCtx(r.Context())
+			if !ok {
+				renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+				return
+			}
+
+			for _, role := range roles {
+				if account.Role == role {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeAccessDenied})
+		})
+	}
+}
+
+// idempotent makes a route safe for retries when the client sends an
+// Idempotency-Key header. The first request with a key is handled normally and
+// its response is stored, so any replay renders the stored response instead of
+// handling the request again. Replays with a different request body are
+// rejected. Keys expire as described by database.IdempotencyKeyLockTimeout
+// and database.IdempotencyKeyRetention.
+func (h *handler) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeySize {
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{
+				Code:    codeValidationError,
+				Details: fmt.Sprintf("idempotency key must have at most %d characters", maxIdempotencyKeySize),
+			})
+			return
+		}
+
+		account, ok := accountFromCtx(r.Context())
+		if !ok {
+			renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		idempotencyKey := &database.IdempotencyKey{
+			AccountID:   account.ID,
+			Key:         key,
+			Fingerprint: fingerprintRequest(r, body),
+		}
+		if err := h.db.CreateIdempotencyKey(r.Context(), idempotencyKey); err != nil {
+			if errors.Is(err, database.ErrIdempotencyKeyAlreadyExists) {
+				h.replayIdempotencyKey(w, r, idempotencyKey)
+				return
+			}
+			renderServerError(w, "error creating idempotency key: %v", err)
+			return
+		}
+
+		// a panic leaves no response to store, so the key is released before
+		// the panic reaches the recoverer
+		defer func() {
+			if p := recover(); p != nil {
+				if err := h.db.DeleteIdempotencyKey(context.Background(), account.ID, key); err != nil {
+					log.Printf("error deleting idempotency key: %v", err)
+				}
+				panic(p)
+			}
+		}()
+
+		rec := newResponseBuffer()
+		next.ServeHTTP(rec, r)
+
+		// server errors are not stored so the client is able to retry the
+		// request with the same key
+		if rec.Code >= http.StatusInternalServerError {
+			if err := h.db.DeleteIdempotencyKey(r.Context(), account.ID, key); err != nil {
+				log.Printf("error deleting idempotency key: %v", err)
+			}
+		} else {
+			// the request already took effect, so its response is rendered
+			// anyway; the key stays in progress until it expires
+			idempotencyKey.StatusCode = rec.Code
+			idempotencyKey.Response = rec.Body.Bytes()
+			if err := h.db.UpdateIdempotencyKey(r.Context(), idempotencyKey); err != nil {
+				log.Printf("error updating idempotency key: %v", err)
+			}
+		}
+
+		rec.flush(w)
+	})
+}
+
+// replayIdempotencyKey renders the stored response of a request that used the
+// same idempotency key as the current one.
+func (h *handler) replayIdempotencyKey(w http.ResponseWriter, r *http.Request, current *database.IdempotencyKey) {
+	stored, err := h.db.FindIdempotencyKey(r.Context(), current.AccountID, current.Key)
+	if err != nil {
+		renderServerError(w, "error finding idempotency key: %v", err)
+		return
+	}
+
+	switch {
+	case stored.Fingerprint != current.Fingerprint:
+		renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeIdempotencyKeyMismatch})
+	case stored.StatusCode == 0:
+		renderJSON(w, http.StatusConflict, &errorResponse{Code: codeIdempotencyKeyInProgress})
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(stored.StatusCode)
+		w.Write(stored.Response)
+	}
+}
+
 func (h *handler) getAccounts(w http.ResponseWriter, r *http.Request) {
-	accounts, err := h.db.FindAllAccounts()
+	filter, res := parseAccountFilter(r)
+	if res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	// fetch one more account than requested to know if there is a next page
+	limit := filter.Limit
+	filter.Limit = limit + 1
+
+	accounts, err := h.db.FindAccounts(r.Context(), filter)
 	if err != nil {
-		renderServerError(w, "error finding all accounts: %v", err)
+		renderServerError(w, "error finding accounts: %v", err)
+		return
+	}
+
+	body := &accountsResponse{Accounts: []*directoryEntry{}}
+	if len(accounts) > limit {
+		accounts = accounts[:limit]
+		body.NextCursor = encodeAccountCursor(filter.Sort, accounts[limit-1])
+	}
+	for _, account := range accounts {
+		body.Accounts = append(body.Accounts, newDirectoryEntry(account))
+	}
+
+	renderJSON(w, http.StatusOK, body)
+}
+
+func (h *handler) getMe(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
 		return
 	}
-	renderJSON(w, http.StatusOK, accounts)
+
+	renderJSON(w, http.StatusOK, account)
 }
 
 func (h *handler) getAccountBalance(w http.ResponseWriter, r *http.Request) {
+	caller, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
 	accountID, err := strconv.ParseInt(chi.URLParam(r, "account_id"), 10, 64)
 	if err != nil {
 		renderJSON(w, http.StatusNotFound, &errorResponse{Code: codeAccountNotFound})
 		return
 	}
 
-	account, err := h.db.FindAccountByID(accountID)
+	// only support staff can read the balance of other accounts, and the
+	// check comes first so the response does not reveal if they exist
+	if accountID != caller.ID && caller.Role != database.RoleSupport && caller.Role != database.RoleAdmin {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeAccessDenied})
+		return
+	}
+
+	account, err := h.db.FindAccountByID(r.Context(), accountID)
 	if err != nil {
 		if errors.Is(err, database.ErrAccountNotFound) {
 			renderJSON(w, http.StatusNotFound, &errorResponse{Code: codeAccountNotFound})
@@ -114,16 +489,35 @@ func (h *handler) getAccountBalance(w http.ResponseWriter, r *http.Request) {
 		renderServerError(w, "error finding account: %v", err)
 		return
 	}
+	ledgerBalance, err := h.db.ComputeLedgerBalance(r.Context(), accountID, money.DefaultCurrency)
+	if err != nil {
+		renderServerError(w, "error computing ledger balance: %v", err)
+		return
+	}
+	wallets, err := h.db.FindAllWalletsWithAccountID(r.Context(), accountID)
+	if err != nil {
+		renderServerError(w, "error finding account wallets: %v", err)
+		return
+	}
 
-	renderJSON(w, http.StatusOK, &balanceResponse{Balance: account.Balance})
+	// Balance and AvailableBalance come from the same read of the account,
+	// so they always agree; LedgerBalance is a separate query and may
+	// already include a transfer committed after the account was read
+	renderJSON(w, http.StatusOK, &balanceResponse{
+		Balance:          account.Balance,
+		LedgerBalance:    ledgerBalance,
+		AvailableBalance: account.AvailableBalance(),
+		CreditLimit:      account.CreditLimit,
+		Wallets:          wallets,
+	})
 }
 
 func (h *handler) createAccount(w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		Name    string          `json:"name" validate:"required"`
-		CPF     string          `json:"cpf" validate:"required,cpf"`
-		Secret  string          `json:"secret" validate:"required,min=6"`
-		Balance decimal.Decimal `json:"balance"`
+		Name   string `json:"name" validate:"required"`
+		CPF    string `json:"cpf" validate:"omitempty,cpf"`
+		CNPJ   string `json:"cnpj" validate:"omitempty,cnpj"`
+		Secret string `json:"secret" validate:"required,min=6"`
 	}
 	if err := bindJSON(r, &body); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -133,20 +527,27 @@ func (h *handler) createAccount(w http.ResponseWriter, r *http.Request) {
 		renderJSON(w, http.StatusUnprocessableEntity, res)
 		return
 	}
+	accountType, res := accountTypeOf(body.CPF, body.CNPJ)
+	if res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
 
-	hash, err := auth.HashPassword(body.Secret)
+	hash, err := h.passwordHasher.Hash(body.Secret)
 	if err != nil {
 		renderServerError(w, "error hashing account secret: %v", err)
 		return
 	}
 
 	account := &database.Account{
-		Name:    body.Name,
-		CPF:     body.CPF,
-		Secret:  hash,
-		Balance: body.Balance,
+		Name:   body.Name,
+		Type:   accountType,
+		CPF:    body.CPF,
+		CNPJ:   body.CNPJ,
+		Secret: hash,
+		Role:   database.RoleCustomer,
 	}
-	if err := h.db.CreateAccount(account); err != nil {
+	if err := h.db.CreateAccount(r.Context(), account); err != nil {
 		if errors.Is(err, database.ErrAccountAlreadyExists) {
 			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeAccountAlreadyExists})
 			return
@@ -160,39 +561,305 @@ func (h *handler) createAccount(w http.ResponseWriter, r *http.Request) {
 
 func (h *handler) login(w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		CPF    string `json:"cpf"`
-		Secret string `json:"secret"`
+		CPF          string `json:"cpf" validate:"omitempty,cpf"`
+		CNPJ         string `json:"cnpj" validate:"omitempty,cnpj"`
+		Secret       string `json:"secret" validate:"required"`
+		TOTPCode     string `json:"totp_code"`
+		RecoveryCode string `json:"recovery_code"`
 	}
 	if err := bindJSON(r, &body); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+	if _, res := accountTypeOf(body.CPF, body.CNPJ); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	doc := body.CPF
+	if doc == "" {
+		doc = body.CNPJ
+	}
 
-	account, err := h.db.FindAccountByCPF(body.CPF)
+	now := h.now()
+	throttles := []loginThrottle{
+		{key: "document:" + document.Normalize(doc), freeAttempts: loginFreeAttemptsPerDocument},
+		{key: "ip:" + h.clientIP(r), freeAttempts: loginFreeAttemptsPerIP},
+	}
+	retryAfter, err := h.reserveLoginAttempt(r.Context(), throttles, now)
 	if err != nil {
-		if errors.Is(err, database.ErrAccountNotFound) {
-			renderJSON(w, http.StatusUnauthorized, &errorResponse{Code: codeAccountNotFound})
+		renderServerError(w, "error reserving login attempt: %v", err)
+		return
+	}
+	if retryAfter > 0 {
+		renderLoginLocked(w, retryAfter)
+		return
+	}
+
+	account, err := h.db.FindAccountByDocument(r.Context(), doc)
+	if err != nil && !errors.Is(err, database.ErrAccountNotFound) {
+		renderServerError(w, "error finding account by document: %v", err)
+		return
+	}
+
+	// the secret is compared even if the account does not exist, so both
+	// cases take the same time and are indistinguishable
+	secretHash := h.dummySecretHash
+	if account != nil {
+		secretHash = account.Secret
+	}
+	if !auth.ComparePassword(secretHash, body.Secret) || account == nil {
+		renderJSON(w, http.StatusUnauthorized, &errorResponse{Code: codeInvalidCredentials})
+		return
+	}
+
+	// the status is only revealed to who knows the secret of the account
+	if code := loginStatusErrorCode(account); code != "" {
+		if err := h.releaseLoginAttempt(r.Context(), throttles, now); err != nil {
+			renderServerError(w, "error releasing login attempt: %v", err)
 			return
 		}
-		renderServerError(w, "error finding account by cpf: %v", err)
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: code})
 		return
 	}
 
-	if !auth.ComparePassword(account.Secret, body.Secret) {
-		renderJSON(w, http.StatusUnauthorized, &errorResponse{Code: codeAccountSecretInvalid})
+	if account.TOTPEnabled {
+		if body.TOTPCode == "" && body.RecoveryCode == "" {
+			if err := h.releaseLoginAttempt(r.Context(), throttles, now); err != nil {
+				renderServerError(w, "error releasing login attempt: %v", err)
+				return
+			}
+			renderJSON(w, http.StatusUnauthorized, &errorResponse{Code: codeTOTPCodeRequired})
+			return
+		}
+		ok, err := h.useSecondFactor(r.Context(), account, body.TOTPCode, body.RecoveryCode)
+		if err != nil {
+			renderServerError(w, "error verifying second factor: %v", err)
+			return
+		}
+		if !ok {
+			// wrong codes are throttled like wrong secrets, otherwise the
+			// codes could be guessed by anyone knowing the secret
+			renderJSON(w, http.StatusUnauthorized, &errorResponse{Code: codeInvalidTOTPCode})
+			return
+		}
+	}
+
+	// only the failures of the document are forgotten, otherwise an attacker
+	// could reset the throttle of its IP by logging into its own account
+	if err := h.db.DeleteLoginThrottle(r.Context(), throttles[0].key); err != nil {
+		renderServerError(w, "error deleting login throttle: %v", err)
+		return
+	}
+	if err := h.releaseLoginAttempt(r.Context(), throttles[1:], now); err != nil {
+		renderServerError(w, "error releasing login attempt: %v", err)
 		return
 	}
 
-	token, err := auth.EncodeToken(h.jwtSecret, account.ID)
+	// the secret is only known on login, so this is the only chance of
+	// upgrading its hash; failing to do so does not prevent the login
+	if h.passwordHasher.NeedsRehash(account.Secret) {
+		if err := h.rehashSecret(r.Context(), account, body.Secret); err != nil {
+			log.Printf("error rehashing secret of account %d: %v", account.ID, err)
+		}
+	}
+
+	session := &database.Session{AccountID: account.ID}
+	refreshToken, err := rotateSessionTokens(session)
 	if err != nil {
-		renderServerError(w, "error encoding authentication token: %v", err)
+		renderServerError(w, "error generating session tokens: %v", err)
 		return
 	}
+	if err := h.db.CreateSession(r.Context(), session); err != nil {
+		renderServerError(w, "error creating session: %v", err)
+		return
+	}
+	h.recordAuditEvent(r.Context(), account.ID, account.ID, database.AuditLogin, h.clientIP(r))
 
-	renderJSON(w, http.StatusOK, &authResponse{Token: token})
+	h.renderSessionTokens(w, session, account.Role, refreshToken)
 }
 
-func (h *handler) createTransfer(w http.ResponseWriter, r *http.Request) {
+// The policy for throttling failed logins. After the free attempts, each
+// failure locks the login for twice as long as the previous one, up to
+// loginMaxLockout. Failures are forgotten after loginFailureWindow without
+// new failures.
+const (
+	loginFreeAttemptsPerDocument = 3
+	loginFreeAttemptsPerIP       = 20
+	loginMaxLockout              = 15 * time.Minute
+	loginFailureWindow           = time.Hour
+)
+
+// loginThrottle identifies the failed logins tracked for a document or an IP.
+// previous holds the failures before the attempt reserved for it.
+type loginThrottle struct {
+	key          string
+	freeAttempts int
+	previous     *database.LoginThrottle
+}
+
+// loginLockout returns for how long the login is locked after the last of
+// failures, given the number of attempts allowed without delay.
+func loginLockout(failures, freeAttempts int) time.Duration {
+	if failures <= freeAttempts {
+		return 0
+	}
+	exp := failures - freeAttempts - 1
+	if exp >= 10 {
+		return loginMaxLockout
+	}
+	if d := time.Second << exp; d < loginMaxLockout {
+		return d
+	}
+	return loginMaxLockout
+}
+
+// reserveLoginAttempt counts a login attempt made at now as a failure for each
+// of throttles before verifying it, so concurrent guesses cannot all get past
+// the throttles. Returns for how long the login is locked instead, without
+// counting the attempt, or zero if it is allowed.
+func (h *handler) reserveLoginAttempt(ctx context.Context, throttles []loginThrottle, now time.Time) (time.Duration, error) {
+	for n := range throttles {
+		t := &throttles[n]
+		lockout := func(failures int) time.Duration {
+			return loginLockout(failures, t.freeAttempts)
+		}
+		previous, err := h.db.ReserveLoginAttempt(ctx, t.key, now, loginFailureWindow, lockout)
+		if err != nil {
+			// the attempts already reserved are not failures if the login
+			// does not go on
+			if err := h.releaseLoginAttempt(ctx, throttles[:n], now); err != nil {
+				return 0, err
+			}
+			if errors.Is(err, database.ErrLoginLocked) {
+				return previous.LastFailureAt.Add(lockout(previous.Failures)).Sub(now), nil
+			}
+			return 0, err
+		}
+		t.previous = previous
+	}
+	return 0, nil
+}
+
+// renderLoginLocked renders the response of a login locked for retryAfter.
+func renderLoginLocked(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10))
+	renderJSON(w, http.StatusTooManyRequests, &errorResponse{Code: codeLoginTemporarilyLocked})
+}
+
+// releaseLoginAttempt uncounts the attempt reserved for each of throttles at
+// now, once it turns out not to be a failure.
+func (h *handler) releaseLoginAttempt(ctx context.Context, throttles []loginThrottle, now time.Time) error {
+	for _, t := range throttles {
+		if err := h.db.ReleaseLoginAttempt(ctx, t.key, now, t.previous); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientIP returns the IP address of the client of r. The forwarding headers
+// are only read when the peer is a trusted proxy, and X-Forwarded-For is read
+// from the right, since the addresses on its left are set by the client.
+func (h *handler) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !h.trustedProxy(ip) {
+		return ip
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if net.ParseIP(addr) == nil {
+				break
+			}
+			ip = addr
+			if !h.trustedProxy(addr) {
+				break
+			}
+		}
+		return ip
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return ip
+}
+
+// trustedProxy reports whether ip belongs to one of the trusted proxies.
+func (h *handler) trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range h.trustedProxies {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// rehashSecret replaces the secret hash of account by a hash of secret
+// produced by the configured hasher.
+func (h *handler) rehashSecret(ctx context.Context, account *database.Account, secret string) error {
+	hash, err := h.passwordHasher.Hash(secret)
+	if err != nil {
+		return err
+	}
+	return h.db.RehashAccountSecret(ctx, account.ID, account.Secret, hash)
+}
+
+// loginStatusErrorCode returns the error code of the status preventing account
+// from logging in, or an empty code if it can log in.
+func loginStatusErrorCode(account *database.Account) errorCode {
+	switch account.Status {
+	case database.AccountBlocked:
+		return codeAccountBlocked
+	case database.AccountClosed:
+		return codeAccountClosed
+	}
+	return ""
+}
+
+// checkCurrentSecret verifies secret against the secret of account, rendering
+// an error response and returning false if it does not match. Guesses are
+// throttled like logins, so a stolen access token cannot be used for finding
+// out the secret.
+func (h *handler) checkCurrentSecret(w http.ResponseWriter, r *http.Request, account *database.Account, secret string) bool {
+	now := h.now()
+	throttles := []loginThrottle{
+		{key: "document:" + account.Document(), freeAttempts: loginFreeAttemptsPerDocument},
+	}
+	retryAfter, err := h.reserveLoginAttempt(r.Context(), throttles, now)
+	if err != nil {
+		renderServerError(w, "error reserving login attempt: %v", err)
+		return false
+	}
+	if retryAfter > 0 {
+		renderLoginLocked(w, retryAfter)
+		return false
+	}
+
+	if !auth.ComparePassword(account.Secret, secret) {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeInvalidCredentials})
+		return false
+	}
+	if err := h.releaseLoginAttempt(r.Context(), throttles, now); err != nil {
+		renderServerError(w, "error releasing login attempt: %v", err)
+		return false
+	}
+	return true
+}
+
+func (h *handler) changeSecret(w http.ResponseWriter, r *http.Request) {
 	account, ok := accountFromCtx(r.Context())
 	if !ok {
 		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
@@ -200,8 +867,8 @@ func (h *handler) createTransfer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var body struct {
-		AccountDestinationID int64           `json:"account_destination_id" validate:"required"`
-		Amount               decimal.Decimal `json:"amount" validate:"required"`
+		CurrentSecret string `json:"current_secret" validate:"required"`
+		NewSecret     string `json:"new_secret" validate:"required,min=6"`
 	}
 	if err := bindJSON(r, &body); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -212,51 +879,1075 @@ func (h *handler) createTransfer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	transfer := &database.Transfer{
-		AccountOriginID:      account.ID,
-		AccountDestinationID: body.AccountDestinationID,
-		Amount:               body.Amount,
+	if !h.checkCurrentSecret(w, r, account, body.CurrentSecret) {
+		return
 	}
-	if err := h.db.CreateTransfer(transfer); err != nil {
-		switch {
-		case errors.Is(err, database.ErrAccountNotFound):
-			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeAccountNotFound})
-			return
-		case errors.Is(err, database.ErrNotEnoughFunds):
-			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeAccountFundsInsuficient})
-			return
-		default:
-			renderServerError(w, "error creating transfer: %v", err)
-			return
-		}
+
+	hash, err := h.passwordHasher.Hash(body.NewSecret)
+	if err != nil {
+		renderServerError(w, "error hashing secret: %v", err)
+		return
+	}
+	if err := h.db.ChangeAccountSecret(r.Context(), account.ID, hash); err != nil {
+		renderServerError(w, "error changing secret: %v", err)
+		return
 	}
+	h.recordAuditEvent(r.Context(), account.ID, account.ID, database.AuditSecretChanged, "")
 
-	renderJSON(w, http.StatusCreated, transfer)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (h *handler) getTransfers(w http.ResponseWriter, r *http.Request) {
+func (h *handler) getAPIKeys(w http.ResponseWriter, r *http.Request) {
 	account, ok := accountFromCtx(r.Context())
 	if !ok {
 		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
 		return
 	}
 
-	transfers, err := h.db.FindAllTransfersWithAccountID(account.ID)
+	keys, err := h.db.FindAllAPIKeysWithAccountID(r.Context(), account.ID)
 	if err != nil {
-		renderServerError(w, "error finding account transfers: %v", err)
+		renderServerError(w, "error finding api keys: %v", err)
 		return
 	}
+	if keys == nil {
+		keys = []*database.APIKey{}
+	}
 
-	renderJSON(w, http.StatusOK, transfers)
+	renderJSON(w, http.StatusOK, keys)
 }
 
-// bindJSON binds JSON encoded data from a HTTP request into the value pointed
+func (h *handler) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	var body struct {
+		Name   string                 `json:"name" validate:"required"`
+		Scopes []database.APIKeyScope `json:"scopes" validate:"required,dive,oneof=read:balance read:transfers write:transfers"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+	if len(body.Scopes) == 0 {
+		renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{
+			Code:    codeValidationError,
+			Details: "scopes is required",
+		})
+		return
+	}
+
+	secret, err := auth.NewAPIKey()
+	if err != nil {
+		renderServerError(w, "error generating api key: %v", err)
+		return
+	}
+
+	key := &database.APIKey{
+		AccountID: account.ID,
+		Name:      body.Name,
+		Prefix:    secret[:len(auth.APIKeyPrefix)+6],
+		Hash:      auth.HashAPIKey(secret),
+		Scopes:    body.Scopes,
+	}
+	if err := h.db.CreateAPIKey(r.Context(), key); err != nil {
+		renderServerError(w, "error creating api key: %v", err)
+		return
+	}
+	h.recordAuditEvent(r.Context(), account.ID, account.ID, database.AuditAPIKeyCreated, key.Prefix)
+
+	renderJSON(w, http.StatusCreated, &apiKeyResponse{APIKey: key, Key: secret})
+}
+
+func (h *handler) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "api_key_id"), 10, 64)
+	if err != nil {
+		renderJSON(w, http.StatusNotFound, &errorResponse{Code: codeAPIKeyNotFound})
+		return
+	}
+
+	if err := h.db.RevokeAPIKey(r.Context(), account.ID, id); err != nil {
+		if errors.Is(err, database.ErrAPIKeyNotFound) {
+			renderJSON(w, http.StatusNotFound, &errorResponse{Code: codeAPIKeyNotFound})
+			return
+		}
+		renderServerError(w, "error revoking api key: %v", err)
+		return
+	}
+	h.recordAuditEvent(r.Context(), account.ID, account.ID, database.AuditAPIKeyRevoked, strconv.FormatInt(id, 10))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	if len(h.totpKey) == 0 {
+		renderJSON(w, http.StatusNotImplemented, &errorResponse{Code: codeTOTPNotConfigured})
+		return
+	}
+	if account.TOTPEnabled {
+		renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeTOTPAlreadyEnabled})
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		renderServerError(w, "error generating totp secret: %v", err)
+		return
+	}
+	encrypted, err := auth.EncryptSecret(h.totpKey, secret)
+	if err != nil {
+		renderServerError(w, "error encrypting totp secret: %v", err)
+		return
+	}
+	recoveryCodes, err := auth.NewRecoveryCodes(totpRecoveryCodes)
+	if err != nil {
+		renderServerError(w, "error generating recovery codes: %v", err)
+		return
+	}
+	hashes := make([]string, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		hashes[i] = auth.HashRecoveryCode(h.totpKey, code)
+	}
+
+	if err := h.db.EnrollAccountTOTP(r.Context(), account.ID, encrypted, hashes); err != nil {
+		if errors.Is(err, database.ErrTOTPAlreadyEnabled) {
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeTOTPAlreadyEnabled})
+			return
+		}
+		renderServerError(w, "error enrolling totp: %v", err)
+		return
+	}
+
+	renderJSON(w, http.StatusCreated, &totpEnrollmentResponse{
+		Secret:        secret,
+		URI:           auth.TOTPURI(totpIssuer, account.Document(), secret),
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+func (h *handler) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	var body struct {
+		TOTPCode string `json:"totp_code" validate:"required"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	if account.TOTPSecret == "" || account.TOTPEnabled {
+		renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeTOTPNotEnrolled})
+		return
+	}
+	secret, err := auth.DecryptSecret(h.totpKey, account.TOTPSecret)
+	if err != nil {
+		renderServerError(w, "error decrypting totp secret: %v", err)
+		return
+	}
+	step, ok := auth.ValidateTOTP(secret, body.TOTPCode, h.now())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeInvalidTOTPCode})
+		return
+	}
+
+	if err := h.db.EnableAccountTOTP(r.Context(), account.ID, step); err != nil {
+		if errors.Is(err, database.ErrTOTPNotEnrolled) {
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeTOTPNotEnrolled})
+			return
+		}
+		renderServerError(w, "error enabling totp: %v", err)
+		return
+	}
+	h.recordAuditEvent(r.Context(), account.ID, account.ID, database.AuditTOTPEnabled, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	var body struct {
+		TOTPCode     string `json:"totp_code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !account.TOTPEnabled {
+		renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeTOTPNotEnrolled})
+		return
+	}
+	if body.TOTPCode == "" && body.RecoveryCode == "" {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeTOTPCodeRequired})
+		return
+	}
+	ok, err := h.useSecondFactor(r.Context(), account, body.TOTPCode, body.RecoveryCode)
+	if err != nil {
+		renderServerError(w, "error verifying second factor: %v", err)
+		return
+	}
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeInvalidTOTPCode})
+		return
+	}
+
+	if err := h.db.DisableAccountTOTP(r.Context(), account.ID); err != nil {
+		renderServerError(w, "error disabling totp: %v", err)
+		return
+	}
+	h.recordAuditEvent(r.Context(), account.ID, account.ID, database.AuditTOTPDisabled, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkTransferTOTP verifies the TOTP code required for transferring amounts,
+// the amounts in each currency, from account, rendering an error response and
+// returning false if the code is missing or invalid. Large transfers require a
+// code that was not used before, even for logging in, so a stolen access
+// token is not enough to move them.
+func (h *handler) checkTransferTOTP(w http.ResponseWriter, r *http.Request, account *database.Account, amounts map[money.Currency]decimal.Decimal, code string) bool {
+	if !account.TOTPEnabled {
+		return true
+	}
+	required, err := h.transferTOTPRequired(r.Context(), amounts)
+	if err != nil {
+		renderServerError(w, "error finding exchange rates: %v", err)
+		return false
+	}
+	if !required {
+		return true
+	}
+
+	if code == "" {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeTOTPCodeRequired})
+		return false
+	}
+	ok, err := h.useSecondFactor(r.Context(), account, code, "")
+	if err != nil {
+		renderServerError(w, "error verifying totp code: %v", err)
+		return false
+	}
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeInvalidTOTPCode})
+		return false
+	}
+	return true
+}
+
+// transferTOTPRequired reports whether transferring amounts, the amounts in
+// each currency, requires a TOTP code. The amounts are converted into
+// money.DefaultCurrency, the currency of the threshold, at the current
+// exchange rates, and amounts in currencies without a rate always require a
+// code.
+func (h *handler) transferTOTPRequired(ctx context.Context, amounts map[money.Currency]decimal.Decimal) (bool, error) {
+	var (
+		rates  []*database.ExchangeRate
+		loaded bool
+	)
+	total := decimal.Zero
+	for c, amount := range amounts {
+		if c == money.DefaultCurrency {
+			total = total.Add(amount)
+			continue
+		}
+		if !loaded {
+			var err error
+			if rates, err = h.db.FindAllExchangeRates(ctx); err != nil {
+				return false, err
+			}
+			loaded = true
+		}
+		rate := findRate(rates, c, money.DefaultCurrency)
+		if rate == nil {
+			return true, nil
+		}
+		total = total.Add(money.Convert(amount, rate.Rate, money.DefaultCurrency))
+	}
+	return total.GreaterThan(h.totpTransferThreshold), nil
+}
+
+// findRate returns the exchange rate from base to quote among rates, or nil
+// if there is none.
+func findRate(rates []*database.ExchangeRate, base, quote money.Currency) *database.ExchangeRate {
+	for _, rate := range rates {
+		if rate.Base == base && rate.Quote == quote {
+			return rate
+		}
+	}
+	return nil
+}
+
+// The parameters of the TOTP enrollments.
+const (
+	totpIssuer        = "desafio-go-stone"
+	totpRecoveryCodes = 10
+)
+
+// useSecondFactor reports whether totpCode or, if given, recoveryCode is a
+// valid second factor of account, consuming it so it is not accepted again.
+func (h *handler) useSecondFactor(ctx context.Context, account *database.Account, totpCode, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		err := h.db.UseAccountRecoveryCode(ctx, account.ID, auth.HashRecoveryCode(h.totpKey, recoveryCode))
+		if errors.Is(err, database.ErrRecoveryCodeNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	secret, err := auth.DecryptSecret(h.totpKey, account.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := auth.ValidateTOTP(secret, totpCode, h.now())
+	if !ok {
+		return false, nil
+	}
+
+	err = h.db.UseAccountTOTPStep(ctx, account.ID, step)
+	if errors.Is(err, database.ErrTOTPCodeReused) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *handler) refreshToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	session := &database.Session{}
+	refreshToken, err := rotateSessionTokens(session)
+	if err != nil {
+		renderServerError(w, "error generating session tokens: %v", err)
+		return
+	}
+	if err := h.db.RefreshSession(r.Context(), auth.HashRefreshToken(body.RefreshToken), session); err != nil {
+		if errors.Is(err, database.ErrSessionNotFound) || errors.Is(err, database.ErrRefreshTokenReused) {
+			renderJSON(w, http.StatusUnauthorized, &errorResponse{Code: codeInvalidRefreshToken})
+			return
+		}
+		renderServerError(w, "error refreshing session: %v", err)
+		return
+	}
+
+	account, err := h.db.FindAccountByID(r.Context(), session.AccountID)
+	if err != nil {
+		renderServerError(w, "error finding account of session: %v", err)
+		return
+	}
+	if code := loginStatusErrorCode(account); code != "" {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: code})
+		return
+	}
+
+	h.renderSessionTokens(w, session, account.Role, refreshToken)
+}
+
+func (h *handler) logout(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessionFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	if err := h.db.RevokeSession(r.Context(), session.ID); err != nil {
+		renderServerError(w, "error revoking session: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rotateSessionTokens sets new token ID, refresh token hash and expiration
+// into session, returning the new refresh token.
+func rotateSessionTokens(session *database.Session) (string, error) {
+	tokenID, err := auth.NewTokenID()
+	if err != nil {
+		return "", err
+	}
+	refreshToken, err := auth.NewRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	session.TokenID = tokenID
+	session.RefreshTokenHash = auth.HashRefreshToken(refreshToken)
+	session.ExpiresAt = time.Now().Add(auth.RefreshTokenTTL)
+	return refreshToken, nil
+}
+
+// renderSessionTokens renders the access token of session, which claims the
+// role of its account, along with its refresh token.
+func (h *handler) renderSessionTokens(w http.ResponseWriter, session *database.Session, role database.Role, refreshToken string) {
+	token, err := auth.EncodeToken(h.jwtKeys, &auth.Claims{
+		AccountID: session.AccountID,
+		TokenID:   session.TokenID,
+		Role:      string(role),
+	})
+	if err != nil {
+		renderServerError(w, "error encoding authentication token: %v", err)
+		return
+	}
+
+	renderJSON(w, http.StatusOK, &authResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(auth.AccessTokenTTL.Seconds()),
+	})
+}
+
+func (h *handler) getJWKS(w http.ResponseWriter, r *http.Request) {
+	// the keys only change when the server restarts
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	renderJSON(w, http.StatusOK, h.jwtKeys.JWKS())
+}
+
+// convertedAmountTooSmall is the details of the validation error of transfers
+// whose amount rounds to zero when converted to the destination currency.
+const convertedAmountTooSmall = "amount is too small to be converted"
+
+func (h *handler) createTransfer(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	var body struct {
+		AccountDestinationID int64           `json:"account_destination_id" validate:"required"`
+		Amount               decimal.Decimal `json:"amount" validate:"positive,precision"`
+		Currency             money.Currency  `json:"currency" validate:"omitempty,currency"`
+		DestinationCurrency  money.Currency  `json:"destination_currency" validate:"omitempty,currency"`
+		TOTPCode             string          `json:"totp_code"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	currency := body.Currency
+	if currency == "" {
+		currency = money.DefaultCurrency
+	}
+	if !h.checkTransferTOTP(w, r, account, map[money.Currency]decimal.Decimal{currency: body.Amount}, body.TOTPCode) {
+		return
+	}
+
+	transfer := &database.Transfer{
+		AccountOriginID:      account.ID,
+		AccountDestinationID: body.AccountDestinationID,
+		Amount:               body.Amount,
+		Currency:             body.Currency,
+		DestinationCurrency:  body.DestinationCurrency,
+	}
+	if err := h.db.CreateTransfer(r.Context(), transfer); err != nil {
+		switch {
+		case errors.Is(err, database.ErrAccountNotFound):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeAccountNotFound})
+			return
+		case errors.Is(err, database.ErrNotEnoughFunds):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeAccountFundsInsuficient})
+			return
+		case errors.Is(err, database.ErrLimitExceeded):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeLimitExceeded})
+			return
+		case errors.Is(err, database.ErrSelfTransfer):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeSelfTransfer})
+			return
+		case errors.Is(err, database.ErrExchangeRateNotFound):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{
+				Code:    codeExchangeRateNotFound,
+				Details: fmt.Sprintf("there is no exchange rate from %s to %s", transfer.Currency, transfer.DestinationCurrency),
+			})
+			return
+		case errors.Is(err, database.ErrInvalidAmount):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeValidationError, Details: convertedAmountTooSmall})
+			return
+		case accountStatusErrorCode(err) != "":
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: accountStatusErrorCode(err)})
+			return
+		default:
+			renderServerError(w, "error creating transfer: %v", err)
+			return
+		}
+	}
+
+	renderJSON(w, http.StatusCreated, transfer)
+}
+
+func (h *handler) createReversal(w http.ResponseWriter, r *http.Request) {
+	transferID, err := strconv.ParseInt(chi.URLParam(r, "transfer_id"), 10, 64)
+	if err != nil {
+		renderJSON(w, http.StatusNotFound, &errorResponse{Code: codeTransferNotFound})
+		return
+	}
+
+	var body struct {
+		Amount *decimal.Decimal `json:"amount" validate:"omitempty,positive,precision"`
+		Reason string           `json:"reason" validate:"required"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	reversal := &database.Transfer{
+		ReversedTransferID: transferID,
+		Reason:             body.Reason,
+	}
+	if body.Amount != nil {
+		reversal.Amount = *body.Amount
+	}
+	if err := h.db.CreateReversal(r.Context(), reversal); err != nil {
+		switch {
+		case errors.Is(err, database.ErrTransferNotFound):
+			renderJSON(w, http.StatusNotFound, &errorResponse{Code: codeTransferNotFound})
+			return
+		case errors.Is(err, database.ErrTransferAlreadyReversed):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeTransferAlreadyReversed})
+			return
+		case errors.Is(err, database.ErrTransferNotReversible):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeTransferNotReversible})
+			return
+		case errors.Is(err, database.ErrReversalAmountExceeded):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeReversalAmountExceeded})
+			return
+		case errors.Is(err, database.ErrInvalidAmount):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeValidationError, Details: convertedAmountTooSmall})
+			return
+		case errors.Is(err, database.ErrNotEnoughFunds):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeAccountFundsInsuficient})
+			return
+		case accountStatusErrorCode(err) != "":
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: accountStatusErrorCode(err)})
+			return
+		default:
+			renderServerError(w, "error creating reversal: %v", err)
+			return
+		}
+	}
+
+	renderJSON(w, http.StatusCreated, reversal)
+}
+
+func (h *handler) getTransfers(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	h.renderTransfers(w, r, account.ID)
+}
+
+// renderTransfers renders the page of the transfers of accountID requested by
+// the query string of r.
+func (h *handler) renderTransfers(w http.ResponseWriter, r *http.Request, accountID int64) {
+	filter, res := parseTransferFilter(r)
+	if res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	// fetch one more transfer than requested to know if there is a next page
+	limit := filter.Limit
+	filter.AccountID = accountID
+	filter.Limit = limit + 1
+
+	transfers, err := h.db.FindTransfers(r.Context(), filter)
+	if err != nil {
+		renderServerError(w, "error finding account transfers: %v", err)
+		return
+	}
+
+	body := &transfersResponse{Transfers: []*database.Transfer{}}
+	if len(transfers) > limit {
+		transfers = transfers[:limit]
+		last := transfers[limit-1]
+		body.NextCursor = encodeTransferCursor(&database.TransferCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+	body.Transfers = append(body.Transfers, transfers...)
+
+	renderJSON(w, http.StatusOK, body)
+}
+
+func (h *handler) createScheduledTransfer(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	var body struct {
+		AccountDestinationID int64                     `json:"account_destination_id" validate:"required"`
+		Amount               decimal.Decimal           `json:"amount" validate:"positive,precision"`
+		Interval             database.ScheduleInterval `json:"interval" validate:"required,oneof=once monthly"`
+		StartAt              time.Time                 `json:"start_at" validate:"required"`
+		TOTPCode             string                    `json:"totp_code"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+	if !body.StartAt.After(h.now()) {
+		renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{
+			Code:    codeValidationError,
+			Details: "start_at must be in the future",
+		})
+		return
+	}
+	// scheduled transfers are always in money.DefaultCurrency
+	if !h.checkTransferTOTP(w, r, account, map[money.Currency]decimal.Decimal{money.DefaultCurrency: body.Amount}, body.TOTPCode) {
+		return
+	}
+
+	scheduled := &database.ScheduledTransfer{
+		AccountOriginID:      account.ID,
+		AccountDestinationID: body.AccountDestinationID,
+		Amount:               body.Amount,
+		Interval:             body.Interval,
+		StartAt:              body.StartAt,
+	}
+	if err := h.db.CreateScheduledTransfer(r.Context(), scheduled); err != nil {
+		switch {
+		case errors.Is(err, database.ErrAccountNotFound):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeAccountNotFound})
+			return
+		case errors.Is(err, database.ErrSelfTransfer):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeSelfTransfer})
+			return
+		case errors.Is(err, database.ErrInvalidAmount):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{
+				Code:    codeValidationError,
+				Details: fmt.Sprintf("amount must have at most %d decimal places", money.DefaultCurrency.Places()),
+			})
+			return
+		case accountStatusErrorCode(err) != "":
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: accountStatusErrorCode(err)})
+			return
+		}
+		renderServerError(w, "error creating scheduled transfer: %v", err)
+		return
+	}
+
+	renderJSON(w, http.StatusCreated, scheduled)
+}
+
+func (h *handler) getScheduledTransfers(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	schedules, err := h.db.FindAllScheduledTransfersWithAccountID(r.Context(), account.ID)
+	if err != nil {
+		renderServerError(w, "error finding account scheduled transfers: %v", err)
+		return
+	}
+	if schedules == nil {
+		schedules = []*database.ScheduledTransfer{}
+	}
+
+	renderJSON(w, http.StatusOK, schedules)
+}
+
+func (h *handler) cancelScheduledTransfer(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	scheduledID, err := strconv.ParseInt(chi.URLParam(r, "scheduled_transfer_id"), 10, 64)
+	if err != nil {
+		renderJSON(w, http.StatusNotFound, &errorResponse{Code: codeScheduledTransferNotFound})
+		return
+	}
+
+	scheduled, err := h.db.CancelScheduledTransfer(r.Context(), account.ID, scheduledID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrScheduledTransferNotFound):
+			renderJSON(w, http.StatusNotFound, &errorResponse{Code: codeScheduledTransferNotFound})
+			return
+		case errors.Is(err, database.ErrScheduledTransferNotActive):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeScheduledTransferNotActive})
+			return
+		default:
+			renderServerError(w, "error cancelling scheduled transfer: %v", err)
+			return
+		}
+	}
+
+	renderJSON(w, http.StatusOK, scheduled)
+}
+
+func (h *handler) getScheduledTransferExecutions(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	scheduledID, err := strconv.ParseInt(chi.URLParam(r, "scheduled_transfer_id"), 10, 64)
+	if err != nil {
+		renderJSON(w, http.StatusNotFound, &errorResponse{Code: codeScheduledTransferNotFound})
+		return
+	}
+
+	// only the origin account is allowed to see the executions
+	schedules, err := h.db.FindAllScheduledTransfersWithAccountID(r.Context(), account.ID)
+	if err != nil {
+		renderServerError(w, "error finding account scheduled transfers: %v", err)
+		return
+	}
+	found := false
+	for _, s := range schedules {
+		if s.ID == scheduledID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		renderJSON(w, http.StatusNotFound, &errorResponse{Code: codeScheduledTransferNotFound})
+		return
+	}
+
+	executions, err := h.db.FindAllScheduledTransferExecutions(r.Context(), scheduledID)
+	if err != nil {
+		renderServerError(w, "error finding scheduled transfer executions: %v", err)
+		return
+	}
+	if executions == nil {
+		executions = []*database.ScheduledTransferExecution{}
+	}
+
+	renderJSON(w, http.StatusOK, executions)
+}
+
+func (h *handler) createDeposit(w http.ResponseWriter, r *http.Request) {
+	operator, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	var body struct {
+		AccountID int64           `json:"account_id" validate:"required"`
+		Amount    decimal.Decimal `json:"amount" validate:"positive,precision"`
+		Currency  money.Currency  `json:"currency" validate:"omitempty,currency"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	movement := &database.CashMovement{
+		AccountID:  body.AccountID,
+		Type:       database.CashMovementDeposit,
+		Amount:     body.Amount,
+		Currency:   body.Currency,
+		OperatorID: operator.ID,
+	}
+	if err := h.db.CreateCashMovement(r.Context(), movement); err != nil {
+		switch {
+		case errors.Is(err, database.ErrAccountNotFound):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeAccountNotFound})
+			return
+		case accountStatusErrorCode(err) != "":
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: accountStatusErrorCode(err)})
+			return
+		}
+		renderServerError(w, "error creating deposit: %v", err)
+		return
+	}
+
+	renderJSON(w, http.StatusCreated, movement)
+}
+
+func (h *handler) createWithdrawal(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	var body struct {
+		Amount   decimal.Decimal `json:"amount" validate:"positive,precision"`
+		Currency money.Currency  `json:"currency" validate:"omitempty,currency"`
+		TOTPCode string          `json:"totp_code"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	// withdrawals are not charged any fee, so the amount is all that leaves
+	// the account
+	currency := body.Currency
+	if currency == "" {
+		currency = money.DefaultCurrency
+	}
+	if !h.checkTransferTOTP(w, r, account, map[money.Currency]decimal.Decimal{currency: body.Amount}, body.TOTPCode) {
+		return
+	}
+
+	movement := &database.CashMovement{
+		AccountID: account.ID,
+		Type:      database.CashMovementWithdrawal,
+		Amount:    body.Amount,
+		Currency:  body.Currency,
+	}
+	if err := h.db.CreateCashMovement(r.Context(), movement); err != nil {
+		switch {
+		case errors.Is(err, database.ErrNotEnoughFunds):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeAccountFundsInsuficient})
+			return
+		case errors.Is(err, database.ErrLimitExceeded):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeLimitExceeded})
+			return
+		case errors.Is(err, database.ErrExchangeRateNotFound):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeExchangeRateNotFound})
+			return
+		case accountStatusErrorCode(err) != "":
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: accountStatusErrorCode(err)})
+			return
+		}
+		renderServerError(w, "error creating withdrawal: %v", err)
+		return
+	}
+
+	renderJSON(w, http.StatusCreated, movement)
+}
+
+func (h *handler) getCashMovements(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	movements, err := h.db.FindAllCashMovementsWithAccountID(r.Context(), account.ID)
+	if err != nil {
+		renderServerError(w, "error finding account cash movements: %v", err)
+		return
+	}
+	if movements == nil {
+		movements = []*database.CashMovement{}
+	}
+
+	renderJSON(w, http.StatusOK, movements)
+}
+
+func (h *handler) getLedgerEntries(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	entries, err := h.db.FindAllLedgerEntriesWithAccountID(r.Context(), account.ID)
+	if err != nil {
+		renderServerError(w, "error finding account ledger entries: %v", err)
+		return
+	}
+	if entries == nil {
+		entries = []*database.LedgerEntry{}
+	}
+
+	renderJSON(w, http.StatusOK, entries)
+}
+
+func (h *handler) getTransferLimits(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	limits, pending, err := h.db.FindTransferLimits(r.Context(), account.ID)
+	if err != nil {
+		renderServerError(w, "error finding account transfer limits: %v", err)
+		return
+	}
+
+	res := &transferLimitsResponse{Limits: limits, Pending: []*transferLimitChange{}}
+	for _, limit := range pending {
+		res.Pending = append(res.Pending, &transferLimitChange{TransferLimit: limit, EffectiveAt: limit.EffectiveAt})
+	}
+	renderJSON(w, http.StatusOK, res)
+}
+
+func (h *handler) changeTransferLimit(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	var body struct {
+		Kind   database.TransferLimitKind `json:"kind" validate:"required,oneof=per_transaction daily nighttime"`
+		Amount decimal.Decimal            `json:"amount" validate:"positive,precision"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	limit := &database.TransferLimit{
+		AccountID: account.ID,
+		Kind:      body.Kind,
+		Amount:    body.Amount,
+	}
+	if err := h.db.RequestTransferLimitChange(r.Context(), limit); err != nil {
+		renderServerError(w, "error changing transfer limit: %v", err)
+		return
+	}
+
+	details := fmt.Sprintf("%s limit of %s effective at %s", limit.Kind, limit.Amount, limit.EffectiveAt.Format(time.RFC3339))
+	h.recordAuditEvent(r.Context(), account.ID, account.ID, database.AuditTransferLimitChanged, details)
+	renderJSON(w, http.StatusOK, &transferLimitChange{TransferLimit: limit, EffectiveAt: limit.EffectiveAt})
+}
+
+func (h *handler) getExchangeRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := h.db.FindAllExchangeRates(r.Context())
+	if err != nil {
+		renderServerError(w, "error finding exchange rates: %v", err)
+		return
+	}
+	if rates == nil {
+		rates = []*database.ExchangeRate{}
+	}
+
+	renderJSON(w, http.StatusOK, rates)
+}
+
+func (h *handler) getFeeSchedules(w http.ResponseWriter, r *http.Request) {
+	schedules, err := h.db.FindAllFeeSchedules(r.Context())
+	if err != nil {
+		renderServerError(w, "error finding fee schedules: %v", err)
+		return
+	}
+	if schedules == nil {
+		schedules = []*database.FeeSchedule{}
+	}
+
+	renderJSON(w, http.StatusOK, schedules)
+}
+
+// maxBodySize is the maximum size of a HTTP request body.
+const maxBodySize = 1024 * 1024 // 1MB
+
+// maxIdempotencyKeySize is the maximum size of an Idempotency-Key header.
+const maxIdempotencyKeySize = 255
+
+// bindJSON binds JSON encoded data from a HTTP request into the value pointed
 // by dest.
 func bindJSON(r *http.Request, dest interface{}) error {
-	const maxBodySize = 1024 * 1024 // 1MB
 	return json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(dest)
 }
 
+// fingerprintRequest returns a hash identifying the method, path and body of a
+// HTTP request.
+func fingerprintRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseBuffer is a http.ResponseWriter that holds the response in memory
+// until it is flushed into another writer.
+type responseBuffer struct {
+	Code   int
+	Body   bytes.Buffer
+	header http.Header
+}
+
+// newResponseBuffer returns an empty response buffer.
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{Code: http.StatusOK, header: http.Header{}}
+}
+
+func (b *responseBuffer) Header() http.Header         { return b.header }
+func (b *responseBuffer) Write(p []byte) (int, error) { return b.Body.Write(p) }
+func (b *responseBuffer) WriteHeader(code int)        { b.Code = code }
+
+// flush writes the buffered response into w.
+func (b *responseBuffer) flush(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(b.Code)
+	w.Write(b.Body.Bytes())
+}
+
 // renderJSON writes a HTTP JSON response with given code and body.
 func renderJSON(w http.ResponseWriter, code int, body interface{}) {
 	data, err := json.Marshal(body)
@@ -275,3 +1966,364 @@ func renderServerError(w http.ResponseWriter, format string, args ...interface{}
 	log.Printf(format, args...)
 	w.WriteHeader(http.StatusInternalServerError)
 }
+
+// recordAuditEvent records action performed on accountID by actorID into the
+// audit log. Failures are only logged, so they never undo the action.
+func (h *handler) recordAuditEvent(ctx context.Context, accountID, actorID int64, action database.AuditAction, details string) {
+	event := &database.AuditEvent{
+		AccountID: accountID,
+		ActorID:   actorID,
+		Action:    action,
+		Details:   details,
+	}
+	if err := h.db.CreateAuditEvent(ctx, event); err != nil {
+		log.Printf("error recording audit event %s of account %d: %v", action, accountID, err)
+	}
+}
+
+// adminAccount returns the account identified by the URL of an admin route,
+// rendering an error response if it cannot be found.
+func (h *handler) adminAccount(w http.ResponseWriter, r *http.Request) (*database.Account, bool) {
+	accountID, err := strconv.ParseInt(chi.URLParam(r, "account_id"), 10, 64)
+	if err != nil {
+		renderJSON(w, http.StatusNotFound, &errorResponse{Code: codeAccountNotFound})
+		return nil, false
+	}
+
+	account, err := h.db.FindAccountByID(r.Context(), accountID)
+	if err != nil {
+		if errors.Is(err, database.ErrAccountNotFound) {
+			renderJSON(w, http.StatusNotFound, &errorResponse{Code: codeAccountNotFound})
+			return nil, false
+		}
+		renderServerError(w, "error finding account: %v", err)
+		return nil, false
+	}
+	return account, true
+}
+
+func (h *handler) adminGetAccount(w http.ResponseWriter, r *http.Request) {
+	account, ok := h.adminAccount(w, r)
+	if !ok {
+		return
+	}
+
+	renderJSON(w, http.StatusOK, account)
+}
+
+func (h *handler) adminGetTransfers(w http.ResponseWriter, r *http.Request) {
+	account, ok := h.adminAccount(w, r)
+	if !ok {
+		return
+	}
+
+	h.renderTransfers(w, r, account.ID)
+}
+
+func (h *handler) adminGetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	account, ok := h.adminAccount(w, r)
+	if !ok {
+		return
+	}
+
+	events, err := h.db.FindAllAuditEventsWithAccountID(r.Context(), account.ID)
+	if err != nil {
+		renderServerError(w, "error finding audit events: %v", err)
+		return
+	}
+	if events == nil {
+		events = []*database.AuditEvent{}
+	}
+
+	renderJSON(w, http.StatusOK, events)
+}
+
+// statusAuditActions maps each account status to the action recorded into the
+// audit log when an account changes to it.
+var statusAuditActions = map[database.AccountStatus]database.AuditAction{
+	database.AccountActive:  database.AuditAccountActivated,
+	database.AccountFrozen:  database.AuditAccountFrozen,
+	database.AccountBlocked: database.AuditAccountBlocked,
+	database.AccountClosed:  database.AuditAccountClosed,
+}
+
+func (h *handler) adminSetAccountStatus(w http.ResponseWriter, r *http.Request) {
+	actor, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+	account, ok := h.adminAccount(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Status database.AccountStatus `json:"status" validate:"required,oneof=active frozen blocked"`
+		Reason string                 `json:"reason" validate:"required"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	if err := h.db.SetAccountStatus(r.Context(), account.ID, body.Status); err != nil {
+		if errors.Is(err, database.ErrInvalidStatusTransition) {
+			renderJSON(w, http.StatusConflict, &errorResponse{
+				Code:    codeInvalidStatusTransition,
+				Details: fmt.Sprintf("account cannot change from %s to %s", account.Status, body.Status),
+			})
+			return
+		}
+		renderServerError(w, "error setting account status: %v", err)
+		return
+	}
+	h.recordAuditEvent(r.Context(), account.ID, actor.ID, statusAuditActions[body.Status], body.Reason)
+
+	account.Status = body.Status
+	renderJSON(w, http.StatusOK, account)
+}
+
+// invalidCreditLine is the details of the validation error of credit lines
+// refused by the database.
+const invalidCreditLine = "credit_limit and overdraft_rate must not be negative and credit_limit must have at most 2 decimal places"
+
+func (h *handler) adminSetCreditLine(w http.ResponseWriter, r *http.Request) {
+	actor, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+	account, ok := h.adminAccount(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		CreditLimit   decimal.Decimal `json:"credit_limit"`
+		OverdraftRate decimal.Decimal `json:"overdraft_rate"`
+		Reason        string          `json:"reason" validate:"required"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	if err := h.db.SetAccountCreditLine(r.Context(), account.ID, body.CreditLimit, body.OverdraftRate); err != nil {
+		switch {
+		case errors.Is(err, database.ErrInvalidCreditLine):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeValidationError, Details: invalidCreditLine})
+			return
+		case accountStatusErrorCode(err) != "":
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: accountStatusErrorCode(err)})
+			return
+		default:
+			renderServerError(w, "error setting credit line: %v", err)
+			return
+		}
+	}
+	details := fmt.Sprintf("%s; credit limit of %s at %s a day", body.Reason, body.CreditLimit, body.OverdraftRate)
+	h.recordAuditEvent(r.Context(), account.ID, actor.ID, database.AuditCreditLineChanged, details)
+
+	account.CreditLimit = body.CreditLimit
+	account.OverdraftRate = body.OverdraftRate
+	renderJSON(w, http.StatusOK, account)
+}
+
+func (h *handler) adminCloseAccount(w http.ResponseWriter, r *http.Request) {
+	actor, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+	account, ok := h.adminAccount(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Reason         string `json:"reason" validate:"required"`
+		SweepAccountID int64  `json:"sweep_account_id"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	h.renderAccountClosure(w, r, account, actor, body.SweepAccountID, body.Reason)
+}
+
+func (h *handler) closeAccount(w http.ResponseWriter, r *http.Request) {
+	account, ok := accountFromCtx(r.Context())
+	if !ok {
+		renderJSON(w, http.StatusForbidden, &errorResponse{Code: codeMissingBearerToken})
+		return
+	}
+
+	var body struct {
+		Secret         string `json:"secret" validate:"required"`
+		SweepAccountID int64  `json:"sweep_account_id"`
+		TOTPCode       string `json:"totp_code"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	if !h.checkCurrentSecret(w, r, account, body.Secret) {
+		return
+	}
+	// sweeping the balances of the wallets is a transfer like any other
+	wallets, err := h.db.FindAllWalletsWithAccountID(r.Context(), account.ID)
+	if err != nil {
+		renderServerError(w, "error finding account wallets: %v", err)
+		return
+	}
+	sweeps := make(map[money.Currency]decimal.Decimal, len(wallets))
+	for _, wallet := range wallets {
+		if wallet.Balance.IsPositive() {
+			sweeps[wallet.Currency] = wallet.Balance
+		}
+	}
+	if !h.checkTransferTOTP(w, r, account, sweeps, body.TOTPCode) {
+		return
+	}
+
+	h.renderAccountClosure(w, r, account, account, body.SweepAccountID, "requested by the account holder")
+}
+
+// renderAccountClosure closes account on behalf of actor, sweeping its balance
+// to sweepAccountID, and renders the closed account.
+func (h *handler) renderAccountClosure(w http.ResponseWriter, r *http.Request, account, actor *database.Account, sweepAccountID int64, reason string) {
+	sweeps, err := h.db.CloseAccount(r.Context(), account.ID, sweepAccountID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrAccountNotFound):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeAccountNotFound})
+			return
+		case errors.Is(err, database.ErrAccountBalanceNotZero):
+			details := "sweep_account_id is required to close an account with funds"
+			if account.Balance.IsNegative() {
+				details = "the overdraft must be paid off before closing the account"
+			}
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{
+				Code:    codeAccountBalanceNotZero,
+				Details: details,
+			})
+			return
+		case accountStatusErrorCode(err) != "":
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: accountStatusErrorCode(err)})
+			return
+		default:
+			renderServerError(w, "error closing account: %v", err)
+			return
+		}
+	}
+
+	details := reason
+	if len(sweeps) > 0 {
+		balances := make([]string, len(sweeps))
+		for n, sweep := range sweeps {
+			balances[n] = fmt.Sprintf("%s %s", sweep.Amount, sweep.Currency)
+		}
+		details = fmt.Sprintf("%s; balance of %s swept to account %d", reason, strings.Join(balances, ", "), sweepAccountID)
+	}
+	h.recordAuditEvent(r.Context(), account.ID, actor.ID, database.AuditAccountClosed, details)
+
+	account.Status = database.AccountClosed
+	account.Balance = decimal.Zero
+	renderJSON(w, http.StatusOK, account)
+}
+
+func (h *handler) adminSetExchangeRate(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Base  money.Currency  `json:"base" validate:"required,currency"`
+		Quote money.Currency  `json:"quote" validate:"required,currency,nefield=Base"`
+		Rate  decimal.Decimal `json:"rate" validate:"positive"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	rate := &database.ExchangeRate{
+		Base:  body.Base,
+		Quote: body.Quote,
+		Rate:  body.Rate,
+	}
+	if err := h.db.SetExchangeRate(r.Context(), rate); err != nil {
+		renderServerError(w, "error setting exchange rate: %v", err)
+		return
+	}
+
+	renderJSON(w, http.StatusOK, rate)
+}
+
+// invalidFeeSchedule is the details of the validation error of fee schedules
+// refused by the database.
+const invalidFeeSchedule = "amounts and quotas must not be negative, amounts must have at most 2 decimal places, rates must be between 0 and 1 and tiers must be in ascending order of up_to, with only the last one unbounded"
+
+func (h *handler) adminSetFeeSchedule(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		TransferType     database.TransferType `json:"transfer_type" validate:"required,oneof=individual business exchange"`
+		Type             database.FeeType      `json:"type" validate:"required,oneof=flat percentage tiered"`
+		Amount           decimal.Decimal       `json:"amount"`
+		Rate             decimal.Decimal       `json:"rate"`
+		Tiers            []*database.FeeTier   `json:"tiers"`
+		FreeMonthlyQuota int                   `json:"free_monthly_quota"`
+		RevenueAccountID int64                 `json:"revenue_account_id" validate:"required"`
+	}
+	if err := bindJSON(r, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res := validateBody(body); res != nil {
+		renderJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+
+	schedule := &database.FeeSchedule{
+		TransferType:     body.TransferType,
+		Type:             body.Type,
+		Amount:           body.Amount,
+		Rate:             body.Rate,
+		Tiers:            body.Tiers,
+		FreeMonthlyQuota: body.FreeMonthlyQuota,
+		RevenueAccountID: body.RevenueAccountID,
+	}
+	if err := h.db.SetFeeSchedule(r.Context(), schedule); err != nil {
+		switch {
+		case errors.Is(err, database.ErrInvalidFeeSchedule):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeValidationError, Details: invalidFeeSchedule})
+			return
+		case errors.Is(err, database.ErrAccountNotFound):
+			renderJSON(w, http.StatusUnprocessableEntity, &errorResponse{Code: codeAccountNotFound})
+			return
+		default:
+			renderServerError(w, "error setting fee schedule: %v", err)
+			return
+		}
+	}
+
+	renderJSON(w, http.StatusOK, schedule)
+}
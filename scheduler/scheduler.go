@@ -0,0 +1,144 @@
+// Package scheduler implements the background job that executes scheduled
+// transfers.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lindebergue/desafio-go-stone/database"
+)
+
+// Options contains the options for creating a scheduler.
+type Options struct {
+	DB database.DB
+
+	// Interval is how often the scheduler looks for due scheduled transfers.
+	// Defaults to one minute.
+	Interval time.Duration
+
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Scheduler executes due scheduled transfers. Every run of a scheduled
+// transfer is claimed through the database before being executed, so many
+// schedulers can run at the same time without executing a run twice.
+type Scheduler struct {
+	db       database.DB
+	interval time.Duration
+	now      func() time.Time
+}
+
+// New returns a new scheduler with given opts.
+func New(opts Options) *Scheduler {
+	s := &Scheduler{
+		db:       opts.DB,
+		interval: opts.Interval,
+		now:      opts.Now,
+	}
+	if s.interval <= 0 {
+		s.interval = time.Minute
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	return s
+}
+
+// Run executes due scheduled transfers every interval until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.RunDue(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("error running scheduled transfers: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue executes all scheduled transfers that are due, returning when there
+// are no more of them. Executions whose transfer fails are recorded as failed
+// and do not stop the remaining ones. Only when ctx is done the execution in
+// progress is left pending, as its transfer may have been created before.
+func (s *Scheduler) RunDue(ctx context.Context) error {
+	for {
+		scheduled, execution, err := s.db.ClaimDueScheduledTransfer(ctx, s.now())
+		if err != nil {
+			if errors.Is(err, database.ErrScheduledTransferNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		if err := s.execute(ctx, scheduled, execution); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Printf("error recording execution %d of scheduled transfer %d: %v", execution.ID, scheduled.ID, err)
+		}
+	}
+}
+
+// businessErrors are the errors of transfers refused for business reasons.
+var businessErrors = []error{
+	database.ErrNotEnoughFunds,
+	database.ErrLimitExceeded,
+	database.ErrAccountNotFound,
+	database.ErrAccountFrozen,
+	database.ErrAccountBlocked,
+	database.ErrAccountClosed,
+	database.ErrExchangeRateNotFound,
+	database.ErrInvalidAmount,
+	database.ErrInvalidCurrency,
+	database.ErrSelfTransfer,
+}
+
+// failureOf returns the failure recorded for an execution of scheduled whose
+// transfer failed with err. Business errors are recorded as they are, while
+// any other error is logged and recorded as an unexpected error.
+func failureOf(scheduled *database.ScheduledTransfer, err error) string {
+	for _, businessErr := range businessErrors {
+		if errors.Is(err, businessErr) {
+			return err.Error()
+		}
+	}
+
+	log.Printf("error executing scheduled transfer %d: %v", scheduled.ID, err)
+	return "unexpected error"
+}
+
+// execute creates the transfer of a claimed execution and records its result.
+func (s *Scheduler) execute(ctx context.Context, scheduled *database.ScheduledTransfer, execution *database.ScheduledTransferExecution) error {
+	transfer := &database.Transfer{
+		AccountOriginID:      scheduled.AccountOriginID,
+		AccountDestinationID: scheduled.AccountDestinationID,
+		Amount:               scheduled.Amount,
+	}
+
+	err := s.db.CreateTransfer(ctx, transfer)
+	switch {
+	case err == nil:
+		execution.Status = database.ExecutionSucceeded
+		execution.TransferID = transfer.ID
+	case ctx.Err() != nil:
+		// the transfer may have been committed right before ctx was done, so
+		// the execution is left pending
+		return ctx.Err()
+	default:
+		// the transfer is made in a single transaction, which was rolled back
+		execution.Status = database.ExecutionFailed
+		execution.Failure = failureOf(scheduled, err)
+	}
+
+	return s.db.FinishScheduledTransferExecution(ctx, execution)
+}
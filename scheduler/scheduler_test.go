@@ -0,0 +1,134 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lindebergue/desafio-go-stone/database"
+)
+
+func TestRunDue(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewInMemDB()
+
+	origin := &database.Account{Name: "origin", CPF: "111.111.111-11", Secret: "secret"}
+	destination := &database.Account{Name: "destination", CPF: "222.222.222-22", Secret: "secret"}
+	require.NoError(t, db.CreateAccount(ctx, origin))
+	require.NoError(t, db.CreateAccount(ctx, destination))
+
+	deposit := &database.CashMovement{
+		AccountID: origin.ID,
+		Type:      database.CashMovementDeposit,
+		Amount:    decimal.NewFromInt(15),
+	}
+	require.NoError(t, db.CreateCashMovement(ctx, deposit))
+
+	startAt := time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC)
+	scheduled := &database.ScheduledTransfer{
+		AccountOriginID:      origin.ID,
+		AccountDestinationID: destination.ID,
+		Amount:               decimal.NewFromInt(10),
+		Interval:             database.ScheduleMonthly,
+		StartAt:              startAt,
+	}
+	require.NoError(t, db.CreateScheduledTransfer(ctx, scheduled))
+
+	now := startAt.Add(-time.Hour)
+	s := New(Options{DB: db, Now: func() time.Time { return now }})
+
+	// nothing is due before the start date
+	require.NoError(t, s.RunDue(ctx))
+	executions, err := db.FindAllScheduledTransferExecutions(ctx, scheduled.ID)
+	require.NoError(t, err)
+	require.Empty(t, executions)
+
+	// the first run succeeds and the second one fails for lack of funds
+	now = startAt.AddDate(0, 1, 0)
+	require.NoError(t, s.RunDue(ctx))
+
+	executions, err = db.FindAllScheduledTransferExecutions(ctx, scheduled.ID)
+	require.NoError(t, err)
+	require.Len(t, executions, 2)
+
+	require.Equal(t, database.ExecutionFailed, executions[0].Status)
+	require.Equal(t, database.ErrNotEnoughFunds.Error(), executions[0].Failure)
+	require.Zero(t, executions[0].TransferID)
+
+	require.Equal(t, database.ExecutionSucceeded, executions[1].Status)
+	require.NotZero(t, executions[1].TransferID)
+	require.True(t, executions[1].ScheduledFor.Equal(startAt))
+
+	found, err := db.FindAccountByID(ctx, destination.ID)
+	require.NoError(t, err)
+	require.True(t, found.Balance.Equal(decimal.NewFromInt(10)))
+
+	// the runs are not executed again
+	require.NoError(t, s.RunDue(ctx))
+	executions, err = db.FindAllScheduledTransferExecutions(ctx, scheduled.ID)
+	require.NoError(t, err)
+	require.Len(t, executions, 2)
+}
+
+// flakyDB fails the first transfer with a connection error.
+type flakyDB struct {
+	database.DB
+	failed bool
+}
+
+func (f *flakyDB) CreateTransfer(ctx context.Context, transfer *database.Transfer) error {
+	if !f.failed {
+		f.failed = true
+		return errors.New("connection reset by peer")
+	}
+	return f.DB.CreateTransfer(ctx, transfer)
+}
+
+func TestRunDueUnexpectedError(t *testing.T) {
+	ctx := context.Background()
+	db := &flakyDB{DB: database.NewInMemDB()}
+
+	origin := &database.Account{Name: "origin", CPF: "111.111.111-11", Secret: "secret"}
+	destination := &database.Account{Name: "destination", CPF: "222.222.222-22", Secret: "secret"}
+	require.NoError(t, db.CreateAccount(ctx, origin))
+	require.NoError(t, db.CreateAccount(ctx, destination))
+	require.NoError(t, db.CreateCashMovement(ctx, &database.CashMovement{
+		AccountID: origin.ID,
+		Type:      database.CashMovementDeposit,
+		Amount:    decimal.NewFromInt(100),
+	}))
+
+	startAt := time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC)
+	var schedules []*database.ScheduledTransfer
+	for n := 0; n < 2; n++ {
+		scheduled := &database.ScheduledTransfer{
+			AccountOriginID:      origin.ID,
+			AccountDestinationID: destination.ID,
+			Amount:               decimal.NewFromInt(10),
+			Interval:             database.ScheduleOnce,
+			StartAt:              startAt,
+		}
+		require.NoError(t, db.CreateScheduledTransfer(ctx, scheduled))
+		schedules = append(schedules, scheduled)
+	}
+
+	// the failed run is recorded and the other schedules still run
+	s := New(Options{DB: db, Now: func() time.Time { return startAt }})
+	require.NoError(t, s.RunDue(ctx))
+
+	var statuses []database.ExecutionStatus
+	var failures []string
+	for _, scheduled := range schedules {
+		executions, err := db.FindAllScheduledTransferExecutions(ctx, scheduled.ID)
+		require.NoError(t, err)
+		require.Len(t, executions, 1)
+		statuses = append(statuses, executions[0].Status)
+		failures = append(failures, executions[0].Failure)
+	}
+	require.ElementsMatch(t, []database.ExecutionStatus{database.ExecutionFailed, database.ExecutionSucceeded}, statuses)
+	require.ElementsMatch(t, []string{"unexpected error", ""}, failures)
+}